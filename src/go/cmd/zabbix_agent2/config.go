@@ -21,15 +21,53 @@ package main
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"time"
 
 	"zabbix.com/internal/agent"
+	"zabbix.com/internal/agent/resultcache"
 	"zabbix.com/internal/agent/scheduler"
+	"zabbix.com/internal/agent/serverconnector"
+	"zabbix.com/pkg/conf"
 	"zabbix.com/pkg/log"
 	"zabbix.com/pkg/zbxcmd"
 )
 
+// staticOptions lists configuration parameters that cannot be changed without restarting agent.
+// Parameters not available on the current platform are ignored.
+var staticOptions = []string{
+	"LogType",
+	"LogFile",
+	"LogFileSize",
+	"DebugLevel",
+	"PidFile",
+	"EnablePersistentBuffer",
+	"PersistentBufferFile",
+	"PersistentBufferFormat",
+	"BufferSpillDir",
+	"ListenIP",
+	"ListenPort",
+	"StatusPort",
+	"ExternalPlugin",
+	"Server",
+	"ControlSocket",
+	"TLSConnect",
+	"TLSAccept",
+	"TLSPSKIdentity",
+	"TLSPSKFile",
+	"TLSCAFile",
+	"TLSCRLFile",
+	"TLSCertFile",
+	"TLSKeyFile",
+	"TLSServerCertIssuer",
+	"TLSServerCertSubject",
+	"AllowKey",
+	"DenyKey",
+	"PerfCounter",
+	"PerfCounterEn",
+}
+
 func updateHostname(taskManager scheduler.Scheduler, options *agent.AgentOptions) error {
 	var maxLen int
 	var err error
@@ -87,3 +125,167 @@ func configUpdateItemParameters(taskManager scheduler.Scheduler, options *agent.
 
 	return nil
 }
+
+// keepStaticOptions restores parameters that cannot be changed at runtime to their current values
+func keepStaticOptions(options *agent.AgentOptions, current *agent.AgentOptions) {
+	nv := reflect.ValueOf(options).Elem()
+	cv := reflect.ValueOf(current).Elem()
+
+	for _, name := range staticOptions {
+		field := nv.FieldByName(name)
+		if !field.IsValid() {
+			continue
+		}
+		value := cv.FieldByName(name)
+		if !reflect.DeepEqual(field.Interface(), value.Interface()) {
+			log.Warningf("cannot change \"%s\" configuration parameter at runtime, agent restart is required",
+				name)
+			field.Set(value)
+		}
+	}
+}
+
+// newServerConnectors returns server connectors for the address/hostname combinations. The current
+// connectors are reused, connectors for new combinations are created, but not started.
+func newServerConnectors(options *agent.AgentOptions, addresses []string, hostnames []string) (
+	connectors []*serverconnector.Connector, err error) {
+	current := make(map[string]*serverconnector.Connector)
+	for _, c := range serverConnectors {
+		current[c.Address()+"/"+c.Hostname()] = c
+	}
+
+	connectors = make([]*serverconnector.Connector, 0, len(addresses)*len(hostnames))
+	for _, address := range addresses {
+		for _, hostname := range hostnames {
+			c, ok := current[address+"/"+hostname]
+			if !ok {
+				if c, err = serverconnector.New(manager, address, hostname, options); err != nil {
+					return nil, fmt.Errorf("cannot create server connector: %s", err)
+				}
+			}
+			connectors = append(connectors, c)
+		}
+	}
+	return
+}
+
+// replaceServerConnectors stops the current connectors that are not in the new connector list,
+// starts the new ones and replaces the connector list.
+func replaceServerConnectors(options *agent.AgentOptions, connectors []*serverconnector.Connector,
+	addresses []string, hostnames []string) (err error) {
+	connectorReloadMutex.Lock()
+	defer connectorReloadMutex.Unlock()
+
+	next := make(map[*serverconnector.Connector]bool)
+	for _, c := range connectors {
+		next[c] = true
+	}
+
+	kept := make([]*serverconnector.Connector, 0, len(serverConnectors))
+	for _, c := range serverConnectors {
+		if next[c] {
+			c.UpdateOptions(options)
+			kept = append(kept, c)
+			delete(next, c)
+			continue
+		}
+		log.Infof("stopping active checks for [%s %s]", c.Address(), c.Hostname())
+		c.Remove()
+	}
+
+	if err = resultcache.Update(options, addresses, hostnames); err != nil {
+		// the removed connectors are already stopped, continue with the remaining ones
+		connectors = kept
+		err = fmt.Errorf("cannot update result cache: %s", err)
+	} else {
+		for _, c := range connectors {
+			if next[c] {
+				log.Infof("starting active checks for [%s %s]", c.Address(), c.Hostname())
+				c.Start()
+				agent.SetHostname(c.ClientID(), c.Hostname())
+			}
+		}
+	}
+
+	serverConnectorsMutex.Lock()
+	serverConnectors = connectors
+	serverConnectorsMutex.Unlock()
+
+	return
+}
+
+// reloadConfiguration reads configuration file and applies the parameters that can be changed
+// at runtime to the running agent. The new configuration is published as a copy, the options
+// being used by agent components are not modified.
+func reloadConfiguration(path string) (err error) {
+	var options agent.AgentOptions
+
+	if err = conf.Load(path, &options); err != nil {
+		return
+	}
+	if err = agent.ValidateOptions(&options); err != nil {
+		return fmt.Errorf("cannot validate configuration: %s", err)
+	}
+	keepStaticOptions(&options, agent.CurrentOptions())
+
+	if err = configUpdateItemParameters(manager, &options); err != nil {
+		return fmt.Errorf("cannot process configuration: %s", err)
+	}
+
+	var hostnames, addresses []string
+	if hostnames, err = agent.ValidateHostnames(options.Hostname); err != nil {
+		return fmt.Errorf("cannot parse the \"Hostname\" parameter: %s", err)
+	}
+	if addresses, err = serverconnector.ParseServerActive(&options); err != nil {
+		return fmt.Errorf("cannot parse the \"ServerActive\" parameter: %s", err)
+	}
+	// validate the whole configuration before applying any part of it
+	if err = manager.ValidateOptions(&options); err != nil {
+		return
+	}
+	// create connectors before applying configuration, so it is not applied if they cannot be created
+	var connectors []*serverconnector.Connector
+	if connectors, err = newServerConnectors(&options, addresses, hostnames); err != nil {
+		return
+	}
+
+	if err = manager.UpdateUserParameters(&options); err != nil {
+		return fmt.Errorf("cannot reload user parameters: %s", err)
+	}
+	if err = manager.UpdateOptions(&options); err != nil {
+		return
+	}
+
+	agent.SetOptions(&options)
+	agent.SetFirstHostname(hostnames[0])
+
+	return replaceServerConnectors(&options, connectors, addresses, hostnames)
+}
+
+// reloadUserParameters reads configuration file and replaces user parameters of the running agent
+func reloadUserParameters(path string) (err error) {
+	var options agent.AgentOptions
+
+	if err = conf.Load(path, &options); err != nil {
+		return
+	}
+	if err = agent.ValidateOptions(&options); err != nil {
+		return fmt.Errorf("cannot validate configuration: %s", err)
+	}
+	if err = manager.UpdateUserParameters(&options); err != nil {
+		return
+	}
+
+	current := *agent.CurrentOptions()
+	current.UserParameter = options.UserParameter
+	current.UnsafeUserParameters = options.UnsafeUserParameters
+	current.UserParameterDir = options.UserParameterDir
+	agent.SetOptions(&current)
+
+	// items that were not supported before can be scheduled now
+	for _, c := range getServerConnectors() {
+		c.ResetConfigRevision()
+	}
+
+	return
+}
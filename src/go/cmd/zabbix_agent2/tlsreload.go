@@ -0,0 +1,135 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/tls"
+)
+
+// tlsFileState is used to detect TLS file changes
+type tlsFileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// tlsWatcher checks TLS files for changes and reloads TLS configuration of the running agent
+type tlsWatcher struct {
+	files     map[string]tlsFileState
+	lastCheck time.Time
+}
+
+// newTLSWatcher creates watcher with the current state of TLS files
+func newTLSWatcher(options *agent.AgentOptions) (w *tlsWatcher) {
+	w = &tlsWatcher{lastCheck: time.Now()}
+	w.update(options)
+	return
+}
+
+// tlsFiles returns the global TLS files and the files of ServerActiveTLS entries
+func tlsFiles(options *agent.AgentOptions) (files []string) {
+	candidates := []string{options.TLSCAFile, options.TLSCRLFile, options.TLSCertFile, options.TLSKeyFile,
+		options.TLSPSKFile}
+	for _, o := range options.ServerActiveTLS {
+		candidates = append(candidates, o.TLSCAFile, o.TLSCRLFile, o.TLSCertFile, o.TLSKeyFile, o.TLSPSKFile)
+	}
+	for _, file := range candidates {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return
+}
+
+// update reads the current state of TLS files and returns true if any of the files has been changed
+// since the last update. The files are followed if they are symbolic links, so certificates replaced
+// by switching links are detected too.
+func (w *tlsWatcher) update(options *agent.AgentOptions) (changed bool) {
+	files := make(map[string]tlsFileState)
+	for _, file := range tlsFiles(options) {
+		var state tlsFileState
+		if fi, err := os.Stat(file); err == nil {
+			state = tlsFileState{modTime: fi.ModTime(), size: fi.Size(), exists: true}
+		}
+		if last, ok := w.files[file]; ok && last != state {
+			changed = true
+		}
+		files[file] = state
+	}
+	w.files = files
+	return
+}
+
+// check reloads TLS configuration if TLS files have been changed. Called periodically by the agent
+// main loop, the files are checked according to TLSFileCheckFrequency.
+func (w *tlsWatcher) check() {
+	options := agent.CurrentOptions()
+	if options.TLSFileCheckFrequency == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(w.lastCheck) < time.Second*time.Duration(options.TLSFileCheckFrequency) {
+		return
+	}
+	w.lastCheck = now
+
+	if !w.update(options) {
+		return
+	}
+
+	log.Infof("TLS files have been changed, reloading TLS configuration")
+	if err := reloadTLS(); err != nil {
+		log.Errf("cannot reload TLS configuration, using the previous certificates and keys: %s", err)
+		return
+	}
+	log.Infof("TLS configuration has been reloaded")
+}
+
+// reloadTLS loads the TLS files again and replaces TLS configuration of listeners and server
+// connectors. The connections being processed are finished with the previous configuration.
+func reloadTLS() (err error) {
+	var tlsConfig *tls.Config
+	if tlsConfig, err = agent.GetTLSConfig(agent.CurrentOptions()); err != nil || tlsConfig == nil {
+		return
+	}
+	if err = tls.Init(tlsConfig); err != nil {
+		return
+	}
+
+	for _, listener := range listeners {
+		if lerr := listener.ReloadTLS(); lerr != nil {
+			err = fmt.Errorf("cannot update server listener: %s", lerr)
+		}
+	}
+
+	serverConnectorsMutex.Lock()
+	for _, c := range serverConnectors {
+		c.ReloadTLS()
+	}
+	serverConnectorsMutex.Unlock()
+
+	return
+}
@@ -26,12 +26,14 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	_ "zabbix.com/plugins"
 
 	"zabbix.com/internal/agent"
+	"zabbix.com/internal/agent/external"
 	"zabbix.com/internal/agent/keyaccess"
 	"zabbix.com/internal/agent/remotecontrol"
 	"zabbix.com/internal/agent/resultcache"
@@ -53,8 +55,14 @@ const remoteCommandSendingTimeout = time.Second
 var manager *scheduler.Manager
 var listeners []*serverlistener.ServerListener
 var serverConnectors []*serverconnector.Connector
+var serverConnectorsMutex sync.Mutex
+
+// serializes connector replacement during configuration reload with active checks refresh requests,
+// so the requests are not sent to stopped connectors
+var connectorReloadMutex sync.Mutex
 var closeChan = make(chan bool)
 var stopChan = make(chan bool)
+var confPath string
 
 func processLoglevelIncreaseCommand(c *remotecontrol.Client) (err error) {
 	if log.IncreaseLogLevel() {
@@ -87,16 +95,91 @@ func processMetricsCommand(c *remotecontrol.Client) (err error) {
 	return c.Reply(data)
 }
 
+func processTasksCommand(c *remotecontrol.Client) (err error) {
+	data := manager.Query("tasks")
+	return c.Reply(data)
+}
+
 func processVersionCommand(c *remotecontrol.Client) (err error) {
 	data := version.Long()
 	return c.Reply(data)
 }
 
+func processConfigReloadCommand(c *remotecontrol.Client) (err error) {
+	if err = reloadConfiguration(confPath); err != nil {
+		log.Errf("cannot reload configuration: %s", err)
+		return fmt.Errorf("Cannot reload configuration: %s", err)
+	}
+	message := "Configuration reloaded"
+	log.Infof(message)
+	return c.Reply(message)
+}
+
+func processUserParameterReloadCommand(c *remotecontrol.Client) (err error) {
+	if err = reloadUserParameters(confPath); err != nil {
+		log.Errf("cannot reload user parameters: %s", err)
+		return fmt.Errorf("Cannot reload user parameters: %s", err)
+	}
+	message := "User parameters reloaded"
+	log.Infof(message)
+	return c.Reply(message)
+}
+
+// processActiveChecksRefreshCommand requests active check configuration update from all server
+// connectors and replies when the updates have finished. The connector can be busy with scheduled
+// update when the request is received, so the reply waits up to double of the update time.
+func processActiveChecksRefreshCommand(c *remotecontrol.Client) (err error) {
+	// the requests queued before connector is stopped by configuration reload are still processed
+	connectorReloadMutex.Lock()
+	connectors := getServerConnectors()
+	if len(connectors) == 0 {
+		connectorReloadMutex.Unlock()
+		return errors.New("No active checks servers are configured")
+	}
+
+	options := agent.CurrentOptions()
+	var timeout time.Duration
+	sinks := make([]<-chan *serverconnector.RefreshResult, len(connectors))
+	for i, connector := range connectors {
+		sinks[i] = connector.RefreshActiveChecks()
+		if t := serverconnector.RefreshTimeout(options, connector.Address()); t > timeout {
+			timeout = t
+		}
+	}
+	connectorReloadMutex.Unlock()
+
+	var reply strings.Builder
+	deadline := time.Now().Add(timeout * 2)
+	for i, sink := range sinks {
+		if i != 0 {
+			reply.WriteString("\n")
+		}
+		select {
+		case r := <-sink:
+			if r.Err != nil {
+				reply.WriteString(fmt.Sprintf("[%s %s] failed: %s", r.Address, r.Hostname, r.Err))
+			} else {
+				reply.WriteString(fmt.Sprintf("[%s %s] success: received %d items", r.Address, r.Hostname, r.Items))
+			}
+		case <-time.After(time.Until(deadline)):
+			reply.WriteString(fmt.Sprintf("[%s %s] failed: timeout while waiting for active checks refresh",
+				connectors[i].Address(), connectors[i].Hostname()))
+		}
+	}
+	log.Infof("active checks refresh requested:\n%s", reply.String())
+
+	return c.Reply(reply.String())
+}
+
 func processHelpCommand(c *remotecontrol.Client) (err error) {
 	help := `Remote control interface, available commands:
 	log_level_increase - Increase log level
 	log_level_decrease - Decrease log level
+	config_reload - Reload configuration
+	userparameter_reload - Reload user parameters
+	active_checks_refresh - Refresh active checks configuration
 	metrics - List available metrics
+	tasks - List item execution statistics
 	version - Display Agent version
 	help - Display this help message`
 	return c.Reply(help)
@@ -117,10 +200,18 @@ func processRemoteCommand(c *remotecontrol.Client) (err error) {
 		err = processLoglevelIncreaseCommand(c)
 	case "log_level_decrease":
 		err = processLoglevelDecreaseCommand(c)
+	case "config_reload":
+		err = processConfigReloadCommand(c)
+	case "userparameter_reload":
+		err = processUserParameterReloadCommand(c)
+	case "active_checks_refresh":
+		err = processActiveChecksRefreshCommand(c)
 	case "help":
 		err = processHelpCommand(c)
 	case "metrics":
 		err = processMetricsCommand(c)
+	case "tasks":
+		err = processTasksCommand(c)
 	case "version":
 		err = processVersionCommand(c)
 	default:
@@ -129,6 +220,74 @@ func processRemoteCommand(c *remotecontrol.Client) (err error) {
 	return
 }
 
+// getServerConnectors returns the current server connector list. The list can be replaced during
+// configuration reload while being accessed by status listener.
+func getServerConnectors() []*serverconnector.Connector {
+	serverConnectorsMutex.Lock()
+	defer serverConnectorsMutex.Unlock()
+	return serverConnectors
+}
+
+// getCacheStatus returns result cache state of the specified active checks client
+func getCacheStatus(clientID uint64) (status *agent.CacheStatus, err error) {
+	for _, c := range getServerConnectors() {
+		if c.ClientID() != clientID {
+			continue
+		}
+		stats := c.CacheStats()
+		status = &agent.CacheStatus{SlotsAvailable: stats.SlotsAvailable, Persistent: stats.Persistent,
+			BufferSize: stats.DiskSize}
+		if stats.OldestRecord != 0 {
+			status.OldestRecord = time.Unix(stats.OldestRecord, 0)
+		}
+		if stats.LastUpload != 0 {
+			status.LastUpload = time.Unix(stats.LastUpload, 0)
+		}
+		return
+	}
+	return nil, fmt.Errorf("Cannot find result cache of client %d.", clientID)
+}
+
+// remoteCommandTimeout returns time to wait for remote command reply. Commands communicating with
+// server or executing checks can take up to Timeout configuration parameter seconds to process,
+// active check configuration refresh - up to double of the longest configuration update time.
+func remoteCommandTimeout(command string) time.Duration {
+	if params := strings.Fields(command); len(params) != 0 {
+		switch params[0] {
+		case "config_reload":
+			return remoteCommandSendingTimeout + time.Second*time.Duration(agent.Options.Timeout)
+		case "active_checks_refresh":
+			var timeout time.Duration
+			addresses, _ := serverconnector.ParseServerActive(&agent.Options)
+			for _, address := range addresses {
+				if t := serverconnector.RefreshTimeout(&agent.Options, address); t > timeout {
+					timeout = t
+				}
+			}
+			return remoteCommandSendingTimeout + timeout*2
+		}
+	}
+	return remoteCommandSendingTimeout
+}
+
+// processRemoteClient processes remote command and closes the client connection
+func processRemoteClient(client *remotecontrol.Client) {
+	if rerr := processRemoteCommand(client); rerr != nil {
+		if rerr = client.Reply("error: " + rerr.Error()); rerr != nil {
+			log.Warningf("cannot reply to remote command: %s", rerr)
+		}
+	}
+	sendServiceStop()
+	client.Close()
+}
+
+// isBackgroundCommand returns true for remote commands waiting for servers, which are processed
+// in separate goroutine so they would not block the main loop
+func isBackgroundCommand(command string) bool {
+	params := strings.Fields(command)
+	return len(params) == 1 && params[0] == "active_checks_refresh"
+}
+
 var pidFile *pidfile.File
 
 func run() (err error) {
@@ -142,9 +301,15 @@ func run() (err error) {
 	confirmService()
 	control.Start()
 
+	watcher := newTLSWatcher(&agent.Options)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 loop:
 	for {
 		select {
+		case <-ticker.C:
+			watcher.check()
 		case sig := <-sigs:
 			switch sig {
 			case syscall.SIGINT, syscall.SIGTERM:
@@ -152,13 +317,11 @@ loop:
 				break loop
 			}
 		case client := <-control.Client():
-			if rerr := processRemoteCommand(client); rerr != nil {
-				if rerr = client.Reply("error: " + rerr.Error()); rerr != nil {
-					log.Warningf("cannot reply to remote command: %s", rerr)
-				}
+			if isBackgroundCommand(client.Request()) {
+				go processRemoteClient(client)
+			} else {
+				processRemoteClient(client)
 			}
-			sendServiceStop()
-			client.Close()
 		case serviceStop := <-closeChan:
 			if serviceStop {
 				break loop
@@ -340,6 +503,10 @@ func main() {
 			fatalExit("cannot initialize user parameters", err)
 		}
 
+		if err = external.RegisterPlugins(agent.Options.ExternalPlugin, agent.Options.Timeout); err != nil {
+			fatalExit("cannot initialize external plugins", err)
+		}
+
 		var m *scheduler.Manager
 		if m, err = scheduler.NewManager(&agent.Options); err != nil {
 			fatalExit("cannot create scheduling manager", err)
@@ -366,6 +533,7 @@ func main() {
 
 		m.Stop()
 		monitor.Wait(monitor.Scheduler)
+		external.Stop()
 		os.Exit(0)
 
 	}
@@ -381,7 +549,7 @@ func main() {
 		}
 
 		if reply, err := remotecontrol.SendCommand(agent.Options.ControlSocket, remoteCommand,
-			remoteCommandSendingTimeout); err != nil {
+			remoteCommandTimeout(remoteCommand)); err != nil {
 			log.Errf("Cannot send remote command: %s", err)
 		} else {
 			log.Infof(reply)
@@ -422,7 +590,7 @@ func main() {
 	greeting := fmt.Sprintf("Starting Zabbix Agent 2 (%s)", version.Long())
 	log.Infof(greeting)
 
-	addresses, err := serverconnector.ParseServerActive()
+	addresses, err := serverconnector.ParseServerActive(&agent.Options)
 	if err != nil {
 		fatalExit("cannot parse the \"ServerActive\" parameter", err)
 	}
@@ -443,6 +611,7 @@ func main() {
 	defer pidFile.Delete()
 
 	log.Infof("using configuration file: %s", confFlag)
+	confPath = confFlag
 
 	if err = keyaccess.LoadRules(agent.Options.AllowKey, agent.Options.DenyKey); err != nil {
 		log.Errf("Failed to load key access rules: %s", err.Error())
@@ -454,6 +623,10 @@ func main() {
 		fatalExit("cannot initialize user parameters", err)
 	}
 
+	if err = external.RegisterPlugins(agent.Options.ExternalPlugin, agent.Options.Timeout); err != nil {
+		fatalExit("cannot initialize external plugins", err)
+	}
+
 	if manager, err = scheduler.NewManager(&agent.Options); err != nil {
 		fatalExit("cannot create scheduling manager", err)
 	}
@@ -480,6 +653,7 @@ func main() {
 	}
 
 	manager.Start()
+	agent.SetInternalStatusProviders(manager.SchedulerStatus, getCacheStatus)
 
 	if err = configUpdateItemParameters(manager, &agent.Options); err != nil {
 		fatalExit("cannot process configuration", err)
@@ -523,7 +697,7 @@ func main() {
 	}
 
 	if agent.Options.StatusPort != 0 {
-		if err = statuslistener.Start(manager, confFlag); err != nil {
+		if err = statuslistener.Start(manager, confFlag, getServerConnectors); err != nil {
 			fatalExit("cannot start HTTP listener", err)
 		}
 	}
@@ -548,6 +722,7 @@ func main() {
 
 	manager.Stop()
 	monitor.Wait(monitor.Scheduler)
+	external.Stop()
 
 	// split shutdown in two steps to ensure that result cache is still running while manager is
 	// being stopped, because there might be pending exporters that could block if result cache
@@ -0,0 +1,381 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+	"unicode"
+
+	"zabbix.com/pkg/conf"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/plugin"
+)
+
+// Plugin forwards plugin requests to the external plugin process. It implements only Exporter
+// interface, the optional Collector and Configurator interfaces are added by wrappers depending
+// on the interfaces declared by plugin process during registration.
+type Plugin struct {
+	plugin.Base
+	proc    *process
+	name    string
+	period  int
+	timeout time.Duration
+	// serializes plugin process restarts and registration
+	startMutex sync.Mutex
+	// last configuration sent to plugin process, resent after restart
+	configMutex sync.Mutex
+	global      *globalOptions
+	options     interface{}
+}
+
+type collectorPlugin struct {
+	*Plugin
+}
+
+type configuratorPlugin struct {
+	*Plugin
+}
+
+type collectorConfiguratorPlugin struct {
+	*Plugin
+}
+
+var plugins []*Plugin
+
+var metricKeyPattern = regexp.MustCompile(`^[A-Za-z0-9\._-]+$`)
+
+// Export implements the Exporter interface.
+func (p *Plugin) Export(key string, params []string, ctx plugin.ContextProvider) (interface{}, error) {
+	return p.ExportWithContext(context.Background(), key, params, ctx)
+}
+
+// ExportWithContext implements the ExporterWithContext interface.
+func (p *Plugin) ExportWithContext(ctx context.Context, key string, params []string,
+	_ plugin.ContextProvider) (result interface{}, err error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	if err = p.ensure(ctx); err != nil {
+		return
+	}
+
+	r := request{Type: requestExport, Key: key, Params: params}
+	if deadline, ok := ctx.Deadline(); ok {
+		r.Timeout = int((time.Until(deadline) + time.Second - 1) / time.Second)
+	}
+
+	resp, err := p.proc.call(ctx, &r)
+	if err != nil {
+		return
+	}
+	if resp.Error != nil {
+		return nil, errors.New(*resp.Error)
+	}
+	if resp.Value == nil {
+		return nil, nil
+	}
+
+	return *resp.Value, nil
+}
+
+func (p *Plugin) collect() error {
+	return p.request(&request{Type: requestCollect})
+}
+
+func (p *Plugin) configure(global *plugin.GlobalOptions, private interface{}) {
+	p.configMutex.Lock()
+	p.global = &globalOptions{Timeout: global.Timeout, SourceIP: global.SourceIP}
+	p.options = convertOptions(private)
+	p.configMutex.Unlock()
+
+	if err := p.request(p.configureRequest()); err != nil {
+		p.Errf("cannot configure plugin: %s", err)
+	}
+}
+
+func (p *Plugin) validate(private interface{}) error {
+	return p.request(&request{Type: requestValidate, Options: convertOptions(private)})
+}
+
+func (p *Plugin) configureRequest() *request {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+
+	return &request{Type: requestConfigure, Global: p.global, Options: p.options}
+}
+
+// request sends request to the plugin process and returns the error reported by plugin
+func (p *Plugin) request(r *request) error {
+	ctx, cancel := p.withTimeout(context.Background())
+	defer cancel()
+
+	if err := p.ensure(ctx); err != nil {
+		return err
+	}
+
+	resp, err := p.proc.call(ctx, r)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return errors.New(*resp.Error)
+	}
+
+	return nil
+}
+
+// withTimeout applies the plugin timeout to contexts without deadline
+func (p *Plugin) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.timeout)
+}
+
+// ensure restarts crashed plugin process, registers it again and restores its configuration
+func (p *Plugin) ensure(ctx context.Context) (err error) {
+	p.startMutex.Lock()
+	defer p.startMutex.Unlock()
+
+	var started bool
+	if started, err = p.proc.start(); err != nil || !started {
+		return
+	}
+
+	p.Infof("restarted plugin process")
+
+	var resp *response
+	if resp, err = p.proc.call(ctx, &request{Type: requestRegister}); err != nil {
+		p.proc.stop()
+		return fmt.Errorf("cannot register plugin: %s", err)
+	}
+	if resp.Name != p.name {
+		p.proc.stop()
+		return fmt.Errorf("cannot register plugin: plugin name changed to \"%s\"", resp.Name)
+	}
+
+	if r := p.configureRequest(); r.Global != nil {
+		if resp, err = p.proc.call(ctx, r); err != nil {
+			p.proc.stop()
+			return fmt.Errorf("cannot configure plugin: %s", err)
+		}
+		if resp.Error != nil {
+			p.proc.stop()
+			return fmt.Errorf("cannot configure plugin: %s", *resp.Error)
+		}
+	}
+
+	return nil
+}
+
+// Collect implements the Collector interface.
+func (p *collectorPlugin) Collect() error {
+	return p.collect()
+}
+
+// Period implements the Collector interface.
+func (p *collectorPlugin) Period() int {
+	return p.period
+}
+
+// Configure implements the Configurator interface.
+func (p *configuratorPlugin) Configure(global *plugin.GlobalOptions, private interface{}) {
+	p.configure(global, private)
+}
+
+// Validate implements the Configurator interface.
+func (p *configuratorPlugin) Validate(private interface{}) error {
+	return p.validate(private)
+}
+
+// Collect implements the Collector interface.
+func (p *collectorConfiguratorPlugin) Collect() error {
+	return p.collect()
+}
+
+// Period implements the Collector interface.
+func (p *collectorConfiguratorPlugin) Period() int {
+	return p.period
+}
+
+// Configure implements the Configurator interface.
+func (p *collectorConfiguratorPlugin) Configure(global *plugin.GlobalOptions, private interface{}) {
+	p.configure(global, private)
+}
+
+// Validate implements the Configurator interface.
+func (p *collectorConfiguratorPlugin) Validate(private interface{}) error {
+	return p.validate(private)
+}
+
+// convertOptions converts plugin private configuration into value that can be marshaled to JSON
+func convertOptions(private interface{}) interface{} {
+	if node, ok := private.(*conf.Node); ok {
+		return nodeValue(node)
+	}
+	return nil
+}
+
+func nodeValue(node *conf.Node) interface{} {
+	var values []string
+	children := make(map[string]interface{})
+
+	for _, v := range node.Nodes {
+		switch n := v.(type) {
+		case *conf.Value:
+			values = append(values, string(n.Value))
+		case *conf.Node:
+			children[n.Name] = nodeValue(n)
+		}
+	}
+
+	switch {
+	case len(children) != 0:
+		return children
+	case len(values) == 1:
+		return values[0]
+	default:
+		return values
+	}
+}
+
+func validateMetric(m *metric, keys map[string]bool) error {
+	if !metricKeyPattern.MatchString(m.Key) {
+		return fmt.Errorf("invalid metric key \"%s\"", m.Key)
+	}
+	if len(m.Description) == 0 {
+		return fmt.Errorf("empty description of metric \"%s\"", m.Key)
+	}
+	if unicode.IsLower([]rune(m.Description)[0]) || m.Description[len(m.Description)-1] != '.' {
+		return fmt.Errorf("description of metric \"%s\" must start with capital letter and end with dot", m.Key)
+	}
+	if _, err := plugin.Get(m.Key); err == nil || keys[m.Key] {
+		return fmt.Errorf("metric \"%s\" is already registered", m.Key)
+	}
+	keys[m.Key] = true
+
+	return nil
+}
+
+// load starts plugin process and returns plugin registered by its registration response
+func load(path string, timeout time.Duration) (acc plugin.Accessor, p *Plugin, params []string, err error) {
+	p = &Plugin{proc: newProcess(path), timeout: timeout}
+	if _, err = p.proc.start(); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var resp *response
+	if resp, err = p.proc.call(ctx, &request{Type: requestRegister}); err != nil {
+		p.proc.stop()
+		return
+	}
+	defer func() {
+		if err != nil {
+			p.proc.stop()
+		}
+	}()
+
+	if resp.Error != nil {
+		return nil, nil, nil, errors.New(*resp.Error)
+	}
+	if resp.Name == "" {
+		return nil, nil, nil, errors.New("plugin name is missing")
+	}
+	if _, ok := plugin.GetPlugin(resp.Name); ok {
+		return nil, nil, nil, fmt.Errorf("plugin name \"%s\" is already registered", resp.Name)
+	}
+	if len(resp.Metrics) == 0 {
+		return nil, nil, nil, errors.New("plugin does not provide any metrics")
+	}
+	keys := make(map[string]bool)
+	for i := range resp.Metrics {
+		if err = validateMetric(&resp.Metrics[i], keys); err != nil {
+			return
+		}
+		params = append(params, resp.Metrics[i].Key, resp.Metrics[i].Description)
+	}
+
+	p.name = resp.Name
+	var exporter, collector, configurator bool
+	for _, i := range resp.Interfaces {
+		switch i {
+		case interfaceExporter:
+			exporter = true
+		case interfaceCollector:
+			collector = true
+		case interfaceConfigurator:
+			configurator = true
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown plugin interface \"%s\"", i)
+		}
+	}
+	if !exporter {
+		return nil, nil, nil, errors.New("plugin does not implement exporter interface")
+	}
+	if collector {
+		if resp.Period <= 0 {
+			return nil, nil, nil, errors.New("invalid collector period")
+		}
+		p.period = resp.Period
+	}
+
+	switch {
+	case collector && configurator:
+		acc = &collectorConfiguratorPlugin{p}
+	case collector:
+		acc = &collectorPlugin{p}
+	case configurator:
+		acc = &configuratorPlugin{p}
+	default:
+		acc = p
+	}
+
+	return
+}
+
+// RegisterPlugins starts the external plugin executables and registers the metrics provided by them.
+func RegisterPlugins(paths []string, timeout int) error {
+	for _, path := range paths {
+		acc, p, params, err := load(path, time.Duration(timeout)*time.Second)
+		if err != nil {
+			return fmt.Errorf("cannot load external plugin \"%s\": %s", path, err)
+		}
+		plugin.RegisterMetrics(acc, p.name, params...)
+		plugins = append(plugins, p)
+		log.Debugf("loaded external plugin %s from \"%s\"", p.name, path)
+	}
+
+	return nil
+}
+
+// Stop stops all external plugin processes.
+func Stop() {
+	for _, p := range plugins {
+		p.proc.close()
+	}
+}
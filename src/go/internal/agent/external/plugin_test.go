@@ -0,0 +1,193 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/plugin"
+)
+
+// TestHelperPlugin is not a real test, it's used as external plugin process by other tests.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("ZBX_EXTERNAL_PLUGIN_HELPER") != "1" {
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var r request
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		resp := response{ID: r.ID}
+		switch r.Type {
+		case requestRegister:
+			resp.Name = "ExternalTest"
+			resp.Metrics = []metric{
+				{Key: "external.echo", Description: "Returns the first parameter."},
+				{Key: "external.error", Description: "Returns error."},
+				{Key: "external.crash", Description: "Terminates the plugin process."},
+				{Key: "external.hang", Description: "Never responds."},
+			}
+			resp.Interfaces = []string{interfaceExporter, interfaceCollector}
+			resp.Period = 10
+		case requestCollect:
+		case requestExport:
+			switch r.Key {
+			case "external.echo":
+				resp.Value = &r.Params[0]
+			case "external.error":
+				msg := "test error"
+				resp.Error = &msg
+			case "external.crash":
+				os.Exit(1)
+			case "external.hang":
+				continue
+			}
+		}
+		_ = encoder.Encode(&resp)
+	}
+	os.Exit(0)
+}
+
+func helperPath(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("external plugin helper script is not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "zbx_external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "plugin.sh")
+	script := fmt.Sprintf("#!/bin/sh\nZBX_EXTERNAL_PLUGIN_HELPER=1 exec '%s' -test.run=TestHelperPlugin\n", os.Args[0])
+	if err = ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExternalPlugin(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	path := helperPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	plugin.ClearRegistry()
+	defer plugin.ClearRegistry()
+
+	if err := RegisterPlugins([]string{path}, 3); err != nil {
+		t.Fatalf("cannot register plugin: %s", err)
+	}
+	defer Stop()
+
+	acc, err := plugin.Get("external.echo")
+	if err != nil {
+		t.Fatalf("metric was not registered: %s", err)
+	}
+	if acc.Name() != "ExternalTest" {
+		t.Errorf("expected plugin name ExternalTest while got %s", acc.Name())
+	}
+	if _, ok := acc.(plugin.Collector); !ok {
+		t.Errorf("expected plugin to implement Collector interface")
+	}
+	if _, ok := acc.(plugin.Configurator); ok {
+		t.Errorf("expected plugin to not implement Configurator interface")
+	}
+
+	exporter := acc.(plugin.ExporterWithContext)
+	value, err := exporter.ExportWithContext(context.Background(), "external.echo", []string{"abc"}, nil)
+	if err != nil || value != "abc" {
+		t.Errorf("expected value abc while got %v (%v)", value, err)
+	}
+
+	if _, err = exporter.ExportWithContext(context.Background(), "external.error", nil, nil); err == nil ||
+		err.Error() != "test error" {
+		t.Errorf("expected error \"test error\" while got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = exporter.ExportWithContext(ctx, "external.hang", nil, nil); err == nil {
+		t.Errorf("expected timeout error")
+	}
+
+	if _, err = exporter.ExportWithContext(context.Background(), "external.crash", nil, nil); err == nil {
+		t.Errorf("expected error when plugin process crashes")
+	}
+
+	time.Sleep(restartInterval)
+	value, err = exporter.ExportWithContext(context.Background(), "external.echo", []string{"restarted"}, nil)
+	if err != nil || value != "restarted" {
+		t.Errorf("expected value restarted while got %v (%v)", value, err)
+	}
+}
+
+func TestProcessTimeouts(t *testing.T) {
+	path := helperPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	proc := newProcess(path)
+	if _, err := proc.start(); err != nil {
+		t.Fatalf("cannot start plugin process: %s", err)
+	}
+	defer proc.close()
+
+	proc.mutex.Lock()
+	done := proc.done
+	proc.mutex.Unlock()
+
+	for i := 0; i < maxTimeouts; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := proc.call(ctx, &request{Type: requestExport, Key: "external.hang"})
+		cancel()
+		if err == nil {
+			t.Fatalf("expected timeout error")
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected hung plugin process to be killed")
+	}
+
+	time.Sleep(restartInterval)
+	if started, err := proc.start(); err != nil || !started {
+		t.Fatalf("expected plugin process to be restarted: %v", err)
+	}
+	resp, err := proc.call(context.Background(), &request{Type: requestExport, Key: "external.echo",
+		Params: []string{"abc"}})
+	if err != nil || resp.Value == nil || *resp.Value != "abc" {
+		t.Errorf("expected value abc while got %v (%v)", resp, err)
+	}
+}
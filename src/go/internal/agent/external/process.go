@@ -0,0 +1,292 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"zabbix.com/pkg/log"
+)
+
+const (
+	// minimum interval between plugin process restarts
+	restartInterval = time.Second
+	// time given to plugin process to exit after its input has been closed
+	stopTimeout = time.Second
+	// number of consecutive request timeouts after which plugin process is considered hung and killed
+	maxTimeouts = 3
+)
+
+var errNotRunning = errors.New("plugin process is not running")
+
+// process manages external plugin process and dispatches its responses to the pending requests.
+type process struct {
+	path  string
+	mutex sync.Mutex
+	// serializes writes to plugin process input, a channel is used so waiting can be cancelled
+	writeLock chan struct{}
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	done      chan struct{}
+	pending   map[uint64]chan *response
+	lastID    uint64
+	started   time.Time
+	// number of consecutive requests the plugin process did not respond to in time
+	timeouts int
+	// set when agent is shutting down to prevent restarts
+	shutdown bool
+}
+
+func newProcess(path string) *process {
+	return &process{path: path, pending: make(map[uint64]chan *response), writeLock: make(chan struct{}, 1)}
+}
+
+// start starts plugin process if it's not running. Returns true if the process was started.
+func (p *process) start() (started bool, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.cmd != nil {
+		return false, nil
+	}
+	if p.shutdown || time.Since(p.started) < restartInterval {
+		return false, errNotRunning
+	}
+	p.started = time.Now()
+
+	cmd := exec.Command(p.path)
+	var stdin io.WriteCloser
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	var stdout, stderr io.ReadCloser
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if stderr, err = cmd.StderrPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return false, fmt.Errorf("cannot start plugin process \"%s\": %s", p.path, err)
+	}
+	log.Debugf("started external plugin process \"%s\" pid:%d", p.path, cmd.Process.Pid)
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.done = make(chan struct{})
+	p.timeouts = 0
+
+	stderrDone := make(chan struct{})
+	go p.logErrors(stderr, stderrDone)
+	go p.read(cmd, stdout, stderrDone, p.done)
+
+	return true, nil
+}
+
+// read dispatches plugin process responses until the process output is closed
+func (p *process) read(cmd *exec.Cmd, stdout io.Reader, stderrDone chan struct{}, done chan struct{}) {
+	decoder := json.NewDecoder(stdout)
+	for {
+		var r response
+		if err := decoder.Decode(&r); err != nil {
+			if err != io.EOF {
+				log.Warningf("cannot read external plugin \"%s\" response: %s", p.path, err)
+			}
+			break
+		}
+		p.mutex.Lock()
+		if sink, ok := p.pending[r.ID]; ok {
+			delete(p.pending, r.ID)
+			sink <- &r
+		}
+		p.timeouts = 0
+		p.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	if p.cmd == cmd {
+		p.cmd = nil
+		p.stdin.Close()
+		p.stdin = nil
+	}
+	for id, sink := range p.pending {
+		close(sink)
+		delete(p.pending, id)
+	}
+	p.mutex.Unlock()
+
+	// Wait closes the pipes, so error output must be read completely before it
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		log.Warningf("external plugin process \"%s\" exited: %s", p.path, err)
+	} else {
+		log.Debugf("external plugin process \"%s\" exited", p.path)
+	}
+	close(done)
+}
+
+// logErrors writes plugin process error output to agent log
+func (p *process) logErrors(stderr io.Reader, done chan struct{}) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Warningf("external plugin \"%s\": %s", p.path, scanner.Text())
+	}
+	close(done)
+}
+
+// kill kills the plugin process if it's still the current one, the process is restarted by the next request
+func (p *process) kill(cmd *exec.Cmd, reason string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cmd == cmd {
+		log.Warningf("external plugin process \"%s\" %s, killing it", p.path, reason)
+		_ = cmd.Process.Kill()
+	}
+}
+
+// cancel removes pending request and returns error describing why the context is done
+func (p *process) cancel(ctx context.Context, id uint64) error {
+	p.mutex.Lock()
+	delete(p.pending, id)
+	p.mutex.Unlock()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("Timeout occurred while waiting for plugin response.")
+	}
+	return ctx.Err()
+}
+
+// write writes data to plugin process input. The process is killed if it does not read its input
+// until the context is done, which also unblocks the pending write.
+func (p *process) write(ctx context.Context, cmd *exec.Cmd, stdin io.Writer, data []byte) (err error) {
+	select {
+	case p.writeLock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := stdin.Write(data)
+		<-p.writeLock
+		written <- err
+	}()
+
+	select {
+	case err = <-written:
+		return
+	case <-ctx.Done():
+		p.kill(cmd, "does not read requests")
+		return ctx.Err()
+	}
+}
+
+// call sends request to the plugin process and waits for response until the context is done
+func (p *process) call(ctx context.Context, r *request) (*response, error) {
+	sink := make(chan *response, 1)
+
+	p.mutex.Lock()
+	if p.cmd == nil {
+		p.mutex.Unlock()
+		return nil, errNotRunning
+	}
+	p.lastID++
+	r.ID = p.lastID
+	p.pending[r.ID] = sink
+	cmd := p.cmd
+	stdin := p.stdin
+	p.mutex.Unlock()
+
+	data, err := json.Marshal(r)
+	if err == nil {
+		data = append(data, '\n')
+		err = p.write(ctx, cmd, stdin, data)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, p.cancel(ctx, r.ID)
+		}
+		p.mutex.Lock()
+		delete(p.pending, r.ID)
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("cannot send request to plugin process: %s", err)
+	}
+
+	select {
+	case resp, ok := <-sink:
+		if !ok {
+			return nil, errors.New("plugin process exited before responding")
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			p.mutex.Lock()
+			var hung bool
+			if p.cmd == cmd {
+				p.timeouts++
+				hung = p.timeouts >= maxTimeouts
+			}
+			p.mutex.Unlock()
+			if hung {
+				p.kill(cmd, fmt.Sprintf("did not respond to %d consecutive requests", maxTimeouts))
+			}
+		}
+		return nil, p.cancel(ctx, r.ID)
+	}
+}
+
+// stop closes plugin process input and kills the process if it does not exit in time
+func (p *process) stop() {
+	p.mutex.Lock()
+	cmd := p.cmd
+	done := p.done
+	if cmd != nil {
+		p.stdin.Close()
+	}
+	p.mutex.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Warningf("external plugin process \"%s\" did not exit, killing it", p.path)
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
+
+// close stops plugin process and disables its restarting
+func (p *process) close() {
+	p.mutex.Lock()
+	p.shutdown = true
+	p.mutex.Unlock()
+
+	p.stop()
+}
@@ -0,0 +1,91 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+// Package external provides support for plugins running as separate executables.
+//
+// The agent starts the plugin executable and exchanges newline delimited JSON messages with it
+// over the plugin standard input (requests) and standard output (responses). The plugin standard
+// error output is written to the agent log. Every request has unique identifier that must be
+// copied into the corresponding response, so the plugin may process requests concurrently and
+// reply in any order. The plugin process must exit when its standard input is closed.
+//
+// Requests:
+//
+//	{"id":1,"type":"register"}
+//	{"id":2,"type":"validate","options":{...}}
+//	{"id":3,"type":"configure","global":{"timeout":3,"source_ip":""},"options":{...}}
+//	{"id":4,"type":"collect"}
+//	{"id":5,"type":"export","key":"...","params":["..."],"timeout":3}
+//
+// Responses:
+//
+//	{"id":1,"name":"...","metrics":[{"key":"...","description":"..."}],
+//	   "interfaces":["exporter","collector","configurator"],"period":10}
+//	{"id":5,"value":"..."}
+//	{"id":5,"error":"..."}
+//
+// The register request is sent right after the plugin process has been started. Exporter interface
+// is mandatory, collector and configurator interfaces are optional. Plugin private options from
+// the agent configuration file (Plugins.<name>.*) are passed as JSON object with nested parameters
+// converted to objects and repeated parameters converted to arrays of strings.
+package external
+
+const (
+	requestRegister  = "register"
+	requestValidate  = "validate"
+	requestConfigure = "configure"
+	requestCollect   = "collect"
+	requestExport    = "export"
+)
+
+const (
+	interfaceExporter     = "exporter"
+	interfaceCollector    = "collector"
+	interfaceConfigurator = "configurator"
+)
+
+type globalOptions struct {
+	Timeout  int    `json:"timeout"`
+	SourceIP string `json:"source_ip"`
+}
+
+type request struct {
+	ID      uint64         `json:"id"`
+	Type    string         `json:"type"`
+	Key     string         `json:"key,omitempty"`
+	Params  []string       `json:"params,omitempty"`
+	Timeout int            `json:"timeout,omitempty"`
+	Global  *globalOptions `json:"global,omitempty"`
+	Options interface{}    `json:"options,omitempty"`
+}
+
+type metric struct {
+	Key         string `json:"key"`
+	Description string `json:"description"`
+}
+
+type response struct {
+	ID         uint64   `json:"id"`
+	Value      *string  `json:"value,omitempty"`
+	Error      *string  `json:"error,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Metrics    []metric `json:"metrics,omitempty"`
+	Interfaces []string `json:"interfaces,omitempty"`
+	Period     int      `json:"period,omitempty"`
+}
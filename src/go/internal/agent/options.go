@@ -26,14 +26,33 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync/atomic"
 	"unicode"
 
 	"zabbix.com/pkg/plugin"
 	"zabbix.com/pkg/tls"
 )
 
+// Options contains the configuration loaded at agent startup. It must not be modified once the agent
+// components are started, the configuration reloaded at runtime is published with SetOptions().
 var Options AgentOptions
 
+var currentOptions atomic.Value
+
+// CurrentOptions returns the current agent configuration. The returned options are shared between
+// goroutines and must not be modified.
+func CurrentOptions() *AgentOptions {
+	if options, ok := currentOptions.Load().(*AgentOptions); ok {
+		return options
+	}
+	return &Options
+}
+
+// SetOptions replaces the current agent configuration after runtime configuration reload
+func SetOptions(options *AgentOptions) {
+	currentOptions.Store(options)
+}
+
 const HostNameLen = 128
 const hostNameListLen = 2048
 
@@ -211,6 +230,46 @@ func GetTLSConfig(options *AgentOptions) (cfg *tls.Config, err error) {
 	return c, nil
 }
 
+// ServerActiveTLSOptions contains TLS parameters of a ServerActive entry, configured by
+// ServerActiveTLS.<name>.<parameter> options. The parameters replace the global TLS-related
+// parameters for connections to the entry, they are not inherited.
+type ServerActiveTLSOptions struct {
+	ServerActive         string
+	TLSConnect           string `conf:"optional"`
+	TLSPSKIdentity       string `conf:"optional"`
+	TLSPSKFile           string `conf:"optional"`
+	TLSCAFile            string `conf:"optional"`
+	TLSCRLFile           string `conf:"optional"`
+	TLSCertFile          string `conf:"optional"`
+	TLSKeyFile           string `conf:"optional"`
+	TLSServerCertIssuer  string `conf:"optional"`
+	TLSServerCertSubject string `conf:"optional"`
+}
+
+// GetServerActiveTLSConfig returns TLS configuration for connections to a ServerActive entry with
+// its own TLS parameters. The parameters are validated in the same way as the global ones and the
+// certificates are loaded into a context used only by the returned configuration.
+func GetServerActiveTLSConfig(options *ServerActiveTLSOptions) (cfg *tls.Config, err error) {
+	tlsOptions := AgentOptions{
+		TLSConnect:           options.TLSConnect,
+		TLSPSKIdentity:       options.TLSPSKIdentity,
+		TLSPSKFile:           options.TLSPSKFile,
+		TLSCAFile:            options.TLSCAFile,
+		TLSCRLFile:           options.TLSCRLFile,
+		TLSCertFile:          options.TLSCertFile,
+		TLSKeyFile:           options.TLSKeyFile,
+		TLSServerCertIssuer:  options.TLSServerCertIssuer,
+		TLSServerCertSubject: options.TLSServerCertSubject,
+	}
+	if cfg, err = GetTLSConfig(&tlsOptions); err != nil || cfg == nil {
+		return
+	}
+	if err = tls.InitConfig(cfg); err != nil {
+		return nil, err
+	}
+	return
+}
+
 func GlobalOptions(all *AgentOptions) (options *plugin.GlobalOptions) {
 	options = &plugin.GlobalOptions{
 		Timeout:  Options.Timeout,
@@ -27,6 +27,12 @@ type AgentOptions struct {
 	PidFile                string   `conf:"optional"`
 	ServerActive           string   `conf:"optional"`
 	RefreshActiveChecks    int      `conf:"optional,range=30:3600,default=120"`
+	ScheduleJitter         int      `conf:"optional,range=0:60,default=0"`
+	HeartbeatFrequency     int      `conf:"optional,range=0:3600,default=0"`
+	ActiveChecksCacheDir   string   `conf:"optional"`
+	HTTPHeader             []string `conf:"optional"`
+	HTTPBearerToken        string   `conf:"optional"`
+	HTTPCAFile             string   `conf:"optional"`
 	Timeout                int      `conf:"optional,range=1:30,default=3"`
 	Hostname               string   `conf:"optional"`
 	HostnameItem           string   `conf:"optional"`
@@ -36,9 +42,13 @@ type AgentOptions struct {
 	HostInterfaceItem      string   `conf:"optional"`
 	BufferSend             int      `conf:"optional,range=1:3600,default=5"`
 	BufferSize             int      `conf:"optional,range=2:65535,default=100"`
+	BufferSpillDir         string   `conf:"optional"`
+	BufferSpillSize        int      `conf:"optional,range=8:1048576,default=128"`
 	EnablePersistentBuffer int      `conf:"optional,range=0:1,default=0"`
 	PersistentBufferPeriod int      `conf:"optional,range=60:31536000,default=3600"`
 	PersistentBufferFile   string   `conf:"optional"`
+	PersistentBufferSize   int      `conf:"optional,range=0:1048576,default=0"`
+	PersistentBufferFormat string   `conf:"optional,default=sqlite"`
 	ListenIP               string   `conf:"optional"`
 	ListenPort             int      `conf:"optional,range=1024:32767,default=10050"`
 	StatusPort             int      `conf:"optional,range=1024:32767"`
@@ -47,6 +57,7 @@ type AgentOptions struct {
 	UserParameter          []string `conf:"optional"`
 	UnsafeUserParameters   int      `conf:"optional,range=0:1,default=0"`
 	UserParameterDir       string   `conf:"optional"`
+	ExternalPlugin         []string `conf:"optional"`
 	ControlSocket          string   `conf:"optional"`
 	Alias                  []string `conf:"optional"`
 	PerfCounter            []string `conf:"optional"`
@@ -61,6 +72,9 @@ type AgentOptions struct {
 	TLSKeyFile             string   `conf:"optional"`
 	TLSServerCertIssuer    string   `conf:"optional"`
 	TLSServerCertSubject   string   `conf:"optional"`
+	TLSFileCheckFrequency  int      `conf:"optional,range=0:3600,default=0"`
+
+	ServerActiveTLS map[string]ServerActiveTLSOptions `conf:"optional"`
 
 	AllowKey interface{} `conf:"optional"`
 	DenyKey  interface{} `conf:"optional"`
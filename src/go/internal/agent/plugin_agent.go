@@ -22,6 +22,7 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"zabbix.com/pkg/plugin"
 	"zabbix.com/pkg/version"
@@ -36,12 +37,29 @@ var impl Plugin
 var hostnames = map[uint64]string{}
 var FirstHostname string
 
+// protects hostnames and FirstHostname, which can be changed by runtime configuration reload
+var hostnamesMutex sync.Mutex
+
 func SetHostname(clientID uint64, hostname string) {
+	hostnamesMutex.Lock()
+	defer hostnamesMutex.Unlock()
 	hostnames[clientID] = hostname
 }
 
+// SetFirstHostname changes the host name returned for internal clients at runtime
+func SetFirstHostname(hostname string) {
+	hostnamesMutex.Lock()
+	defer hostnamesMutex.Unlock()
+	FirstHostname = hostname
+}
+
 func getHostname(clientID uint64) string {
-	return hostnames[clientID]
+	hostnamesMutex.Lock()
+	defer hostnamesMutex.Unlock()
+	if clientID > MaxBuiltinClientID {
+		return hostnames[clientID]
+	}
+	return FirstHostname
 }
 
 // Export -
@@ -52,10 +70,7 @@ func (p *Plugin) Export(key string, params []string, ctx plugin.ContextProvider)
 
 	switch key {
 	case "agent.hostname":
-		if ctx.ClientID() > MaxBuiltinClientID {
-			return getHostname(ctx.ClientID()), nil
-		}
-		return FirstHostname, nil
+		return getHostname(ctx.ClientID()), nil
 	case "agent.ping":
 		return 1, nil
 	case "agent.version":
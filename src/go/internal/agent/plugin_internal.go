@@ -0,0 +1,204 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"zabbix.com/pkg/plugin"
+)
+
+// SchedulerStatus contains scheduler state used for agent self-monitoring
+type SchedulerStatus struct {
+	// number of tasks queued in scheduler
+	QueueLength int
+	// plugin capacity usage by plugin name
+	Plugins map[string]PluginCapacity
+	// number of unsupported active check items of the requesting client, or of all clients
+	// when requested by passive check
+	UnsupportedItems int
+}
+
+// PluginCapacity contains plugin capacity usage
+type PluginCapacity struct {
+	Used int
+	Max  int
+}
+
+// CacheStatus contains result cache state used for agent self-monitoring
+type CacheStatus struct {
+	SlotsAvailable int
+	Persistent     bool
+	// the oldest record in persistent buffer, zero if buffer is empty
+	OldestRecord time.Time
+	// the last time cache was successfully uploaded (or had nothing to upload), zero if never
+	LastUpload time.Time
+	// the persistent buffer size of the client in bytes
+	BufferSize int64
+}
+
+// InternalPlugin provides agent self-monitoring metrics
+type InternalPlugin struct {
+	plugin.Base
+	mutex           sync.Mutex
+	schedulerStatus func(clientID uint64) *SchedulerStatus
+	cacheStatus     func(clientID uint64) (*CacheStatus, error)
+}
+
+var internalImpl InternalPlugin
+
+// SetInternalStatusProviders sets functions used to obtain scheduler and result cache state
+// for agent.internal[] metrics.
+func SetInternalStatusProviders(scheduler func(clientID uint64) *SchedulerStatus,
+	cache func(clientID uint64) (*CacheStatus, error)) {
+	internalImpl.mutex.Lock()
+	defer internalImpl.mutex.Unlock()
+	internalImpl.schedulerStatus = scheduler
+	internalImpl.cacheStatus = cache
+}
+
+func (p *InternalPlugin) getSchedulerStatus(clientID uint64) (status *SchedulerStatus, err error) {
+	p.mutex.Lock()
+	provider := p.schedulerStatus
+	p.mutex.Unlock()
+	if provider == nil {
+		return nil, errors.New("Scheduler status is not available.")
+	}
+	return provider(clientID), nil
+}
+
+func (p *InternalPlugin) getCacheStatus(clientID uint64) (status *CacheStatus, err error) {
+	if clientID <= MaxBuiltinClientID {
+		return nil, errors.New("Result cache status is available only for active checks.")
+	}
+	p.mutex.Lock()
+	provider := p.cacheStatus
+	p.mutex.Unlock()
+	if provider == nil {
+		return nil, errors.New("Result cache status is not available.")
+	}
+	return provider(clientID)
+}
+
+// exportScheduler handles scheduler related agent.internal[] metrics
+func (p *InternalPlugin) exportScheduler(params []string, clientID uint64) (result interface{}, err error) {
+	status, err := p.getSchedulerStatus(clientID)
+	if err != nil {
+		return
+	}
+
+	switch params[0] {
+	case "queue":
+		if len(params) > 1 {
+			return nil, errors.New("Too many parameters.")
+		}
+		return status.QueueLength, nil
+	case "unsupported":
+		if len(params) > 1 {
+			return nil, errors.New("Too many parameters.")
+		}
+		return status.UnsupportedItems, nil
+	default:
+		if len(params) < 2 || params[1] == "" {
+			return nil, errors.New("Missing plugin name parameter.")
+		}
+		if len(params) > 3 {
+			return nil, errors.New("Too many parameters.")
+		}
+		capacity, ok := status.Plugins[params[1]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown plugin %s.", params[1])
+		}
+		var mode string
+		if len(params) == 3 {
+			mode = params[2]
+		}
+		switch mode {
+		case "", "used":
+			return capacity.Used, nil
+		case "max":
+			return capacity.Max, nil
+		case "pused":
+			if capacity.Max == 0 {
+				return 0.0, nil
+			}
+			return float64(capacity.Used) * 100 / float64(capacity.Max), nil
+		default:
+			return nil, errors.New("Invalid third parameter.")
+		}
+	}
+}
+
+// exportCache handles result cache related agent.internal[] metrics
+func (p *InternalPlugin) exportCache(params []string, clientID uint64) (result interface{}, err error) {
+	if len(params) > 1 {
+		return nil, errors.New("Too many parameters.")
+	}
+	status, err := p.getCacheStatus(clientID)
+	if err != nil {
+		return
+	}
+
+	switch params[0] {
+	case "cache_slots":
+		return status.SlotsAvailable, nil
+	case "buffer_oldest":
+		if !status.Persistent {
+			return nil, errors.New("Persistent buffer is not enabled.")
+		}
+		if status.OldestRecord.IsZero() {
+			return 0, nil
+		}
+		return int64(time.Since(status.OldestRecord).Seconds()), nil
+	case "buffer_size":
+		if !status.Persistent {
+			return nil, errors.New("Persistent buffer is not enabled.")
+		}
+		return status.BufferSize, nil
+	default:
+		if status.LastUpload.IsZero() {
+			return nil, errors.New("No data has been uploaded yet.")
+		}
+		return int64(time.Since(status.LastUpload).Seconds()), nil
+	}
+}
+
+// Export -
+func (p *InternalPlugin) Export(key string, params []string, ctx plugin.ContextProvider) (result interface{}, err error) {
+	if len(params) == 0 || params[0] == "" {
+		return nil, errors.New("Invalid first parameter.")
+	}
+
+	switch params[0] {
+	case "queue", "unsupported", "capacity":
+		return p.exportScheduler(params, ctx.ClientID())
+	case "cache_slots", "buffer_oldest", "buffer_size", "last_upload":
+		return p.exportCache(params, ctx.ClientID())
+	default:
+		return nil, errors.New("Invalid first parameter.")
+	}
+}
+
+func init() {
+	plugin.RegisterMetrics(&internalImpl, "AgentInternal",
+		"agent.internal", "Returns agent internal state for self-monitoring.")
+}
@@ -0,0 +1,117 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"zabbix.com/pkg/plugin"
+)
+
+type mockContext struct {
+	clientID uint64
+}
+
+func (c *mockContext) ClientID() uint64 {
+	return c.clientID
+}
+
+func (c *mockContext) ItemID() uint64 {
+	return 0
+}
+
+func (c *mockContext) Output() plugin.ResultWriter {
+	return nil
+}
+
+func (c *mockContext) Meta() *plugin.Meta {
+	return nil
+}
+
+func (c *mockContext) GlobalRegexp() plugin.RegexpMatcher {
+	return nil
+}
+
+func TestInternalPlugin(t *testing.T) {
+	SetInternalStatusProviders(
+		func(clientID uint64) *SchedulerStatus {
+			status := &SchedulerStatus{
+				QueueLength: 10,
+				Plugins:     map[string]PluginCapacity{"Agent": {Used: 25, Max: 100}},
+			}
+			if clientID == 101 {
+				status.UnsupportedItems = 2
+			} else {
+				status.UnsupportedItems = 5
+			}
+			return status
+		},
+		func(clientID uint64) (*CacheStatus, error) {
+			return &CacheStatus{
+				SlotsAvailable: 42,
+				Persistent:     true,
+				OldestRecord:   time.Now().Add(-time.Minute),
+				LastUpload:     time.Now(),
+				BufferSize:     4096,
+			}, nil
+		})
+	defer SetInternalStatusProviders(nil, nil)
+
+	tests := []struct {
+		params   []string
+		clientID uint64
+		result   interface{}
+		failed   bool
+	}{
+		{params: []string{"queue"}, clientID: 101, result: 10},
+		{params: []string{"unsupported"}, clientID: 101, result: 2},
+		{params: []string{"unsupported"}, clientID: PassiveChecksClientID, result: 5},
+		{params: []string{"capacity", "Agent"}, clientID: 101, result: 25},
+		{params: []string{"capacity", "Agent", "max"}, clientID: 101, result: 100},
+		{params: []string{"capacity", "Agent", "pused"}, clientID: 101, result: 25.0},
+		{params: []string{"capacity", "Unknown"}, clientID: 101, failed: true},
+		{params: []string{"capacity"}, clientID: 101, failed: true},
+		{params: []string{"cache_slots"}, clientID: 101, result: 42},
+		{params: []string{"cache_slots"}, clientID: PassiveChecksClientID, failed: true},
+		{params: []string{"buffer_oldest"}, clientID: 101, result: int64(60)},
+		{params: []string{"buffer_size"}, clientID: 101, result: int64(4096)},
+		{params: []string{"last_upload"}, clientID: 101, result: int64(0)},
+		{params: []string{"queue", "extra"}, clientID: 101, failed: true},
+		{params: []string{"unknown"}, clientID: 101, failed: true},
+		{params: []string{}, clientID: 101, failed: true},
+	}
+
+	for _, test := range tests {
+		result, err := internalImpl.Export("agent.internal", test.params, &mockContext{clientID: test.clientID})
+		if err != nil {
+			if !test.failed {
+				t.Errorf("%v: expected success while got error %s", test.params, err)
+			}
+			continue
+		}
+		if test.failed {
+			t.Errorf("%v: expected error while got success", test.params)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("%v: expected %v (%T) while got %v (%T)", test.params, test.result, test.result, result, result)
+		}
+	}
+}
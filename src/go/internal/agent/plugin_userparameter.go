@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -41,7 +42,9 @@ type UserParameterPlugin struct {
 	plugin.Base
 	parameters           map[string]*parameterInfo
 	unsafeUserParameters int
-	userParameterDir    string
+	userParameterDir     string
+	// protects user parameter configuration, which can be reloaded at runtime
+	mutex sync.RWMutex
 }
 
 var userParameter UserParameterPlugin
@@ -49,7 +52,11 @@ var userParameter UserParameterPlugin
 func (p *UserParameterPlugin) cmd(key string, params []string) (string, error) {
 	var b bytes.Buffer
 
-	parameter := p.parameters[key]
+	parameter, ok := p.parameters[key]
+	if !ok {
+		// the user parameter has been removed by configuration reload
+		return "", plugin.UnsupportedMetricError
+	}
 	s := parameter.cmd
 
 	if parameter.flexible {
@@ -107,14 +114,18 @@ func (p *UserParameterPlugin) cmd(key string, params []string) (string, error) {
 
 // Export -
 func (p *UserParameterPlugin) Export(key string, params []string, ctx plugin.ContextProvider) (result interface{}, err error) {
+	p.mutex.RLock()
 	s, err := p.cmd(key, params)
+	dir := p.userParameterDir
+	p.mutex.RUnlock()
+
 	if err != nil {
 		return nil, err
 	}
 
 	p.Debugf("executing command:'%s'", s)
 
-	stdoutStderr, err := zbxcmd.Execute(s, time.Second*time.Duration(Options.Timeout), p.userParameterDir)
+	stdoutStderr, err := zbxcmd.Execute(s, time.Second*time.Duration(CurrentOptions().Timeout), dir)
 	if err != nil {
 		return nil, err
 	}
@@ -124,29 +135,33 @@ func (p *UserParameterPlugin) Export(key string, params []string, ctx plugin.Con
 	return stdoutStderr, nil
 }
 
-func InitUserParameterPlugin(userParameterConfig []string, unsafeUserParameters int, userParameterDir string) error {
-	userParameter.parameters = make(map[string]*parameterInfo)
-	userParameter.unsafeUserParameters = unsafeUserParameters
-	userParameter.userParameterDir = userParameterDir
+// parseUserParameters parses user parameter configuration and returns the parameters mapped by
+// their keys.
+func parseUserParameters(userParameterConfig []string) (parameters map[string]*parameterInfo, err error) {
+	parameters = make(map[string]*parameterInfo)
 
 	for i := 0; i < len(userParameterConfig); i++ {
 		s := strings.SplitN(userParameterConfig[i], ",", 2)
 
 		if len(s) != 2 {
-			return fmt.Errorf("cannot add user parameter \"%s\": not comma-separated", userParameterConfig[i])
+			return nil, fmt.Errorf("cannot add user parameter \"%s\": not comma-separated", userParameterConfig[i])
 		}
 
 		key, p, err := itemutil.ParseKey(s[0])
 		if err != nil {
-			return fmt.Errorf("cannot add user parameter \"%s\": %s", userParameterConfig[i], err)
+			return nil, fmt.Errorf("cannot add user parameter \"%s\": %s", userParameterConfig[i], err)
+		}
+
+		if acc, _ := plugin.Get(key); acc != nil && acc != &userParameter {
+			return nil, fmt.Errorf(`cannot register user parameter "%s": key already used`, userParameterConfig[i])
 		}
 
-		if acc, _ := plugin.Get(key); acc != nil {
-			return fmt.Errorf(`cannot register user parameter "%s": key already used`, userParameterConfig[i])
+		if _, ok := parameters[key]; ok {
+			return nil, fmt.Errorf(`cannot register user parameter "%s": key already used`, userParameterConfig[i])
 		}
 
 		if len(strings.TrimSpace(s[1])) == 0 {
-			return fmt.Errorf("cannot add user parameter \"%s\": command is missing", userParameterConfig[i])
+			return nil, fmt.Errorf("cannot add user parameter \"%s\": command is missing", userParameterConfig[i])
 		}
 
 		parameter := &parameterInfo{cmd: s[1]}
@@ -154,12 +169,54 @@ func InitUserParameterPlugin(userParameterConfig []string, unsafeUserParameters
 		if len(p) == 1 && p[0] == "*" {
 			parameter.flexible = true
 		} else if len(p) != 0 {
-			return fmt.Errorf("cannot add user parameter \"%s\": syntax error", userParameterConfig[i])
+			return nil, fmt.Errorf("cannot add user parameter \"%s\": syntax error", userParameterConfig[i])
 		}
 
-		userParameter.parameters[key] = parameter
-		plugin.RegisterMetrics(&userParameter, "UserParameter", key, fmt.Sprintf("User parameter: %s.", s[1]))
+		parameters[key] = parameter
+	}
+
+	return parameters, nil
+}
+
+// registerUserParameters replaces user parameter configuration and user parameter metrics
+func registerUserParameters(parameters map[string]*parameterInfo, unsafeUserParameters int, userParameterDir string) {
+	userParameter.mutex.Lock()
+	userParameter.parameters = parameters
+	userParameter.unsafeUserParameters = unsafeUserParameters
+	userParameter.userParameterDir = userParameterDir
+	userParameter.mutex.Unlock()
+
+	params := make([]string, 0, len(parameters)*2)
+	for key, parameter := range parameters {
+		params = append(params, key, fmt.Sprintf("User parameter: %s.", parameter.cmd))
+	}
+	plugin.ReplaceMetrics(&userParameter, "UserParameter", params...)
+}
+
+func InitUserParameterPlugin(userParameterConfig []string, unsafeUserParameters int, userParameterDir string) error {
+	parameters, err := parseUserParameters(userParameterConfig)
+	if err != nil {
+		return err
+	}
+	registerUserParameters(parameters, unsafeUserParameters, userParameterDir)
+
+	return nil
+}
+
+// ValidateUserParameters checks that the user parameter configuration can be loaded
+func ValidateUserParameters(userParameterConfig []string) error {
+	_, err := parseUserParameters(userParameterConfig)
+	return err
+}
+
+// ReloadUserParameterPlugin replaces the registered user parameters with the new configuration.
+// The current user parameters are kept if the new configuration cannot be parsed.
+func ReloadUserParameterPlugin(userParameterConfig []string, unsafeUserParameters int, userParameterDir string) error {
+	parameters, err := parseUserParameters(userParameterConfig)
+	if err != nil {
+		return err
 	}
+	registerUserParameters(parameters, unsafeUserParameters, userParameterDir)
 
 	return nil
 }
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"fmt"
 	"testing"
 
 	"zabbix.com/pkg/plugin"
@@ -263,3 +264,58 @@ func TestUnsafeCmd(t *testing.T) {
 		}
 	})
 }
+
+func TestReloadUserParameters(t *testing.T) {
+	plugin.Metrics = make(map[string]*plugin.Metric)
+
+	if err := InitUserParameterPlugin([]string{"a,echo a", "b[*],echo $1"}, 0, ""); err != nil {
+		t.Fatalf("Plugin init failed: %s", err)
+	}
+
+	if err := ReloadUserParameterPlugin([]string{"b,echo b", "c,echo c"}, 0, ""); err != nil {
+		t.Fatalf("Plugin reload failed: %s", err)
+	}
+
+	if _, ok := plugin.Metrics["a"]; ok {
+		t.Errorf("Removed user parameter is still registered")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := plugin.Metrics[key]; !ok {
+			t.Errorf("User parameter %s is not registered", key)
+		}
+	}
+	if _, err := userParameter.cmd("a", []string{}); err == nil {
+		t.Errorf("Expected error for removed user parameter while got success")
+	}
+	if cmd, err := userParameter.cmd("b", []string{}); err != nil {
+		t.Errorf("cmd test b failed %s", err)
+	} else if cmd != "echo b" {
+		t.Errorf("cmd test b failed: expected command: [echo b] got: [%s]", cmd)
+	}
+
+	if err := ReloadUserParameterPlugin([]string{"d"}, 0, ""); err == nil {
+		t.Errorf("Expected error while got success")
+	}
+	if _, ok := plugin.Metrics["c"]; !ok {
+		t.Errorf("User parameters were changed by failed reload")
+	}
+
+	// the kept user parameters must stay registered while the metrics are being replaced
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = ReloadUserParameterPlugin([]string{"b,echo b", fmt.Sprintf("e%d,echo e", i)}, 0, "")
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			if _, err := plugin.Get("b"); err != nil {
+				t.Fatalf("Kept user parameter is not available during reload: %s", err)
+			}
+		}
+	}
+}
@@ -1,3 +1,5 @@
+// +build !nosqlite
+
 /*
 ** Zabbix
 ** Copyright (C) 2001-2021 Zabbix SIA
@@ -35,13 +37,26 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqliteSupported is false when agent is built without SQLite persistent buffer support
+const sqliteSupported = true
+
 const (
 	DbVariableNotSet = -1
-	StorageTolerance = 600
-	DataLimit        = 10000
+	// the number of oldest data records removed at once when buffer size exceeds the limit
+	EvictionLimit = 1000
+	// the estimated size of record fields other than value and event source, including SQLite
+	// row overhead
+	RecordOverhead = 64
 )
 
 type DiskCache struct {
+	// the number of rows in data and log tables, accessed atomically
+	dataRows int64
+	logRows  int64
+	// the write time of the oldest record, accessed atomically
+	oldestRecord int64
+	// the estimated size of destination records in bytes, accessed atomically
+	diskSize int64
 	*cacheData
 	storagePeriod int64
 	oldestLog     int64
@@ -49,6 +64,16 @@ type DiskCache struct {
 	serverID      int
 	database      *sql.DB
 	persistFlag   uint32
+	// the estimated size of records in data and log tables
+	dataSize int64
+	logSize  int64
+	// the destination records size limit in bytes, 0 - unlimited
+	sizeLimit int64
+	// set when buffer size exceeds the limit and there are no more data records to remove,
+	// accessed atomically
+	sizeFlag      uint32
+	lastSizeCheck time.Time
+	evicting      bool
 }
 
 func (c *DiskCache) resultFetch(rows *sql.Rows) (d *AgentData, err error) {
@@ -132,6 +157,58 @@ func (c *DiskCache) getLastID(table string) (id uint64, err error) {
 	return uint64(v), nil
 }
 
+func (c *DiskCache) countRows(table string) (count int64, err error) {
+	rows, err := c.database.Query(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+	if err != nil {
+		return
+	}
+	_, err = fetchRowAndClose(rows, &count)
+	return
+}
+
+// recordsSize returns the estimated size of table records matching the condition
+func (c *DiskCache) recordsSize(table string, condition string, args ...interface{}) (size int64, err error) {
+	rows, err := c.database.Query(fmt.Sprintf("SELECT COUNT(*),"+
+		"COALESCE(SUM(LENGTH(CAST(value AS BLOB))+LENGTH(CAST(eventsource AS BLOB))),0) FROM %s WHERE %s",
+		table, condition), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var count, length int64
+	if rows.Next() {
+		if err = rows.Scan(&count, &length); err != nil {
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return count*RecordOverhead + length, nil
+}
+
+// deleteRows deletes table records matching the condition and decrements the row counter by the
+// number of deleted rows and the size counter by their estimated size
+func (c *DiskCache) deleteRows(counter *int64, size *int64, table string, condition string,
+	args ...interface{}) (err error) {
+	var deleted int64
+	if deleted, err = c.recordsSize(table, condition, args...); err != nil {
+		return
+	}
+	var result sql.Result
+	if result, err = c.database.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, condition), args...); err != nil {
+		return
+	}
+	*size -= deleted
+	if *size < 0 {
+		*size = 0
+	}
+	if n, err := result.RowsAffected(); err == nil {
+		atomic.AddInt64(counter, -n)
+	}
+	return
+}
+
 func (c *DiskCache) updateDataRange() (err error) {
 	clock, err := c.getOldestWriteClock(tableName("data", c.serverID))
 	if err != nil {
@@ -153,6 +230,63 @@ func (c *DiskCache) updateLogRange() (err error) {
 	return
 }
 
+// checkSize removes the oldest data (non-log) records while the size of destination records
+// exceeds the limit. If there are no more data records new log records are not accepted until
+// the size is below the limit. The database file is shared by all destinations, so the records
+// size is estimated from the values stored in destination tables.
+func (c *DiskCache) checkSize() {
+	now := time.Now()
+	if now.Sub(c.lastSizeCheck) < SizeCheckInterval {
+		return
+	}
+	c.lastSizeCheck = now
+
+	for {
+		used := c.dataSize + c.logSize
+		atomic.StoreInt64(&c.diskSize, used)
+
+		if c.sizeLimit == 0 || used <= c.sizeLimit {
+			if c.evicting {
+				c.Warningf("persistent buffer size is within the limit again")
+				c.evicting = false
+			}
+			atomic.StoreUint32(&c.sizeFlag, 0)
+			return
+		}
+
+		if !c.evicting {
+			c.Warningf("persistent buffer size %d exceeds the limit of %d bytes, removing the oldest values",
+				used, c.sizeLimit)
+			c.evicting = true
+		}
+
+		if atomic.LoadInt64(&c.dataRows) == 0 {
+			atomic.StoreUint32(&c.sizeFlag, 1)
+			return
+		}
+
+		condition := fmt.Sprintf("id IN (SELECT id FROM data_%d ORDER BY id LIMIT ?)", c.serverID)
+		if err := c.deleteRows(&c.dataRows, &c.dataSize, tableName("data", c.serverID), condition,
+			EvictionLimit); err != nil {
+			c.Errf("cannot remove the oldest values from data_%d: %s", c.serverID, err)
+			return
+		}
+		if err := c.updateDataRange(); err != nil {
+			c.Errf("cannot update data clock: %s", err)
+			return
+		}
+	}
+}
+
+// updateOldestRecord publishes the oldest record time for result cache statistics
+func (c *DiskCache) updateOldestRecord() {
+	oldest := c.oldestData
+	if oldest == 0 || (c.oldestLog != 0 && c.oldestLog < oldest) {
+		oldest = c.oldestLog
+	}
+	atomic.StoreInt64(&c.oldestRecord, oldest)
+}
+
 func (c *DiskCache) upload(u Uploader) (err error) {
 	var results []*AgentData
 	var result *AgentData
@@ -216,6 +350,7 @@ func (c *DiskCache) upload(u Uploader) (err error) {
 	}
 
 	if len(results) == 0 {
+		c.uploadSucceeded()
 		return
 	}
 
@@ -239,6 +374,7 @@ func (c *DiskCache) upload(u Uploader) (err error) {
 		timeout = 60
 	}
 	if err = u.Write(data, time.Duration(timeout)*time.Second); err != nil {
+		c.uploadFailed()
 		if c.lastError == nil || err.Error() != c.lastError.Error() {
 			c.Warningf("history upload to [%s %s] started to fail: %s", u.Addr(), u.Hostname(), err)
 			c.lastError = err
@@ -246,12 +382,13 @@ func (c *DiskCache) upload(u Uploader) (err error) {
 		return
 	}
 
+	c.uploadSucceeded()
 	if c.lastError != nil {
 		c.Warningf("history upload to [%s %s] is working again", u.Addr(), u.Hostname())
 		c.lastError = nil
 	}
 	if maxDataId != 0 {
-		if _, err = c.database.Exec(fmt.Sprintf("DELETE FROM data_%d WHERE id<=?", c.serverID), maxDataId); err != nil {
+		if err = c.deleteRows(&c.dataRows, &c.dataSize, tableName("data", c.serverID), "id<=?", maxDataId); err != nil {
 			return fmt.Errorf("cannot delete from data_%d: %s", c.serverID, err)
 		}
 		if err = c.updateDataRange(); err != nil {
@@ -259,7 +396,7 @@ func (c *DiskCache) upload(u Uploader) (err error) {
 		}
 	}
 	if maxLogId != 0 {
-		if _, err = c.database.Exec(fmt.Sprintf("DELETE FROM log_%d WHERE id<=?", c.serverID), maxLogId); err != nil {
+		if err = c.deleteRows(&c.logRows, &c.logSize, tableName("log", c.serverID), "id<=?", maxLogId); err != nil {
 			return fmt.Errorf("cannot delete from log_%d: %s", c.serverID, err)
 		}
 		if err = c.updateLogRange(); err != nil {
@@ -355,8 +492,8 @@ func (c *DiskCache) write(r *plugin.Result) {
 		}
 
 		if (now - c.oldestData) > c.storagePeriod+StorageTolerance {
-			query := fmt.Sprintf("DELETE FROM data_%d WHERE clock<?", c.serverID)
-			if _, err = c.database.Exec(query, now-c.storagePeriod); err != nil {
+			if err = c.deleteRows(&c.dataRows, &c.dataSize, tableName("data", c.serverID), "clock<?",
+				now-c.storagePeriod); err != nil {
 				c.Errf("cannot delete old data from data_%d : %s", c.serverID, err)
 			}
 			c.oldestData, err = c.getOldestWriteClock(tableName("data", c.serverID))
@@ -376,6 +513,12 @@ func (c *DiskCache) write(r *plugin.Result) {
 			EventSource, EventID, EventSeverity, EventTimestamp, clock, ns)
 		if err != nil {
 			c.Errf("cannot execute SQL statement : %s", err)
+		} else if r.Persistent {
+			atomic.AddInt64(&c.logRows, 1)
+			c.logSize += int64(RecordOverhead + len(Value) + len(EventSource))
+		} else {
+			atomic.AddInt64(&c.dataRows, 1)
+			c.dataSize += int64(RecordOverhead + len(Value) + len(EventSource))
 		}
 	}
 	if err != nil {
@@ -400,6 +543,8 @@ func (c *DiskCache) run() {
 		case *agent.AgentOptions:
 			c.updateOptions(v)
 		}
+		c.checkSize()
+		c.updateOldestRecord()
 	}
 	c.Debugf("disk cache has been stopped")
 	if c.database != nil {
@@ -410,7 +555,10 @@ func (c *DiskCache) run() {
 
 func (c *DiskCache) updateOptions(options *agent.AgentOptions) {
 	c.storagePeriod = int64(options.PersistentBufferPeriod)
+	c.sizeLimit = int64(options.PersistentBufferSize) * 1048576
 	c.timeout = options.Timeout
+	// check the buffer size with the new limit
+	c.lastSizeCheck = time.Time{}
 }
 
 func (c *DiskCache) insertResultTable(table string) string {
@@ -426,7 +574,7 @@ func (c *DiskCache) init(options *agent.AgentOptions) {
 	c.updateOptions(options)
 
 	var err error
-	c.database, err = sql.Open("sqlite3", agent.Options.PersistentBufferFile)
+	c.database, err = sql.Open("sqlite3", options.PersistentBufferFile)
 	if err != nil {
 		return
 	}
@@ -453,6 +601,23 @@ func (c *DiskCache) init(options *agent.AgentOptions) {
 	if err = c.updateDataRange(); err != nil {
 		c.Errf("cannot update data clock")
 	}
+	if c.dataRows, err = c.countRows(tableName("data", c.serverID)); err != nil {
+		c.Errf("cannot count data records")
+	}
+	if c.logRows, err = c.countRows(tableName("log", c.serverID)); err != nil {
+		c.Errf("cannot count log records")
+	}
+	if c.dataSize, err = c.recordsSize(tableName("data", c.serverID), "1=1"); err != nil {
+		c.Errf("cannot obtain data records size")
+	}
+	if c.logSize, err = c.recordsSize(tableName("log", c.serverID), "1=1"); err != nil {
+		c.Errf("cannot obtain log records size")
+	}
+	if err = c.updateLogRange(); err != nil {
+		c.Errf("cannot update log clock")
+	}
+	c.checkSize()
+	c.updateOldestRecord()
 }
 
 func (c *DiskCache) Start() {
@@ -467,8 +632,196 @@ func (c *DiskCache) SlotsAvailable() int {
 
 func (c *DiskCache) PersistSlotsAvailable() int {
 
-	if atomic.LoadUint32(&c.persistFlag) == 1 {
+	if atomic.LoadUint32(&c.persistFlag) == 1 || atomic.LoadUint32(&c.sizeFlag) == 1 {
 		return 0
 	}
 	return int(^uint(0) >> 1) //Max int
 }
+
+func (c *DiskCache) Stats() Stats {
+	dataRows := atomic.LoadInt64(&c.dataRows)
+	logRows := atomic.LoadInt64(&c.logRows)
+	return Stats{
+		Persistent:       true,
+		Values:           int(dataRows + logRows),
+		PersistentValues: int(logRows),
+		SlotsAvailable:   c.SlotsAvailable(),
+		UploadFailures:   atomic.LoadUint64(&c.uploadFailures),
+		OldestRecord:     atomic.LoadInt64(&c.oldestRecord),
+		DiskSize:         atomic.LoadInt64(&c.diskSize),
+		LastUpload:       atomic.LoadInt64(&c.lastUpload),
+	}
+}
+
+// newDiskCache creates SQLite based persistent buffer
+func newDiskCache(data *cacheData, options *agent.AgentOptions) ResultCache {
+	c := &DiskCache{
+		cacheData: data,
+	}
+	c.init(options)
+	return c
+}
+
+// fetchRowAndClose fetches and scans the next row. False is returned if there are no
+// rows to fetch or an error occurred.
+func fetchRowAndClose(rows *sql.Rows, args ...interface{}) (ok bool, err error) {
+	if rows.Next() {
+		err = rows.Scan(args...)
+		rows.Close()
+		return err == nil, err
+	}
+	return false, rows.Err()
+}
+
+func createTableQuery(table string, id int) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s_%d ("+
+			"id INTEGER,"+
+			"write_clock INTEGER,"+
+			"itemid INTEGER,"+
+			"lastlogsize INTEGER,"+
+			"mtime INTEGER,"+
+			"state INTEGER,"+
+			"value TEXT,"+
+			"eventsource TEXT,"+
+			"eventid INTEGER,"+
+			"eventseverity INTEGER,"+
+			"eventtimestamp INTEGER,"+
+			"clock INTEGER,"+
+			"ns INTEGER"+
+			")",
+		table, id)
+}
+
+// prepareDiskCache registers address/hostname combinations in the persistent buffer, creating their
+// tables and dropping tables of combinations no longer used. The log data is removed when purgeLog
+// is set.
+func prepareDiskCache(options *agent.AgentOptions, addresses []string, hostnames []string, purgeLog bool) (err error) {
+	type activeCombination struct {
+		address  string
+		hostname string
+	}
+
+	var database *sql.DB
+	database, err = sql.Open("sqlite3", options.PersistentBufferFile)
+	if err != nil {
+		return fmt.Errorf("Cannot open database %s : %s.", options.PersistentBufferFile, err)
+	}
+	defer database.Close()
+
+	stmt, err := database.Prepare("CREATE TABLE IF NOT EXISTS registry (id INTEGER PRIMARY KEY,address TEXT,hostname TEXT,UNIQUE(address,hostname))")
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(); err != nil {
+		return err
+	}
+
+	var id int
+	var address string
+	var hostname string
+	ids := make([]int, 0)
+	combinations := make([]activeCombination, 0)
+	registeredCombinations := make([]activeCombination, 0)
+
+	for _, addr := range addresses {
+		for _, host := range hostnames {
+			combinations = append(combinations, activeCombination{address: addr, hostname: host})
+		}
+	}
+
+	rows, err := database.Query("SELECT id,address,hostname FROM registry")
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(&id, &address, &hostname); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		registeredCombinations = append(registeredCombinations, activeCombination{address: address, hostname: hostname})
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+addressCheck:
+	for i, cr := range registeredCombinations {
+		for _, c := range combinations {
+			if c.address == cr.address && c.hostname == cr.hostname {
+				continue addressCheck
+			}
+		}
+		if _, err = database.Exec(fmt.Sprintf("DELETE FROM registry WHERE ID = %d", ids[i])); err != nil {
+			return err
+		}
+		if _, err = database.Exec(fmt.Sprintf("DROP TABLE data_%d", ids[i])); err != nil {
+			return err
+		}
+		if _, err = database.Exec(fmt.Sprintf("DROP TABLE log_%d", ids[i])); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range combinations {
+		stmt, err = database.Prepare("INSERT OR IGNORE INTO registry (address,hostname) VALUES (?,?)")
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close()
+
+		if _, err = stmt.Exec(c.address, c.hostname); err != nil {
+			return err
+		}
+		rows, err = database.Query("SELECT id FROM registry WHERE address=? AND hostname=?", c.address, c.hostname)
+		if err != nil {
+			return err
+		}
+
+		if ok, err := fetchRowAndClose(rows, &id); !ok {
+			if err == nil {
+				err = fmt.Errorf("cannot select id for address %s hostname %s", c.address, c.hostname)
+			}
+			return err
+		}
+
+		stmt, err = database.Prepare(createTableQuery("data", id))
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close()
+
+		if _, err = stmt.Exec(); err != nil {
+			return err
+		}
+		if _, err = database.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS data_%d_1 ON data_%d (write_clock)", id, id)); err != nil {
+			return err
+		}
+
+		stmt, err = database.Prepare(createTableQuery("log", id))
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close()
+
+		if _, err = stmt.Exec(); err != nil {
+			return err
+		}
+		if _, err = database.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS log_%d_1 ON log_%d (write_clock)", id, id)); err != nil {
+			return err
+		}
+		if purgeLog {
+			if _, err = database.Exec(fmt.Sprintf("DELETE FROM log_%d", id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// +build nosqlite
+
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package resultcache
+
+import (
+	"zabbix.com/internal/agent"
+)
+
+// sqliteSupported is false when agent is built without SQLite persistent buffer support
+const sqliteSupported = false
+
+// newDiskCache is never called because Prepare rejects SQLite persistent buffer format
+func newDiskCache(data *cacheData, options *agent.AgentOptions) ResultCache {
+	panic(errSQLiteUnsupported)
+}
+
+func prepareDiskCache(options *agent.AgentOptions, addresses []string, hostnames []string, purgeLog bool) (err error) {
+	return errSQLiteUnsupported
+}
@@ -0,0 +1,148 @@
+// +build !nosqlite
+
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package resultcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/plugin"
+)
+
+func TestDiskCacheSizeLimit(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	dir, err := ioutil.TempDir("", "zbx_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent.Options = agent.AgentOptions{
+		EnablePersistentBuffer: 1,
+		PersistentBufferFile:   filepath.Join(dir, "buffer.db"),
+		PersistentBufferPeriod: 3600,
+		Timeout:                3,
+	}
+	if err = Prepare(&agent.Options, []string{""}, []string{""}); err != nil {
+		t.Fatalf("cannot prepare persistent buffer: %s", err)
+	}
+
+	cache := New(&agent.Options, 0, &mockWriter{t: t}).(*DiskCache)
+	defer cache.database.Close()
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 5000; i++ {
+		cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	for i := 0; i < 100; i++ {
+		cache.write(&plugin.Result{Itemid: 2, Value: &value, Ts: time.Now(), Persistent: true})
+	}
+
+	cache.sizeLimit = 2 * 1048576
+	cache.lastSizeCheck = time.Time{}
+	cache.checkSize()
+
+	stats := cache.Stats()
+	if stats.DiskSize == 0 {
+		t.Errorf("Expected non zero buffer size")
+	}
+	if stats.PersistentValues != 100 {
+		t.Errorf("Expected log values to be kept while got %d log values", stats.PersistentValues)
+	}
+	if dataValues := stats.Values - stats.PersistentValues; dataValues >= 5000 || dataValues == 0 {
+		t.Errorf("Expected part of the oldest data values to be removed while got %d data values", dataValues)
+	}
+	if stats.DiskSize > cache.sizeLimit {
+		t.Errorf("Expected buffer size %d to be within the limit", stats.DiskSize)
+	}
+	if cache.PersistSlotsAvailable() == 0 {
+		t.Errorf("Expected log values to be accepted")
+	}
+
+	cache.sizeLimit = 4096
+	cache.lastSizeCheck = time.Time{}
+	cache.checkSize()
+
+	stats = cache.Stats()
+	if stats.Values != stats.PersistentValues || stats.PersistentValues != 100 {
+		t.Errorf("Expected only log values to be kept while got %d values", stats.Values)
+	}
+	if cache.PersistSlotsAvailable() != 0 {
+		t.Errorf("Expected log values to be rejected when buffer is full")
+	}
+}
+
+func TestDiskCacheSharedSizeLimit(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	dir, err := ioutil.TempDir("", "zbx_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent.Options = agent.AgentOptions{
+		EnablePersistentBuffer: 1,
+		PersistentBufferFile:   filepath.Join(dir, "buffer.db"),
+		PersistentBufferPeriod: 3600,
+		PersistentBufferSize:   1,
+		Timeout:                3,
+	}
+	addresses := []string{"127.0.0.1:10051", "127.0.0.2:10051"}
+	if err = Prepare(&agent.Options, addresses, []string{"", ""}); err != nil {
+		t.Fatalf("cannot prepare persistent buffer: %s", err)
+	}
+
+	caches := make([]*DiskCache, len(addresses))
+	for i, address := range addresses {
+		caches[i] = New(&agent.Options, uint64(100+i), &mockWriter{t: t, addr: address}).(*DiskCache)
+		defer caches[i].database.Close()
+	}
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 100; i++ {
+		caches[0].write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	for i := 0; i < 2000; i++ {
+		caches[1].write(&plugin.Result{Itemid: 2, Value: &value, Ts: time.Now()})
+	}
+	for _, cache := range caches {
+		cache.lastSizeCheck = time.Time{}
+		cache.checkSize()
+	}
+
+	// the limit applies to each destination, filling the buffer of one destination must not remove
+	// values of the other
+	if stats := caches[0].Stats(); stats.Values != 100 {
+		t.Errorf("Expected values of the first destination to be kept while got %d values", stats.Values)
+	}
+	if stats := caches[1].Stats(); stats.Values >= 2000 || stats.DiskSize > caches[1].sizeLimit {
+		t.Errorf("Expected the oldest values of the second destination to be removed while got %d values of %d bytes",
+			stats.Values, stats.DiskSize)
+	}
+}
@@ -20,35 +20,38 @@ package resultcache
 
 import (
 	"encoding/json"
+	"path/filepath"
 	"sync/atomic"
 	"time"
 
 	"zabbix.com/internal/agent"
 	"zabbix.com/internal/monitor"
-	"zabbix.com/pkg/itemutil"
 	"zabbix.com/pkg/log"
 	"zabbix.com/pkg/plugin"
 	"zabbix.com/pkg/version"
 )
 
 type MemoryCache struct {
+	// the number and total size of values spilled to disk, accessed atomically
+	spillValueNum int64
+	spillSize     int64
 	*cacheData
 	results         []*AgentData
 	maxBufferSize   int32
 	totalValueNum   int32
 	persistValueNum int32
+	// the disk overflow for values not fitting in the cache, nil if disabled
+	spill *segmentStream
+	// the maximum size of spilled values in bytes
+	spillLimit int64
+	// set while there are values spilled to disk, accessed atomically
+	spillFlag uint32
 }
 
-func (c *MemoryCache) upload(u Uploader) (err error) {
-	if len(c.results) == 0 {
-		return
-	}
-
-	c.Debugf("upload history data, %d/%d value(s)", len(c.results), cap(c.results))
-
+func (c *MemoryCache) writeResults(u Uploader, results []*AgentData) (err error) {
 	request := AgentDataRequest{
 		Request: "agent data",
-		Data:    c.results,
+		Data:    results,
 		Session: c.token,
 		Host:    u.Hostname(),
 		Version: version.Short(),
@@ -61,11 +64,12 @@ func (c *MemoryCache) upload(u Uploader) (err error) {
 		return
 	}
 
-	timeout := len(c.results) * c.timeout
+	timeout := len(results) * c.timeout
 	if timeout > 60 {
 		timeout = 60
 	}
 	if err = u.Write(data, time.Duration(timeout)*time.Second); err != nil {
+		c.uploadFailed()
 		if c.lastError == nil || err.Error() != c.lastError.Error() {
 			c.Warningf("history upload to [%s] started to fail: %s %s", u.Addr(), u.Hostname(), err)
 			c.lastError = err
@@ -73,10 +77,78 @@ func (c *MemoryCache) upload(u Uploader) (err error) {
 		return
 	}
 
+	c.uploadSucceeded()
 	if c.lastError != nil {
 		c.Warningf("history upload to [%s %s] is working again", u.Addr(), u.Hostname())
 		c.lastError = nil
 	}
+	return
+}
+
+// uploadSpill uploads the oldest values spilled to disk. The values are written to disk only
+// after cache is full and uploaded, so the spilled values are always newer than the cached ones.
+func (c *MemoryCache) uploadSpill(u Uploader) (err error) {
+	if err = c.spill.sync(); err != nil {
+		c.Errf("cannot write spilled values to disk: %s", err)
+		return
+	}
+
+	var results []*AgentData
+	var id uint64
+	var offset int64
+	if results, id, offset, err = c.spill.read(DataLimit); err != nil {
+		c.Errf("cannot read spilled values: %s", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	c.Debugf("upload spilled history data, %d/%d value(s)", len(results), c.spill.records)
+
+	if err = c.writeResults(u, results); err != nil {
+		return
+	}
+
+	if err = c.spill.commit(id, offset, len(results)); err != nil {
+		c.Errf("cannot remove uploaded spilled values: %s", err)
+	}
+	c.updateSpillStats()
+
+	if c.spill.records != 0 {
+		// continue with the next batch without blocking the cache input
+		c.retry = time.AfterFunc(0, func() { c.Upload(u) })
+	}
+	return
+}
+
+func (c *MemoryCache) updateSpillStats() {
+	atomic.StoreInt64(&c.spillValueNum, c.spill.records)
+	atomic.StoreInt64(&c.spillSize, c.spill.size())
+	if c.spill.records == 0 {
+		if atomic.LoadUint32(&c.spillFlag) == 1 {
+			c.Debugf("all spilled values have been uploaded")
+		}
+		atomic.StoreUint32(&c.spillFlag, 0)
+	} else {
+		atomic.StoreUint32(&c.spillFlag, 1)
+	}
+}
+
+func (c *MemoryCache) upload(u Uploader) (err error) {
+	if len(c.results) == 0 {
+		if c.spill != nil && c.spill.records != 0 {
+			return c.uploadSpill(u)
+		}
+		c.uploadSucceeded()
+		return
+	}
+
+	c.Debugf("upload history data, %d/%d value(s)", len(c.results), cap(c.results))
+
+	if err = c.writeResults(u, c.results); err != nil {
+		return
+	}
 
 	// clear results slice to ensure that the data is garbage collected
 	c.results[0] = nil
@@ -85,8 +157,12 @@ func (c *MemoryCache) upload(u Uploader) (err error) {
 	}
 	c.results = c.results[:0]
 
-	c.totalValueNum = 0
-	c.persistValueNum = 0
+	atomic.StoreInt32(&c.totalValueNum, 0)
+	atomic.StoreInt32(&c.persistValueNum, 0)
+
+	if c.spill != nil && c.spill.records != 0 {
+		return c.uploadSpill(u)
+	}
 	return
 }
 
@@ -105,9 +181,9 @@ func (c *MemoryCache) flushOutput(u Uploader) {
 func (c *MemoryCache) addResult(result *AgentData) {
 	full := c.persistValueNum >= c.maxBufferSize/2 || c.totalValueNum >= c.maxBufferSize
 	c.results = append(c.results, result)
-	c.totalValueNum++
+	atomic.AddInt32(&c.totalValueNum, 1)
 	if result.persistent {
-		c.persistValueNum++
+		atomic.AddInt32(&c.persistValueNum, 1)
 	}
 
 	if c.persistValueNum >= c.maxBufferSize/2 || c.totalValueNum >= c.maxBufferSize {
@@ -134,7 +210,7 @@ func (c *MemoryCache) insertResult(result *AgentData) {
 		for i, r := range c.results {
 			if !r.persistent {
 				if result.persistent {
-					c.persistValueNum++
+					atomic.AddInt32(&c.persistValueNum, 1)
 				}
 				c.Debugf("cache is full, removing oldest value for itemid:%d", r.Itemid)
 				index = i
@@ -152,39 +228,42 @@ func (c *MemoryCache) insertResult(result *AgentData) {
 	c.results[len(c.results)-1] = result
 }
 
+// spillResult writes result to disk overflow, returns false if it failed
+func (c *MemoryCache) spillResult(result *AgentData) bool {
+	if c.spill.records == 0 {
+		c.Debugf("cache is full, spilling values to disk")
+	}
+	if err := c.spill.append(result); err != nil {
+		c.Errf("cannot spill value to disk: %s", err)
+		return false
+	}
+	atomic.StoreUint32(&c.spillFlag, 1)
+
+	for c.spill.size() > c.spillLimit && len(c.spill.segments) > 1 {
+		records, err := c.spill.evict()
+		if err != nil {
+			c.Errf("cannot remove the oldest spilled values: %s", err)
+			break
+		}
+		c.Warningf("spilled values exceed the limit of %d bytes, removed %d oldest spilled values",
+			c.spillLimit, records)
+	}
+	atomic.StoreInt64(&c.spillValueNum, c.spill.records)
+	atomic.StoreInt64(&c.spillSize, c.spill.size())
+	return true
+}
+
 func (c *MemoryCache) write(r *plugin.Result) {
 	c.lastDataID++
-	var value *string
-	var state *int
-	if r.Error == nil {
-		value = r.Value
-	} else {
-		errmsg := r.Error.Error()
-		value = &errmsg
-		tmp := itemutil.StateNotSupported
-		state = &tmp
-	}
-
-	var clock, ns int
-	if !r.Ts.IsZero() {
-		clock = int(r.Ts.Unix())
-		ns = r.Ts.Nanosecond()
-	}
-
-	data := &AgentData{
-		Id:             c.lastDataID,
-		Itemid:         r.Itemid,
-		LastLogsize:    r.LastLogsize,
-		Mtime:          r.Mtime,
-		Clock:          clock,
-		Ns:             ns,
-		Value:          value,
-		State:          state,
-		EventSource:    r.EventSource,
-		EventID:        r.EventID,
-		EventSeverity:  r.EventSeverity,
-		EventTimestamp: r.EventTimestamp,
-		persistent:     r.Persistent,
+	data := newAgentData(c.lastDataID, r)
+
+	// once spilling has started all values are spilled until the disk overflow is uploaded to
+	// keep the values ordered, log values are kept in memory as their upload is tracked by
+	// log items
+	if c.spill != nil && !data.persistent && (c.spill.records != 0 || c.totalValueNum >= c.maxBufferSize) {
+		if c.spillResult(data) {
+			return
+		}
 	}
 
 	if c.totalValueNum >= c.maxBufferSize {
@@ -213,17 +292,36 @@ func (c *MemoryCache) run() {
 		}
 	}
 	c.Debugf("memory cache has been stopped")
+	if c.spill != nil {
+		if err := c.spill.close(); err != nil {
+			c.Errf("cannot close spill segment: %s", err)
+		}
+	}
 	monitor.Unregister(monitor.Output)
 }
 
 func (c *MemoryCache) updateOptions(options *agent.AgentOptions) {
-	c.maxBufferSize = int32(options.BufferSize)
+	atomic.StoreInt32(&c.maxBufferSize, int32(options.BufferSize))
+	c.spillLimit = int64(options.BufferSpillSize) * 1048576
 	c.timeout = options.Timeout
 }
 
 func (c *MemoryCache) init(options *agent.AgentOptions) {
 	c.updateOptions(options)
 	c.results = make([]*AgentData, 0, c.maxBufferSize)
+
+	if options.BufferSpillDir != "" && c.uploader != nil {
+		dir := segmentCacheDir(options.BufferSpillDir, c.uploader.Addr(), c.uploader.Hostname())
+		c.spill = &segmentStream{}
+		if err := c.spill.open(filepath.Join(dir, "data")); err != nil {
+			c.Errf("cannot open spill directory: %s", err)
+			c.spill = nil
+			return
+		}
+		// values spilled before restart are uploaded first
+		c.lastDataID = c.spill.lastID
+		c.updateSpillStats()
+	}
 }
 
 func (c *MemoryCache) Start() {
@@ -242,9 +340,25 @@ func (c *MemoryCache) SlotsAvailable() int {
 }
 
 func (c *MemoryCache) PersistSlotsAvailable() int {
+	// apply back pressure to log items until the spilled values are uploaded
+	if atomic.LoadUint32(&c.spillFlag) == 1 {
+		return 0
+	}
 	slots := atomic.LoadInt32(&c.maxBufferSize)/2 - atomic.LoadInt32(&c.persistValueNum)
 	if slots < 0 {
 		slots = 0
 	}
 	return int(slots)
 }
+
+func (c *MemoryCache) Stats() Stats {
+	return Stats{
+		Values:           int(atomic.LoadInt32(&c.totalValueNum)) + int(atomic.LoadInt64(&c.spillValueNum)),
+		PersistentValues: int(atomic.LoadInt32(&c.persistValueNum)),
+		Capacity:         int(atomic.LoadInt32(&c.maxBufferSize)),
+		SlotsAvailable:   c.SlotsAvailable(),
+		UploadFailures:   atomic.LoadUint64(&c.uploadFailures),
+		LastUpload:       atomic.LoadInt64(&c.lastUpload),
+		DiskSize:         atomic.LoadInt64(&c.spillSize),
+	}
+}
@@ -37,33 +37,72 @@
 // big problem because cache buffer is not static and will be extended as required.
 // The cache limit (BufferSize) is treated more like recommendation than hard limit.
 //
+// If spilling to disk is enabled (BufferSpillDir) the results are not replaced when the
+// cache is full. Instead they are written to disk and uploaded after the cached results.
+// While there are results spilled to disk all new results are spilled too, preserving the
+// result order, and new persistent results are not accepted.
+//
 package resultcache
 
 import (
 	"crypto/md5"
-	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/itemutil"
 	"zabbix.com/pkg/log"
 	"zabbix.com/pkg/plugin"
 )
 
 const (
 	UploadRetryInterval = time.Second
+	StorageTolerance    = 600
+	DataLimit           = 10000
+	// the interval of buffer size checks
+	SizeCheckInterval = time.Second
+
+	// persistent buffer formats
+	FormatSQLite  = "sqlite"
+	FormatSegment = "segment"
 )
 
+var errSQLiteUnsupported = errors.New("\"PersistentBufferFormat\" parameter value \"sqlite\" is not supported," +
+	" agent was built without SQLite")
+
 type ResultCache interface {
 	Start()
 	Stop()
 	Upload(u Uploader)
-	// TODO: will be used once the runtime configuration reload is implemented
 	UpdateOptions(options *agent.AgentOptions)
+	Stats() Stats
+}
+
+// Stats contains result cache statistics. For persistent buffer the number of values
+// is the number of rows in data (Values-PersistentValues) and log (PersistentValues) tables.
+// For memory cache the number of values includes values spilled to disk.
+type Stats struct {
+	Persistent       bool
+	Values           int
+	PersistentValues int
+	// memory cache capacity, zero for persistent buffer
+	Capacity       int
+	SlotsAvailable int
+	UploadFailures uint64
+	// the write time of the oldest persistent buffer record (unix timestamp), zero if buffer is empty
+	OldestRecord int64
+	// the time of the last successful upload (unix timestamp), zero if there were none
+	LastUpload int64
+	// the persistent buffer size of the destination in bytes (estimated for SQLite buffer), for memory
+	// cache - the size of values spilled to disk
+	DiskSize int64
 }
 
 type AgentData struct {
@@ -99,6 +138,11 @@ type Uploader interface {
 
 // common cache data
 type cacheData struct {
+	// the number of failed history uploads, accessed atomically (must be the first field for
+	// 64-bit alignment)
+	uploadFailures uint64
+	// the time of the last successful upload, accessed atomically
+	lastUpload int64
 	log.Logger
 	input      chan interface{}
 	uploader   Uploader
@@ -118,11 +162,18 @@ func (c *cacheData) Write(result *plugin.Result) {
 	c.input <- result
 }
 
-// TODO: will be used once the runtime configuration reload is implemented
 func (c *cacheData) UpdateOptions(options *agent.AgentOptions) {
 	c.input <- options
 }
 
+func (c *cacheData) uploadFailed() {
+	atomic.AddUint64(&c.uploadFailures, 1)
+}
+
+func (c *cacheData) uploadSucceeded() {
+	atomic.StoreInt64(&c.lastUpload, time.Now().Unix())
+}
+
 func (c *cacheData) Upload(u Uploader) {
 	if u == nil {
 		u = c.uploader
@@ -136,6 +187,42 @@ func (c *cacheData) Flush() {
 	c.Upload(nil)
 }
 
+// newAgentData creates agent data record with the specified id from plugin result
+func newAgentData(id uint64, r *plugin.Result) *AgentData {
+	var value *string
+	var state *int
+	if r.Error == nil {
+		value = r.Value
+	} else {
+		errmsg := r.Error.Error()
+		value = &errmsg
+		tmp := itemutil.StateNotSupported
+		state = &tmp
+	}
+
+	var clock, ns int
+	if !r.Ts.IsZero() {
+		clock = int(r.Ts.Unix())
+		ns = r.Ts.Nanosecond()
+	}
+
+	return &AgentData{
+		Id:             id,
+		Itemid:         r.Itemid,
+		LastLogsize:    r.LastLogsize,
+		Mtime:          r.Mtime,
+		Clock:          clock,
+		Ns:             ns,
+		Value:          value,
+		State:          state,
+		EventSource:    r.EventSource,
+		EventID:        r.EventID,
+		EventSeverity:  r.EventSeverity,
+		EventTimestamp: r.EventTimestamp,
+		persistent:     r.Persistent,
+	}
+}
+
 func newToken() string {
 	h := md5.New()
 	_ = binary.Write(h, binary.LittleEndian, time.Now().UnixNano())
@@ -146,17 +233,6 @@ func tableName(prefix string, index int) string {
 	return fmt.Sprintf("%s_%d", prefix, index)
 }
 
-// fetchRowAndClose fetches and scans the next row. False is returned if there are no
-// rows to fetch or an error occurred.
-func fetchRowAndClose(rows *sql.Rows, args ...interface{}) (ok bool, err error) {
-	if rows.Next() {
-		err = rows.Scan(args...)
-		rows.Close()
-		return err == nil, err
-	}
-	return false, rows.Err()
-}
-
 func New(options *agent.AgentOptions, clientid uint64, output Uploader) ResultCache {
 	data := &cacheData{
 		Logger:   log.New(fmt.Sprintf("%d", clientid)),
@@ -172,161 +248,57 @@ func New(options *agent.AgentOptions, clientid uint64, output Uploader) ResultCa
 		}
 		c.init(options)
 		return c
-	} else {
-		c := &DiskCache{
+	} else if options.PersistentBufferFormat == FormatSegment {
+		c := &SegmentCache{
 			cacheData: data,
 		}
 		c.init(options)
 		return c
+	} else {
+		return newDiskCache(data, options)
 	}
 }
 
-func createTableQuery(table string, id int) string {
-	return fmt.Sprintf(
-		"CREATE TABLE IF NOT EXISTS %s_%d ("+
-			"id INTEGER,"+
-			"write_clock INTEGER,"+
-			"itemid INTEGER,"+
-			"lastlogsize INTEGER,"+
-			"mtime INTEGER,"+
-			"state INTEGER,"+
-			"value TEXT,"+
-			"eventsource TEXT,"+
-			"eventid INTEGER,"+
-			"eventseverity INTEGER,"+
-			"eventtimestamp INTEGER,"+
-			"clock INTEGER,"+
-			"ns INTEGER"+
-			")",
-		table, id)
-}
-
-func prepareDiskCache(options *agent.AgentOptions, addresses []string, hostnames []string) (err error) {
-	type activeCombination struct {
-		address  string
-		hostname string
-	}
-
-	var database *sql.DB
-	database, err = sql.Open("sqlite3", options.PersistentBufferFile)
-	if err != nil {
-		return fmt.Errorf("Cannot open database %s : %s.", options.PersistentBufferFile, err)
-	}
-	defer database.Close()
-
-	stmt, err := database.Prepare("CREATE TABLE IF NOT EXISTS registry (id INTEGER PRIMARY KEY,address TEXT,hostname TEXT,UNIQUE(address,hostname))")
-	if err != nil {
-		return err
+// prepareSegmentCache creates segment directories of address/hostname combinations in the root
+// directory and removes directories of combinations no longer used. The log data is removed when
+// purgeLog is set.
+func prepareSegmentCache(root string, addresses []string, hostnames []string, purgeLog bool) (err error) {
+	if err = os.MkdirAll(root, 0700); err != nil {
+		return fmt.Errorf("Cannot create directory %s : %s.", root, err)
 	}
 
-	defer stmt.Close()
-
-	if _, err = stmt.Exec(); err != nil {
-		return err
-	}
-
-	var id int
-	var address string
-	var hostname string
-	ids := make([]int, 0)
-	combinations := make([]activeCombination, 0)
-	registeredCombinations := make([]activeCombination, 0)
-
+	dirs := make(map[string]bool)
 	for _, addr := range addresses {
 		for _, host := range hostnames {
-			combinations = append(combinations, activeCombination{address: addr, hostname: host})
+			dirs[segmentCacheDir(root, addr, host)] = true
 		}
 	}
 
-	rows, err := database.Query("SELECT id,address,hostname FROM registry")
-	if err != nil {
-		return err
-	}
-
-	for rows.Next() {
-		if err = rows.Scan(&id, &address, &hostname); err != nil {
-			rows.Close()
-			return err
-		}
-		ids = append(ids, id)
-		registeredCombinations = append(registeredCombinations, activeCombination{address: address, hostname: hostname})
-	}
-	if err = rows.Err(); err != nil {
-		return err
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(root); err != nil {
+		return
 	}
-addressCheck:
-	for i, cr := range registeredCombinations {
-		for _, c := range combinations {
-			if c.address == cr.address && c.hostname == cr.hostname {
-				continue addressCheck
+	// remove only obsolete segment directories, the root directory might be shared with other data
+	for _, fi := range files {
+		dir := filepath.Join(root, fi.Name())
+		if fi.IsDir() && isSegmentCacheDir(fi.Name()) && !dirs[dir] {
+			if err = os.RemoveAll(dir); err != nil {
+				return
 			}
 		}
-		if _, err = database.Exec(fmt.Sprintf("DELETE FROM registry WHERE ID = %d", ids[i])); err != nil {
-			return err
-		}
-		if _, err = database.Exec(fmt.Sprintf("DROP TABLE data_%d", ids[i])); err != nil {
-			return err
-		}
-		if _, err = database.Exec(fmt.Sprintf("DROP TABLE log_%d", ids[i])); err != nil {
-			return err
-		}
 	}
 
-	for _, c := range combinations {
-		stmt, err = database.Prepare("INSERT OR IGNORE INTO registry (address,hostname) VALUES (?,?)")
-		if err != nil {
-			return err
-		}
-
-		defer stmt.Close()
-
-		if _, err = stmt.Exec(c.address, c.hostname); err != nil {
-			return err
-		}
-		rows, err = database.Query("SELECT id FROM registry WHERE address=? AND hostname=?", c.address, c.hostname)
-		if err != nil {
-			return err
-		}
-
-		if ok, err := fetchRowAndClose(rows, &id); !ok {
-			if err == nil {
-				err = fmt.Errorf("cannot select id for address %s hostname %s", c.address, c.hostname)
+	for dir := range dirs {
+		if purgeLog {
+			if err = os.RemoveAll(filepath.Join(dir, "log")); err != nil {
+				return
 			}
-			return err
 		}
-
-		stmt, err = database.Prepare(createTableQuery("data", id))
-		if err != nil {
-			return err
-		}
-
-		defer stmt.Close()
-
-		if _, err = stmt.Exec(); err != nil {
-			return err
-		}
-		if _, err = database.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS data_%d_1 ON data_%d (write_clock)", id, id)); err != nil {
-			return err
-		}
-
-		stmt, err = database.Prepare(createTableQuery("log", id))
-		if err != nil {
-			return err
-		}
-
-		defer stmt.Close()
-
-		if _, err = stmt.Exec(); err != nil {
-			return err
-		}
-		if _, err = database.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS log_%d_1 ON log_%d (write_clock)", id, id)); err != nil {
-			return err
-		}
-		if _, err = database.Exec(fmt.Sprintf("DELETE FROM log_%d", id)); err != nil {
-			return err
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return
 		}
 	}
-	return nil
+	return
 }
 
 func Prepare(options *agent.AgentOptions, addresses []string, hostnames []string) (err error) {
@@ -337,14 +309,47 @@ func Prepare(options *agent.AgentOptions, addresses []string, hostnames []string
 		if options.PersistentBufferFile != "" {
 			return errors.New("\"PersistentBufferFile\" parameter is not empty but \"EnablePersistentBuffer\" is not set")
 		}
+		if options.BufferSpillDir != "" {
+			return prepareSegmentCache(options.BufferSpillDir, addresses, hostnames, false)
+		}
 		return
 	}
+	if options.BufferSpillDir != "" {
+		return errors.New("\"BufferSpillDir\" parameter is not empty but \"EnablePersistentBuffer\" is set")
+	}
 
-	if err = prepareDiskCache(options, addresses, hostnames); err != nil {
+	switch options.PersistentBufferFormat {
+	case FormatSegment:
+		return prepareSegmentCache(options.PersistentBufferFile, addresses, hostnames, true)
+	case FormatSQLite, "":
+		if !sqliteSupported {
+			return errSQLiteUnsupported
+		}
+	default:
+		return fmt.Errorf("invalid \"PersistentBufferFormat\" parameter value \"%s\"", options.PersistentBufferFormat)
+	}
+
+	if err = prepareDiskCache(options, addresses, hostnames, true); err != nil {
 		if err = os.Remove(options.PersistentBufferFile); err != nil {
 			return
 		}
-		err = prepareDiskCache(options, addresses, hostnames)
+		err = prepareDiskCache(options, addresses, hostnames, true)
 	}
 	return
 }
+
+// Update updates result cache registry after runtime configuration reload. Unlike Prepare the
+// buffered log data of the remaining address/hostname combinations is preserved. The result
+// caches of removed combinations must be stopped before calling this function.
+func Update(options *agent.AgentOptions, addresses []string, hostnames []string) (err error) {
+	if options.EnablePersistentBuffer == 0 {
+		if options.BufferSpillDir != "" {
+			return prepareSegmentCache(options.BufferSpillDir, addresses, hostnames, false)
+		}
+		return
+	}
+	if options.PersistentBufferFormat == FormatSegment {
+		return prepareSegmentCache(options.PersistentBufferFile, addresses, hostnames, false)
+	}
+	return prepareDiskCache(options, addresses, hostnames, false)
+}
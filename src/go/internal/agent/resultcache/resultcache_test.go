@@ -21,7 +21,11 @@ package resultcache
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,6 +38,7 @@ type mockWriter struct {
 	counter int
 	lastid  uint64
 	t       *testing.T
+	addr    string
 }
 
 func (w *mockWriter) Write(data []byte, timeout time.Duration) (err error) {
@@ -57,7 +62,7 @@ func (w *mockWriter) Write(data []byte, timeout time.Duration) (err error) {
 }
 
 func (w *mockWriter) Addr() string {
-	return ""
+	return w.addr
 }
 
 func (w *mockWriter) CanRetry() bool {
@@ -490,3 +495,305 @@ func TestBufferFull10PersistentAndNormal(t *testing.T) {
 	cache := c.(*MemoryCache)
 	checkBuffer(t, cache, input, expected)
 }
+
+func TestSegmentCache(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	dir, err := ioutil.TempDir("", "zbx_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent.Options = agent.AgentOptions{
+		EnablePersistentBuffer: 1,
+		PersistentBufferFile:   dir,
+		PersistentBufferFormat: FormatSegment,
+		PersistentBufferPeriod: 3600,
+		Timeout:                3,
+	}
+	if err = Prepare(&agent.Options, []string{""}, []string{""}); err != nil {
+		t.Fatalf("cannot prepare persistent buffer: %s", err)
+	}
+
+	writer := &mockWriter{t: t, lastid: 1}
+	cache := New(&agent.Options, 0, writer).(*SegmentCache)
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 5000; i++ {
+		cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	for i := 0; i < 100; i++ {
+		cache.write(&plugin.Result{Itemid: 2, Value: &value, Ts: time.Now(), Persistent: true})
+	}
+	if len(cache.data.segments) < 2 {
+		t.Errorf("Expected data values to be split into several segments while got %d", len(cache.data.segments))
+	}
+
+	// the first upload succeeds
+	cache.flushOutput(writer)
+	cache.updateCounters()
+	if stats := cache.Stats(); stats.Values != 0 || stats.DiskSize != 0 {
+		t.Errorf("Expected empty buffer after upload while got %d values of %d bytes", stats.Values, stats.DiskSize)
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	for i := 0; i < 10; i++ {
+		cache.write(&plugin.Result{Itemid: 2, Value: &value, Ts: time.Now(), Persistent: true})
+	}
+	// the second upload fails, but the values are written to disk
+	cache.flushOutput(writer)
+	_ = cache.data.close()
+	_ = cache.log.close()
+
+	// append incomplete record to emulate crash during write
+	f, err := os.OpenFile(segmentPath(cache.data.dir, cache.data.segments[0].id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+
+	if err = Update(&agent.Options, []string{""}, []string{""}); err != nil {
+		t.Fatalf("cannot update persistent buffer: %s", err)
+	}
+	cache = New(&agent.Options, 0, writer).(*SegmentCache)
+	if stats := cache.Stats(); stats.Values != 20 || stats.PersistentValues != 10 {
+		t.Errorf("Expected 20 values with 10 log values after restart while got %d values with %d log values",
+			stats.Values, stats.PersistentValues)
+	}
+	if cache.lastDataID != 5120 {
+		t.Errorf("Expected last data id %d while got %d", 5120, cache.lastDataID)
+	}
+
+	writer.counter = 0
+	writer.lastid = 5101
+	cache.flushOutput(writer)
+	cache.updateCounters()
+	if stats := cache.Stats(); stats.Values != 0 {
+		t.Errorf("Expected empty buffer after upload while got %d values", stats.Values)
+	}
+	_ = cache.data.close()
+	_ = cache.log.close()
+
+	// the record ids start from the beginning after restart with empty buffer, the values written
+	// after that must not be treated as already uploaded
+	for i := 0; i < 2; i++ {
+		if err = Update(&agent.Options, []string{""}, []string{""}); err != nil {
+			t.Fatalf("cannot update persistent buffer: %s", err)
+		}
+		cache = New(&agent.Options, 0, writer).(*SegmentCache)
+		if i == 0 {
+			for j := 0; j < 10; j++ {
+				cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+			}
+			writer.counter = 1
+			cache.flushOutput(writer)
+			_ = cache.data.close()
+			_ = cache.log.close()
+		}
+	}
+	if stats := cache.Stats(); stats.Values != 10 {
+		t.Errorf("Expected 10 values after restart while got %d values", stats.Values)
+	}
+	writer.counter = 0
+	writer.lastid = 1
+	cache.flushOutput(writer)
+	if writer.lastid != 11 {
+		t.Errorf("Expected values with ids 1-10 to be uploaded while got last id %d", writer.lastid-1)
+	}
+	_ = cache.data.close()
+	_ = cache.log.close()
+}
+
+type spillWriter struct {
+	ids  []uint64
+	fail bool
+}
+
+func (w *spillWriter) Write(data []byte, timeout time.Duration) (err error) {
+	if w.fail {
+		return errors.New("mock error")
+	}
+	var request AgentDataRequest
+	_ = json.Unmarshal(data, &request)
+	for _, d := range request.Data {
+		w.ids = append(w.ids, d.Id)
+	}
+	return
+}
+
+func (w *spillWriter) Addr() string {
+	return ""
+}
+
+func (w *spillWriter) CanRetry() bool {
+	return false
+}
+
+func (w *spillWriter) Hostname() string {
+	return ""
+}
+
+func TestPrepareSegmentCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zbx_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	obsolete := segmentCacheDir(dir, "127.0.0.2:10051", "host")
+	for _, d := range []string{obsolete, filepath.Join(dir, "other"), filepath.Join(dir, "0123456789abcdeg")} {
+		if err = os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = prepareSegmentCache(dir, []string{"127.0.0.1:10051"}, []string{"host"}, false); err != nil {
+		t.Fatalf("cannot prepare segment directory: %s", err)
+	}
+
+	if _, err = os.Stat(segmentCacheDir(dir, "127.0.0.1:10051", "host")); err != nil {
+		t.Errorf("expected segment directory to be created: %s", err)
+	}
+	if _, err = os.Stat(obsolete); !os.IsNotExist(err) {
+		t.Errorf("expected obsolete segment directory to be removed")
+	}
+	for _, name := range []string{"other", "0123456789abcdeg"} {
+		if _, err = os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected unrelated directory %s to be kept: %s", name, err)
+		}
+	}
+}
+
+func TestMemoryCacheSpill(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	dir, err := ioutil.TempDir("", "zbx_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent.Options = agent.AgentOptions{
+		BufferSize:      10,
+		BufferSpillDir:  dir,
+		BufferSpillSize: 8,
+		Timeout:         3,
+	}
+	if err = Prepare(&agent.Options, []string{""}, []string{""}); err != nil {
+		t.Fatalf("cannot prepare spill directory: %s", err)
+	}
+
+	writer := &spillWriter{fail: true}
+	cache := New(&agent.Options, 0, writer).(*MemoryCache)
+
+	value := "value"
+	for i := 0; i < 25; i++ {
+		cache.write(&plugin.Result{Itemid: uint64(i % 3), Value: &value, Ts: time.Now()})
+	}
+
+	stats := cache.Stats()
+	if stats.Values != 25 || stats.DiskSize == 0 {
+		t.Errorf("Expected 25 values with 15 spilled to disk while got %d values of %d bytes on disk",
+			stats.Values, stats.DiskSize)
+	}
+	if cache.PersistSlotsAvailable() != 0 {
+		t.Errorf("Expected log values to be rejected while values are spilled")
+	}
+
+	writer.fail = false
+	cache.flushOutput(writer)
+
+	if len(writer.ids) != 25 {
+		t.Fatalf("Expected 25 uploaded values while got %d", len(writer.ids))
+	}
+	for i, id := range writer.ids {
+		if id != uint64(i+1) {
+			t.Errorf("Expected %d data id while got %d", i+1, id)
+		}
+	}
+	if stats = cache.Stats(); stats.Values != 0 || stats.DiskSize != 0 {
+		t.Errorf("Expected empty cache after upload while got %d values of %d bytes on disk",
+			stats.Values, stats.DiskSize)
+	}
+	if cache.PersistSlotsAvailable() == 0 {
+		t.Errorf("Expected log values to be accepted after spilled values are uploaded")
+	}
+
+	// the spilled values are kept after restart
+	writer.fail = true
+	for i := 0; i < 15; i++ {
+		cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	_ = cache.spill.close()
+
+	writer.fail = false
+	writer.ids = nil
+	cache = New(&agent.Options, 0, writer).(*MemoryCache)
+	if stats = cache.Stats(); stats.Values != 5 {
+		t.Errorf("Expected 5 spilled values after restart while got %d", stats.Values)
+	}
+	cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	cache.flushOutput(writer)
+	if !reflect.DeepEqual(writer.ids, []uint64{36, 37, 38, 39, 40, 41}) {
+		t.Errorf("Expected spilled values to be uploaded before new values while got %v", writer.ids)
+	}
+	_ = cache.spill.close()
+}
+
+func TestMemoryCacheSpillLimit(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	dir, err := ioutil.TempDir("", "zbx_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent.Options = agent.AgentOptions{
+		BufferSize:      10,
+		BufferSpillDir:  dir,
+		BufferSpillSize: 8,
+		Timeout:         3,
+	}
+	if err = Prepare(&agent.Options, []string{""}, []string{""}); err != nil {
+		t.Fatalf("cannot prepare spill directory: %s", err)
+	}
+
+	writer := &spillWriter{fail: true}
+	cache := New(&agent.Options, 0, writer).(*MemoryCache)
+	defer cache.spill.close()
+	cache.spillLimit = SegmentSize
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 10000; i++ {
+		cache.write(&plugin.Result{Itemid: 1, Value: &value, Ts: time.Now()})
+	}
+	// log values are kept in memory even while values are spilled
+	cache.write(&plugin.Result{Itemid: 2, Value: &value, Ts: time.Now(), Persistent: true})
+
+	stats := cache.Stats()
+	if stats.DiskSize > 2*SegmentSize {
+		t.Errorf("Expected spilled values size to be limited while got %d bytes", stats.DiskSize)
+	}
+	if stats.Values >= 10001 || stats.PersistentValues != 1 {
+		t.Errorf("Expected the oldest spilled values to be removed and log value to be kept while got %d values"+
+			" with %d log values", stats.Values, stats.PersistentValues)
+	}
+
+	writer.fail = false
+	cache.flushOutput(writer)
+	for cache.spill.records != 0 {
+		cache.flushOutput(writer)
+	}
+	if len(writer.ids) != stats.Values {
+		t.Fatalf("Expected %d uploaded values while got %d", stats.Values, len(writer.ids))
+	}
+	// the memory cache values are uploaded first followed by the newest spilled values
+	if writer.ids[len(writer.ids)-1] != 10000 {
+		t.Errorf("Expected the newest spilled value to be kept while got last id %d", writer.ids[len(writer.ids)-1])
+	}
+}
@@ -0,0 +1,436 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package resultcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segmented append-only log used by segment cache. Each stream is a directory containing segment
+// files named by the id of their first record and a position file with the segment id and offset
+// of the first record not uploaded yet. The segment record consists of 4 byte payload length,
+// 4 byte payload CRC32 checksum (both little endian) and the agent data JSON as payload.
+const (
+	segmentExt       = ".seg"
+	positionFileName = "position"
+	recordHeaderSize = 8
+	maxRecordSize    = 16 * 1048576
+	// maximum segment file size, new segment is started when exceeded
+	SegmentSize = 4 * 1048576
+)
+
+var errInvalidRecord = errors.New("invalid record")
+
+type segment struct {
+	// the id of the first record
+	id      uint64
+	size    int64
+	records int64
+	// the segment creation and last write times
+	created  time.Time
+	modified time.Time
+}
+
+// segmentStream is a sequence of segments containing records in the write order
+type segmentStream struct {
+	dir      string
+	segments []*segment
+	// the segment being written, always the last segment
+	file   *os.File
+	writer *bufio.Writer
+	// the read position - segment id and offset of the first record not uploaded yet
+	readID     uint64
+	readOffset int64
+	// the number of records not uploaded yet
+	records int64
+	// the last record id
+	lastID uint64
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// readRecord reads single record, returns io.EOF at the end of the segment
+func readRecord(r io.Reader) (data *AgentData, size int64, err error) {
+	var header [recordHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errInvalidRecord
+		}
+		return
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length > maxRecordSize {
+		return nil, 0, errInvalidRecord
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, 0, errInvalidRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, errInvalidRecord
+	}
+	data = &AgentData{}
+	if err = json.Unmarshal(payload, data); err != nil {
+		return nil, 0, errInvalidRecord
+	}
+	return data, recordHeaderSize + int64(length), nil
+}
+
+// scanSegment counts segment records starting with the specified offset. The segment is truncated
+// after the last valid record.
+func scanSegment(path string, offset int64) (records int64, size int64, lastID uint64, err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	r := bufio.NewReader(f)
+	size = offset
+	for {
+		data, n, rerr := readRecord(r)
+		if rerr != nil {
+			if rerr != io.EOF {
+				// incomplete record written before agent crash
+				err = f.Truncate(size)
+			}
+			return
+		}
+		size += n
+		records++
+		lastID = data.Id
+	}
+}
+
+// open loads the stream segments and read position, creating the stream directory if necessary
+func (s *segmentStream) open(dir string) (err error) {
+	s.dir = dir
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), segmentExt) {
+			continue
+		}
+		var id uint64
+		if id, err = strconv.ParseUint(strings.TrimSuffix(fi.Name(), segmentExt), 10, 64); err != nil {
+			return fmt.Errorf("invalid segment file name %s", fi.Name())
+		}
+		s.segments = append(s.segments, &segment{id: id, created: fi.ModTime(), modified: fi.ModTime()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	for _, seg := range s.segments {
+		var lastID uint64
+		if seg.records, seg.size, lastID, err = scanSegment(segmentPath(dir, seg.id), 0); err != nil {
+			return
+		}
+		if lastID > s.lastID {
+			s.lastID = lastID
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, positionFileName)); err == nil {
+		if _, err = fmt.Sscanf(string(data), "%d %d", &s.readID, &s.readOffset); err != nil {
+			s.readID, s.readOffset = 0, 0
+		}
+	}
+	// Segments before the read position are removed before the position is saved, so the position
+	// must refer to existing segment. Otherwise it's left from the records uploaded before the ids
+	// started from the beginning and must be ignored.
+	if s.readID != 0 && !s.hasSegment(s.readID) {
+		if err = s.resetPosition(); err != nil {
+			return
+		}
+	}
+
+	for _, seg := range s.segments {
+		switch {
+		case seg.id < s.readID:
+			continue
+		case seg.id == s.readID:
+			if s.readOffset > seg.size {
+				s.readOffset = seg.size
+			}
+			var records int64
+			if records, _, _, err = scanSegment(segmentPath(dir, seg.id), s.readOffset); err != nil {
+				return
+			}
+			s.records += records
+		default:
+			s.records += seg.records
+		}
+	}
+	// remove already uploaded segments
+	for len(s.segments) != 0 && s.segments[0].id < s.readID {
+		if err = os.Remove(segmentPath(dir, s.segments[0].id)); err != nil {
+			return
+		}
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+// append writes record to the current segment, starting new segment if necessary. The record is
+// buffered until the stream is synced.
+func (s *segmentStream) append(data *AgentData) (err error) {
+	var payload []byte
+	if payload, err = json.Marshal(data); err != nil {
+		return
+	}
+
+	if s.file == nil || s.segments[len(s.segments)-1].size >= SegmentSize {
+		if err = s.close(); err != nil {
+			return
+		}
+		if s.file, err = os.OpenFile(segmentPath(s.dir, data.Id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+			return
+		}
+		s.writer = bufio.NewWriterSize(s.file, 65536)
+		now := time.Now()
+		s.segments = append(s.segments, &segment{id: data.Id, created: now, modified: now})
+	}
+
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err = s.writer.Write(header[:]); err != nil {
+		return
+	}
+	if _, err = s.writer.Write(payload); err != nil {
+		return
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(recordHeaderSize + len(payload))
+	seg.records++
+	seg.modified = time.Now()
+	s.records++
+	s.lastID = data.Id
+
+	return nil
+}
+
+// sync flushes buffered records and commits the current segment to disk
+func (s *segmentStream) sync() (err error) {
+	if s.file == nil {
+		return
+	}
+	if err = s.writer.Flush(); err != nil {
+		return
+	}
+	return s.file.Sync()
+}
+
+// close syncs and closes the current segment, so next record will start a new segment
+func (s *segmentStream) close() (err error) {
+	if s.file == nil {
+		return
+	}
+	err = s.sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	s.writer = nil
+	return
+}
+
+// read reads up to limit records starting with the read position. Returns the records and the
+// position after the last returned record. The stream must be synced before reading.
+func (s *segmentStream) read(limit int) (results []*AgentData, id uint64, offset int64, err error) {
+	id, offset = s.readID, s.readOffset
+	for _, seg := range s.segments {
+		if seg.id < s.readID {
+			continue
+		}
+		if seg.id != id {
+			id, offset = seg.id, 0
+		}
+		if offset >= seg.size {
+			continue
+		}
+
+		var f *os.File
+		if f, err = os.Open(segmentPath(s.dir, seg.id)); err != nil {
+			return
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return
+		}
+		r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+		for len(results) < limit && offset < seg.size {
+			var data *AgentData
+			var n int64
+			if data, n, err = readRecord(r); err != nil {
+				f.Close()
+				return nil, 0, 0, fmt.Errorf("cannot read segment %s: %s", segmentPath(s.dir, seg.id), err)
+			}
+			results = append(results, data)
+			offset += n
+		}
+		f.Close()
+
+		if len(results) == limit {
+			break
+		}
+	}
+	return
+}
+
+// commit moves the read position after the uploaded records and removes uploaded segments
+func (s *segmentStream) commit(id uint64, offset int64, records int) (err error) {
+	s.readID, s.readOffset = id, offset
+	s.records -= int64(records)
+
+	for len(s.segments) != 0 {
+		seg := s.segments[0]
+		if seg.id > s.readID || (seg.id == s.readID && s.readOffset < seg.size) {
+			break
+		}
+		if err = s.removeFirst(); err != nil {
+			return
+		}
+	}
+
+	if len(s.segments) == 0 {
+		return s.resetPosition()
+	}
+	return s.savePosition()
+}
+
+// hasSegment returns true if the stream contains segment with the specified id
+func (s *segmentStream) hasSegment(id uint64) bool {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFirst removes the oldest segment
+func (s *segmentStream) removeFirst() (err error) {
+	seg := s.segments[0]
+	if len(s.segments) == 1 && s.file != nil {
+		if err = s.close(); err != nil {
+			return
+		}
+	}
+	if err = os.Remove(segmentPath(s.dir, seg.id)); err != nil {
+		return
+	}
+	s.segments = s.segments[1:]
+	return
+}
+
+// evict removes the oldest segment with records not uploaded yet. Returns the number of removed
+// records.
+func (s *segmentStream) evict() (records int64, err error) {
+	if len(s.segments) == 0 {
+		return
+	}
+	// all segments except the first one contain only records not uploaded yet
+	records = s.records
+	for _, seg := range s.segments[1:] {
+		records -= seg.records
+	}
+	if err = s.removeFirst(); err != nil {
+		return
+	}
+	s.records -= records
+	if len(s.segments) == 0 {
+		return records, s.resetPosition()
+	}
+	s.readID, s.readOffset = s.segments[0].id, 0
+	return records, s.savePosition()
+}
+
+// resetPosition resets the read position to the start of the stream and removes the position file.
+// It's done when there are no segments left, so records with restarted ids are not treated as
+// already uploaded.
+func (s *segmentStream) resetPosition() (err error) {
+	s.readID, s.readOffset = 0, 0
+	if err = os.Remove(filepath.Join(s.dir, positionFileName)); err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// savePosition writes the read position to disk
+func (s *segmentStream) savePosition() (err error) {
+	path := filepath.Join(s.dir, positionFileName)
+	tmp := path + ".tmp"
+	var f *os.File
+	if f, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+		return
+	}
+	if _, err = fmt.Fprintf(f, "%d %d\n", s.readID, s.readOffset); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// size returns the total size of stream segments
+func (s *segmentStream) size() (size int64) {
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return
+}
+
+// oldest returns the creation time of the oldest segment containing records not uploaded yet
+func (s *segmentStream) oldest() time.Time {
+	if s.records == 0 || len(s.segments) == 0 {
+		return time.Time{}
+	}
+	return s.segments[0].created
+}
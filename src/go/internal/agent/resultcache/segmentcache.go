@@ -0,0 +1,387 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package resultcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/internal/monitor"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/plugin"
+	"zabbix.com/pkg/version"
+)
+
+// SegmentCache is persistent buffer keeping values in append-only segment files. The values are
+// written to disk before each upload and the uploaded segments are removed.
+type SegmentCache struct {
+	// the number of values in data and log streams, accessed atomically
+	dataRows int64
+	logRows  int64
+	// the write time of the oldest record, accessed atomically
+	oldestRecord int64
+	// the total size of segment files in bytes, accessed atomically
+	diskSize int64
+	*cacheData
+	data          segmentStream
+	log           segmentStream
+	storagePeriod int64
+	persistFlag   uint32
+	// the buffer size limit in bytes, 0 - unlimited
+	sizeLimit int64
+	// set when buffer size exceeds the limit and there are no more data segments to remove,
+	// accessed atomically
+	sizeFlag      uint32
+	lastSizeCheck time.Time
+	evicting      bool
+}
+
+// segmentCacheDir returns the segment directory of the address/hostname combination
+func segmentCacheDir(root string, address string, hostname string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(address + "/" + hostname))
+	return filepath.Join(root, fmt.Sprintf("%016x", h.Sum64()))
+}
+
+// isSegmentCacheDir returns true if the directory name matches segment directory name format
+func isSegmentCacheDir(name string) bool {
+	if len(name) != 16 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *SegmentCache) updateCounters() {
+	atomic.StoreInt64(&c.dataRows, c.data.records)
+	atomic.StoreInt64(&c.logRows, c.log.records)
+	atomic.StoreInt64(&c.diskSize, c.data.size()+c.log.size())
+}
+
+// updateOldestRecord publishes the oldest record time for result cache statistics
+func (c *SegmentCache) updateOldestRecord() {
+	oldest := c.data.oldest()
+	if oldestLog := c.log.oldest(); oldest.IsZero() || (!oldestLog.IsZero() && oldestLog.Before(oldest)) {
+		oldest = oldestLog
+	}
+	var clock int64
+	if !oldest.IsZero() {
+		clock = oldest.Unix()
+	}
+	atomic.StoreInt64(&c.oldestRecord, clock)
+}
+
+// evictData removes the oldest data segment
+func (c *SegmentCache) evictData() (err error) {
+	var records int64
+	if records, err = c.data.evict(); err != nil {
+		return fmt.Errorf("cannot remove the oldest data segment: %s", err)
+	}
+	c.Debugf("removed %d oldest values from persistent buffer", records)
+	return
+}
+
+// checkLimits removes data segments older than the storage period and the oldest data segments
+// while the buffer size exceeds the limit. Log values are never removed, instead new log values
+// are not accepted until the log buffer is within the limits again.
+func (c *SegmentCache) checkLimits() {
+	now := time.Now()
+	if now.Sub(c.lastSizeCheck) < SizeCheckInterval {
+		return
+	}
+	c.lastSizeCheck = now
+
+	defer c.updateCounters()
+
+	for len(c.data.segments) != 0 && c.data.records != 0 &&
+		now.Sub(c.data.segments[0].modified) > time.Duration(c.storagePeriod+StorageTolerance)*time.Second {
+		if err := c.evictData(); err != nil {
+			c.Errf("%s", err)
+			return
+		}
+	}
+
+	if oldest := c.log.oldest(); oldest.IsZero() || now.Sub(oldest) < time.Duration(c.storagePeriod)*time.Second {
+		atomic.StoreUint32(&c.persistFlag, 0)
+	} else {
+		atomic.StoreUint32(&c.persistFlag, 1)
+	}
+
+	for {
+		size := c.data.size() + c.log.size()
+		if c.sizeLimit == 0 || size <= c.sizeLimit {
+			if c.evicting {
+				c.Warningf("persistent buffer size is within the limit again")
+				c.evicting = false
+			}
+			atomic.StoreUint32(&c.sizeFlag, 0)
+			return
+		}
+
+		if !c.evicting {
+			c.Warningf("persistent buffer size %d exceeds the limit of %d bytes, removing the oldest values",
+				size, c.sizeLimit)
+			c.evicting = true
+		}
+
+		if len(c.data.segments) == 0 {
+			atomic.StoreUint32(&c.sizeFlag, 1)
+			return
+		}
+
+		if err := c.evictData(); err != nil {
+			c.Errf("%s", err)
+			return
+		}
+	}
+}
+
+// sync writes the buffered values to disk
+func (c *SegmentCache) sync() (err error) {
+	if err = c.data.sync(); err != nil {
+		return fmt.Errorf("cannot write data segment: %s", err)
+	}
+	if err = c.log.sync(); err != nil {
+		return fmt.Errorf("cannot write log segment: %s", err)
+	}
+	return
+}
+
+func (c *SegmentCache) upload(u Uploader) (err error) {
+	defer func() {
+		if err != nil && (c.lastError == nil || err.Error() != c.lastError.Error()) {
+			c.Warningf("cannot upload history data: %s", err)
+			c.lastError = err
+		}
+	}()
+
+	if err = c.sync(); err != nil {
+		return
+	}
+
+	var results, logResults []*AgentData
+	var dataID, logID uint64
+	var dataOffset, logOffset int64
+
+	if results, dataID, dataOffset, err = c.data.read(DataLimit); err != nil {
+		c.Errf("cannot read data segment: %s", err)
+		return
+	}
+	dataLen := len(results)
+
+	if dataLen != DataLimit {
+		if logResults, logID, logOffset, err = c.log.read(DataLimit - dataLen); err != nil {
+			c.Errf("cannot read log segment: %s", err)
+			return
+		}
+		for _, r := range logResults {
+			r.persistent = true
+		}
+		results = append(results, logResults...)
+	}
+
+	if len(results) == 0 {
+		c.uploadSucceeded()
+		return
+	}
+
+	request := AgentDataRequest{
+		Request: "agent data",
+		Data:    results,
+		Session: c.token,
+		Host:    u.Hostname(),
+		Version: version.Short(),
+	}
+
+	var data []byte
+
+	if data, err = json.Marshal(&request); err != nil {
+		c.Errf("cannot convert cached history to json: %s", err.Error())
+		return
+	}
+
+	timeout := len(results) * c.timeout
+	if timeout > 60 {
+		timeout = 60
+	}
+	if err = u.Write(data, time.Duration(timeout)*time.Second); err != nil {
+		c.uploadFailed()
+		if c.lastError == nil || err.Error() != c.lastError.Error() {
+			c.Warningf("history upload to [%s %s] started to fail: %s", u.Addr(), u.Hostname(), err)
+			c.lastError = err
+		}
+		return
+	}
+
+	c.uploadSucceeded()
+	if c.lastError != nil {
+		c.Warningf("history upload to [%s %s] is working again", u.Addr(), u.Hostname())
+		c.lastError = nil
+	}
+
+	defer c.updateCounters()
+
+	if dataLen != 0 {
+		if err = c.data.commit(dataID, dataOffset, dataLen); err != nil {
+			return fmt.Errorf("cannot remove uploaded data segments: %s", err)
+		}
+	}
+	if len(logResults) != 0 {
+		if err = c.log.commit(logID, logOffset, len(logResults)); err != nil {
+			return fmt.Errorf("cannot remove uploaded log segments: %s", err)
+		}
+		if oldest := c.log.oldest(); oldest.IsZero() ||
+			time.Since(oldest) < time.Duration(c.storagePeriod)*time.Second {
+			atomic.StoreUint32(&c.persistFlag, 0)
+		}
+	}
+
+	return
+}
+
+func (c *SegmentCache) flushOutput(u Uploader) {
+	if c.retry != nil {
+		c.retry.Stop()
+		c.retry = nil
+	}
+
+	if err := c.upload(u); err != nil && u.CanRetry() {
+		c.retry = time.AfterFunc(UploadRetryInterval, func() { c.Upload(u) })
+	}
+}
+
+func (c *SegmentCache) write(r *plugin.Result) {
+	c.lastDataID++
+	data := newAgentData(c.lastDataID, r)
+
+	var err error
+	if r.Persistent {
+		if err = c.log.append(data); err == nil {
+			atomic.AddInt64(&c.logRows, 1)
+		}
+	} else {
+		if err = c.data.append(data); err == nil {
+			atomic.AddInt64(&c.dataRows, 1)
+		}
+	}
+	if err != nil {
+		c.Errf("cannot write value to persistent buffer: %s", err)
+		panic(err)
+	}
+}
+
+func (c *SegmentCache) run() {
+	defer log.PanicHook()
+	c.Debugf("starting segment cache")
+
+	for {
+		u := <-c.input
+		if u == nil {
+			break
+		}
+		switch v := u.(type) {
+		case Uploader:
+			c.flushOutput(v)
+		case *plugin.Result:
+			c.write(v)
+		case *agent.AgentOptions:
+			c.updateOptions(v)
+		}
+		c.checkLimits()
+		c.updateOldestRecord()
+	}
+	c.Debugf("segment cache has been stopped")
+	if err := c.data.close(); err != nil {
+		c.Errf("cannot close data segment: %s", err)
+	}
+	if err := c.log.close(); err != nil {
+		c.Errf("cannot close log segment: %s", err)
+	}
+	monitor.Unregister(monitor.Output)
+}
+
+func (c *SegmentCache) updateOptions(options *agent.AgentOptions) {
+	c.storagePeriod = int64(options.PersistentBufferPeriod)
+	c.sizeLimit = int64(options.PersistentBufferSize) * 1048576
+	c.timeout = options.Timeout
+	// check the buffer limits with the new options
+	c.lastSizeCheck = time.Time{}
+}
+
+func (c *SegmentCache) init(options *agent.AgentOptions) {
+	c.updateOptions(options)
+
+	dir := segmentCacheDir(options.PersistentBufferFile, c.uploader.Addr(), c.uploader.Hostname())
+	if err := c.data.open(filepath.Join(dir, "data")); err != nil {
+		c.Errf("cannot open persistent buffer data segments: %s", err)
+	}
+	if err := c.log.open(filepath.Join(dir, "log")); err != nil {
+		c.Errf("cannot open persistent buffer log segments: %s", err)
+	}
+
+	c.lastDataID = c.data.lastID
+	if c.log.lastID > c.lastDataID {
+		c.lastDataID = c.log.lastID
+	}
+
+	c.checkLimits()
+	c.updateOldestRecord()
+}
+
+func (c *SegmentCache) Start() {
+	// register with secondary group to stop result cache after other components are stopped
+	monitor.Register(monitor.Output)
+	go c.run()
+}
+
+func (c *SegmentCache) SlotsAvailable() int {
+	return int(^uint(0) >> 1) //Max int
+}
+
+func (c *SegmentCache) PersistSlotsAvailable() int {
+	if atomic.LoadUint32(&c.persistFlag) == 1 || atomic.LoadUint32(&c.sizeFlag) == 1 {
+		return 0
+	}
+	return int(^uint(0) >> 1) //Max int
+}
+
+func (c *SegmentCache) Stats() Stats {
+	dataRows := atomic.LoadInt64(&c.dataRows)
+	logRows := atomic.LoadInt64(&c.logRows)
+	return Stats{
+		Persistent:       true,
+		Values:           int(dataRows + logRows),
+		PersistentValues: int(logRows),
+		SlotsAvailable:   c.SlotsAvailable(),
+		UploadFailures:   atomic.LoadUint64(&c.uploadFailures),
+		OldestRecord:     atomic.LoadInt64(&c.oldestRecord),
+		DiskSize:         atomic.LoadInt64(&c.diskSize),
+		LastUpload:       atomic.LoadInt64(&c.lastUpload),
+	}
+}
@@ -20,6 +20,7 @@
 package scheduler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/fnv"
@@ -59,6 +60,8 @@ type client struct {
 	id uint64
 	// A map of itemids to the associated exporter tasks. It's used to update task when item parameters change.
 	exporters map[uint64]exporterTaskAccessor
+	// A map of item keys to direct exporter task (single passive checks) execution statistics.
+	directStats map[string]*directTaskStats
 	// plugins used by client
 	pluginsInfo map[*pluginAgent]*pluginInfo
 	// server global regular expression bundle
@@ -98,8 +101,9 @@ func (c *client) Output() plugin.ResultWriter {
 }
 
 // addRequest requests client to start monitoring/update item described by request 'r' using plugin 'p' (*pluginAgent)
-// with output writer 'sink'
-func (c *client) addRequest(p *pluginAgent, r *plugin.Request, sink plugin.ResultWriter, now time.Time) (err error) {
+// with output writer 'sink'. The context 'ctx' is used to cancel direct requests.
+func (c *client) addRequest(ctx context.Context, p *pluginAgent, r *plugin.Request, sink plugin.ResultWriter,
+	now time.Time) (err error) {
 	var info *pluginInfo
 	var ok bool
 
@@ -158,11 +162,18 @@ func (c *client) addRequest(p *pluginAgent, r *plugin.Request, sink plugin.Resul
 				task = &exporterTask{
 					taskBase: taskBase{plugin: p, active: true, recurring: true},
 					item:     clientItem{itemid: r.Itemid, delay: r.Delay, key: r.Key},
+					shared:   shareItemExport(p.impl, r.Key),
 					updated:  now,
 					client:   c,
 					output:   sink,
 				}
+				if task.shared {
+					p.acquireSharedKey(task.item.key)
+				}
 				if err = task.reschedule(now); err != nil {
+					if task.shared {
+						p.releaseSharedKey(task.item.key)
+					}
 					return
 				}
 				c.exporters[r.Itemid] = task
@@ -173,8 +184,18 @@ func (c *client) addRequest(p *pluginAgent, r *plugin.Request, sink plugin.Resul
 				// update existing exporter task
 				task = tacc.task()
 				task.updated = now
+				shared := shareItemExport(p.impl, r.Key)
+				// shared items are scheduled by their keys
+				rescheduleKey := task.item.key != r.Key && (shared || task.shared)
+				if task.shared {
+					p.releaseSharedKey(task.item.key)
+				}
+				if shared {
+					p.acquireSharedKey(r.Key)
+				}
 				task.item.key = r.Key
-				if task.item.delay != r.Delay {
+				task.shared = shared
+				if task.item.delay != r.Delay || rescheduleKey {
 					task.item.delay = r.Delay
 					if err = task.reschedule(now); err != nil {
 						return
@@ -192,9 +213,10 @@ func (c *client) addRequest(p *pluginAgent, r *plugin.Request, sink plugin.Resul
 			task := &directExporterTask{
 				taskBase: taskBase{plugin: p, active: true, recurring: true},
 				item:     clientItem{itemid: r.Itemid, delay: r.Delay, key: r.Key},
-				expire:   now.Add(time.Duration(agent.Options.Timeout) * time.Second),
+				expire:   now.Add(time.Duration(agent.CurrentOptions().Timeout) * time.Second),
 				client:   c,
 				output:   sink,
+				ctx:      ctx,
 			}
 			if err = task.reschedule(now); err != nil {
 				return
@@ -244,7 +266,7 @@ func (c *client) addRequest(p *pluginAgent, r *plugin.Request, sink plugin.Resul
 		if p.refcount == 0 {
 			task := &configuratorTask{
 				taskBase: taskBase{plugin: p, active: true},
-				options:  &agent.Options,
+				options:  agent.CurrentOptions(),
 			}
 			_ = task.reschedule(now)
 			tasks = append(tasks, task)
@@ -295,6 +317,13 @@ func (c *client) cleanup(plugins map[string]*pluginAgent, now time.Time) (releas
 		expiry = now.Add(-time.Hour * 25)
 	}
 
+	// remove statistics of direct checks not performed since plugin expiry time
+	for key, s := range c.directStats {
+		if s.updated.Before(expiry) {
+			delete(c.directStats, key)
+		}
+	}
+
 	// deactivate plugins
 	for _, p := range plugins {
 		if info, ok := c.pluginsInfo[p]; ok {
@@ -352,11 +381,23 @@ func (c *client) updateExpressions(expressions []*glexpr.Expression) {
 	}
 }
 
+// updateDirectStats updates execution statistics of direct exporter task
+func (c *client) updateDirectStats(t *directExporterTask, now time.Time) {
+	s, ok := c.directStats[t.item.key]
+	if !ok {
+		s = &directTaskStats{}
+		c.directStats[t.item.key] = s
+	}
+	s.plugin = t.plugin.name()
+	s.update(&t.execution, now)
+}
+
 // newClient creates new client
 func newClient(id uint64, output plugin.ResultWriter) (b *client) {
 	b = &client{
 		id:          id,
 		exporters:   make(map[uint64]exporterTaskAccessor),
+		directStats: make(map[string]*directTaskStats),
 		pluginsInfo: make(map[*pluginAgent]*pluginInfo),
 		output:      output,
 	}
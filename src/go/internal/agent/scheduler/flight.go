@@ -0,0 +1,169 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/itemutil"
+	"zabbix.com/pkg/plugin"
+)
+
+// exportFlight is a single export shared by all items requesting the same key at the same time.
+type exportFlight struct {
+	// the time the export was scheduled at, zero for direct exports
+	scheduled time.Time
+	// closed when the export has finished
+	done     chan struct{}
+	finished time.Time
+	value    interface{}
+	err      error
+}
+
+// flightGroup tracks shared plugin exports. It's accessed by task goroutines and by scheduler,
+// which removes finished exports.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*exportFlight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*exportFlight)}
+}
+
+// sharedContext is the context provider of shared exports. Shared export results must not depend
+// on item or client, so it provides no item context.
+type sharedContext struct {
+}
+
+func (c *sharedContext) ClientID() uint64 {
+	return agent.LocalChecksClientID
+}
+
+func (c *sharedContext) ItemID() uint64 {
+	return 0
+}
+
+func (c *sharedContext) Output() plugin.ResultWriter {
+	return nil
+}
+
+func (c *sharedContext) Meta() *plugin.Meta {
+	return &plugin.Meta{}
+}
+
+func (c *sharedContext) GlobalRegexp() plugin.RegexpMatcher {
+	return nil
+}
+
+// shareExport returns true if the results of the key export can be shared between items. Sharing
+// is disabled unless the plugin explicitly allows it.
+func shareExport(impl plugin.Accessor, key string) bool {
+	if sharing, ok := impl.(plugin.ExportSharing); ok {
+		return sharing.ShareExport(key)
+	}
+	return false
+}
+
+// shareItemExport returns true if the results of the item key (with parameters) export can be
+// shared between items
+func shareItemExport(impl plugin.Accessor, itemkey string) bool {
+	key, _, err := itemutil.ParseKey(itemkey)
+	if err != nil {
+		return false
+	}
+	return shareExport(impl, key)
+}
+
+// do returns result of export performed by function fn unless the same item key is being exported
+// or has been exported for the same scheduled time. In that case the result of the other export
+// is returned. The export is performed in own goroutine with context limited by timeout, so it
+// does not depend on the item which started it. The context 'ctx' limits only waiting for
+// the result. If the shared export was cancelled the export is performed again with context 'ctx'.
+func (g *flightGroup) do(ctx context.Context, itemkey string, scheduled time.Time, timeout time.Duration,
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+
+	g.mutex.Lock()
+	f, ok := g.flights[itemkey]
+	if !ok || !(f.running() || (!scheduled.IsZero() && f.scheduled.Equal(scheduled))) {
+		f = &exportFlight{scheduled: scheduled, done: make(chan struct{})}
+		g.flights[itemkey] = f
+		go g.run(itemkey, f, timeout, fn)
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+		return fn(ctx)
+	}
+	return f.value, f.err
+}
+
+// run performs the shared export
+func (g *flightGroup) run(itemkey string, f *exportFlight, timeout time.Duration,
+	fn func(ctx context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	f.value, f.err = fn(ctx)
+	cancel()
+	f.finished = time.Now()
+	close(f.done)
+
+	// direct exports are shared only while running
+	if f.scheduled.IsZero() {
+		g.mutex.Lock()
+		if g.flights[itemkey] == f {
+			delete(g.flights, itemkey)
+		}
+		g.mutex.Unlock()
+	}
+}
+
+// running returns true if the export has not finished yet
+func (f *exportFlight) running() bool {
+	select {
+	case <-f.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// cleanup removes finished exports. The finished exports are kept for Timeout seconds, so items
+// scheduled at the same time but performed later because of limited plugin capacity can still
+// use their results.
+func (g *flightGroup) cleanup(now time.Time) {
+	expire := now.Add(-time.Duration(agent.CurrentOptions().Timeout) * time.Second)
+	g.mutex.Lock()
+	for itemkey, f := range g.flights {
+		if !f.running() && f.finished.Before(expire) {
+			delete(g.flights, itemkey)
+		}
+	}
+	g.mutex.Unlock()
+}
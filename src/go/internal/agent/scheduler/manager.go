@@ -21,6 +21,7 @@ package scheduler
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -64,20 +65,51 @@ type updateRequest struct {
 	sink     plugin.ResultWriter
 	requests []*plugin.Request
 	expressions []*glexpr.Expression
+	// optional context to cancel direct requests
+	ctx context.Context
+	// optional channel notified without blocking when some of the requests were rejected
+	rejected chan<- struct{}
+}
+
+// optionsUpdate contains validated agent configuration to be applied at runtime.
+type optionsUpdate struct {
+	options *agent.AgentOptions
+	aliases *alias.Manager
+}
+
+// userParameterUpdate contains user parameter configuration to be reloaded at runtime.
+type userParameterUpdate struct {
+	options *agent.AgentOptions
+	sink    chan error
 }
 
 // queryRequest contains status/debug query request.
 type queryRequest struct {
 	command string
-	sink    chan string
+	sink    chan *queryResult
+}
+
+// queryResult contains status/debug query response or processing error.
+type queryResult struct {
+	text string
+	err  error
+}
+
+// statusRequest contains scheduler status request for agent self-monitoring.
+type statusRequest struct {
+	clientID uint64
+	sink     chan *agent.SchedulerStatus
 }
 
 type Scheduler interface {
+	// UpdateTasks replaces the client requests. If rejected is not nil, it's notified without blocking
+	// when some of the requests could not be scheduled.
 	UpdateTasks(clientID uint64, writer plugin.ResultWriter, expressions []*glexpr.Expression,
-		requests []*plugin.Request)
+		requests []*plugin.Request, rejected chan<- struct{})
 	FinishTask(task performer)
 	PerformTask(key string, timeout time.Duration, clientID uint64) (result string, err error)
 	Query(command string) (status string)
+	QueryStatus(command string) (status string, err error)
 }
 
 // cleanupClient performs deactivation of plugins the client is not using anymore.
@@ -168,6 +200,12 @@ func (m *Manager) processUpdateRequest(update *updateRequest, now time.Time) {
 
 	c.updateExpressions(update.expressions)
 
+	var rejected bool
+	ctx := update.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	for _, r := range update.requests {
 		var key string
 		var params []string
@@ -183,7 +221,7 @@ func (m *Manager) processUpdateRequest(update *updateRequest, now time.Time) {
 			if !ok {
 				err = fmt.Errorf("Unknown metric %s", key)
 			} else {
-				err = c.addRequest(p, r, update.sink, now)
+				err = c.addRequest(ctx, p, r, update.sink, now)
 			}
 		}
 
@@ -196,6 +234,7 @@ func (m *Manager) processUpdateRequest(update *updateRequest, now time.Time) {
 			}
 			update.sink.Write(&plugin.Result{Itemid: r.Itemid, Error: err, Ts: now})
 			log.Debugf("[%d] cannot monitor metric \"%s\": %s", update.clientID, r.Key, err.Error())
+			rejected = true
 			continue
 		}
 
@@ -206,6 +245,13 @@ func (m *Manager) processUpdateRequest(update *updateRequest, now time.Time) {
 		}
 	}
 
+	if rejected && update.rejected != nil {
+		select {
+		case update.rejected <- struct{}{}:
+		default:
+		}
+	}
+
 	m.cleanupClient(c, now)
 }
 
@@ -245,6 +291,15 @@ func (m *Manager) processQueue(now time.Time) {
 // processFinishRequest handles finished tasks
 func (m *Manager) processFinishRequest(task performer) {
 	m.activeTasksNum--
+	switch t := task.(type) {
+	case *exporterTask:
+		t.unsupported = t.failed
+		t.stats.update(&t.execution, time.Now())
+	case *directExporterTask:
+		if c, ok := m.clients[t.client.ID()]; ok {
+			c.updateDirectStats(t, time.Now())
+		}
+	}
 	p := task.getPlugin()
 	p.releaseCapacity(task)
 	if p.active() && task.isActive() && task.isRecurring() {
@@ -259,6 +314,17 @@ func (m *Manager) processFinishRequest(task performer) {
 	}
 }
 
+// cleanupFlights removes finished shared exports that cannot be reused anymore
+func (m *Manager) cleanupFlights(now time.Time) {
+	cleaned := make(map[*pluginAgent]bool)
+	for _, p := range m.plugins {
+		if !cleaned[p] {
+			p.flights.cleanup(now)
+			cleaned[p] = true
+		}
+	}
+}
+
 // rescheduleQueue reschedules all queued tasks. This is done whenever time
 // difference between ticks exceeds limits (for example during daylight saving changes).
 func (m *Manager) rescheduleQueue(now time.Time) {
@@ -299,6 +365,78 @@ func (m *Manager) deactivatePlugins() {
 	}
 }
 
+// processOptionsUpdate applies runtime configuration changes. The aliases are replaced, plugin
+// capacities recalculated and configurator tasks queued for active plugins, so they would pick up
+// the new configuration. Inactive plugins will be configured when activated.
+func (m *Manager) processOptionsUpdate(update *optionsUpdate, now time.Time) {
+	if m.shutdownSeconds != shutdownInactive {
+		return
+	}
+	m.aliases = update.aliases
+
+	updated := make(map[*pluginAgent]bool)
+	for _, p := range m.plugins {
+		if _, ok := updated[p]; ok {
+			continue
+		}
+		updated[p] = true
+		p.maxCapacity = getPluginCapacity(p.impl, update.options)
+		p.timeout = getPluginTimeout(p.impl, update.options)
+
+		if _, ok := p.impl.(plugin.Configurator); !ok || !p.active() {
+			continue
+		}
+		task := &configuratorTask{
+			taskBase: taskBase{plugin: p, active: true},
+			options:  update.options,
+		}
+		_ = task.reschedule(now)
+		p.enqueueTask(task)
+		log.Debugf("created configurator task for plugin %s", p.name())
+
+		if !p.queued() {
+			heap.Push(&m.pluginQueue, p)
+		} else {
+			m.pluginQueue.Update(p)
+		}
+	}
+}
+
+// processUserParameterUpdate reloads user parameters and synchronizes the manager metrics with
+// the plugin registry. Tasks of removed user parameters are left to fail until their clients stop
+// requesting them. The plugin agents are looked up by plugin implementation, so the user parameter
+// plugin keeps its agent even if all its metrics are replaced.
+func (m *Manager) processUserParameterUpdate(update *userParameterUpdate) (err error) {
+	if err = agent.ReloadUserParameterPlugin(update.options.UserParameter, update.options.UnsafeUserParameters,
+		update.options.UserParameterDir); err != nil {
+		return
+	}
+
+	metrics := plugin.GetMetrics()
+	agents := make(map[plugin.Accessor]*pluginAgent)
+	for key, p := range m.plugins {
+		agents[p.impl] = p
+		if _, ok := metrics[key]; !ok {
+			log.Debugf("removed metric %s provided by plugin %s", key, p.name())
+			delete(m.plugins, key)
+		}
+	}
+
+	for key, metric := range metrics {
+		if _, ok := m.plugins[key]; ok {
+			continue
+		}
+		p, ok := agents[metric.Plugin]
+		if !ok {
+			p = newPluginAgent(metric.Plugin, update.options)
+			agents[metric.Plugin] = p
+		}
+		m.plugins[key] = p
+		log.Debugf("added metric %s provided by plugin %s", key, p.name())
+	}
+	return
+}
+
 // run() is the main worker loop running in own goroutine until stopped
 func (m *Manager) run() {
 	defer log.PanicHook()
@@ -324,6 +462,7 @@ run:
 			}
 			lastTick = now
 			m.processQueue(now)
+			m.cleanupFlights(now)
 			if m.shutdownSeconds != shutdownInactive {
 				m.shutdownSeconds--
 				if m.shutdownSeconds == 0 {
@@ -362,12 +501,16 @@ run:
 					break run
 				}
 				m.processQueue(time.Now())
+			case *optionsUpdate:
+				m.processOptionsUpdate(v, time.Now())
+				m.processQueue(time.Now())
+			case *userParameterUpdate:
+				v.sink <- m.processUserParameterUpdate(v)
+			case *statusRequest:
+				v.sink <- m.getSchedulerStatus(v.clientID)
 			case *queryRequest:
-				if response, err := m.processQuery(v); err != nil {
-					v.sink <- "cannot process request: " + err.Error()
-				} else {
-					v.sink <- response
-				}
+				response, err := m.processQuery(v)
+				v.sink <- &queryResult{text: response, err: err}
 			}
 		}
 	}
@@ -379,16 +522,58 @@ type pluginCapacity struct {
 	Capacity int `conf:"optional"`
 }
 
+// getPluginCapacity returns plugin capacity from its configuration, limited by the plugin
+// maximum capacity.
+func getPluginCapacity(p plugin.Accessor, options *agent.AgentOptions) (capacity int) {
+	capacity = p.Capacity()
+	var opts pluginCapacity
+	optsRaw := options.Plugins[p.Name()]
+	if optsRaw != nil {
+		if err := conf.Unmarshal(optsRaw, &opts, false); err != nil {
+			log.Warningf("invalid plugin %s configuration: %s", p.Name(), err)
+			log.Warningf("using default plugin capacity settings: %d", plugin.DefaultCapacity)
+			capacity = plugin.DefaultCapacity
+		} else {
+			if opts.Capacity != 0 {
+				capacity = opts.Capacity
+			}
+		}
+	}
+
+	if capacity > p.Capacity() {
+		log.Warningf("lowering the plugin %s capacity to %d as the configured capacity %d exceeds limits",
+			p.Name(), p.Capacity(), capacity)
+		capacity = p.Capacity()
+	}
+	return
+}
+
+type pluginTimeout struct {
+	Timeout int `conf:"optional"`
+}
+
+// getPluginTimeout returns plugin specific Timeout parameter, zero if it's not configured.
+func getPluginTimeout(p plugin.Accessor, options *agent.AgentOptions) time.Duration {
+	var opts pluginTimeout
+	if optsRaw := options.Plugins[p.Name()]; optsRaw != nil {
+		if err := conf.Unmarshal(optsRaw, &opts, false); err != nil {
+			return 0
+		}
+	}
+	return time.Duration(opts.Timeout) * time.Second
+}
+
 func (m *Manager) init() {
+	registered := plugin.GetMetrics()
 	m.input = make(chan interface{}, 10)
-	m.pluginQueue = make(pluginHeap, 0, len(plugin.Metrics))
+	m.pluginQueue = make(pluginHeap, 0, len(registered))
 	m.clients = make(map[uint64]*client)
 	m.plugins = make(map[string]*pluginAgent)
 	m.shutdownSeconds = shutdownInactive
 
-	metrics := make([]*plugin.Metric, 0, len(plugin.Metrics))
+	metrics := make([]*plugin.Metric, 0, len(registered))
 
-	for _, metric := range plugin.Metrics {
+	for _, metric := range registered {
 		metrics = append(metrics, metric)
 	}
 	sort.Slice(metrics, func(i, j int) bool {
@@ -398,58 +583,47 @@ func (m *Manager) init() {
 	pagent := &pluginAgent{}
 	for _, metric := range metrics {
 		if metric.Plugin != pagent.impl {
-			capacity := metric.Plugin.Capacity()
-			var opts pluginCapacity
-			optsRaw := agent.Options.Plugins[metric.Plugin.Name()]
-			if optsRaw != nil {
-				if err := conf.Unmarshal(optsRaw, &opts, false); err != nil {
-					log.Warningf("invalid plugin %s configuration: %s", metric.Plugin.Name(), err)
-					log.Warningf("using default plugin capacity settings: %d", plugin.DefaultCapacity)
-					capacity = plugin.DefaultCapacity
-				} else {
-					if opts.Capacity != 0 {
-						capacity = opts.Capacity
-					}
-				}
-			}
-
-			if capacity > metric.Plugin.Capacity() {
-				log.Warningf("lowering the plugin %s capacity to %d as the configured capacity %d exceeds limits",
-					metric.Plugin.Name(), metric.Plugin.Capacity(), capacity)
-				capacity = metric.Plugin.Capacity()
-			}
-
-			pagent = &pluginAgent{
-				impl:         metric.Plugin,
-				tasks:        make(performerHeap, 0),
-				maxCapacity:  capacity,
-				usedCapacity: 0,
-				index:        -1,
-				refcount:     0,
-			}
-
-			interfaces := ""
-			if _, ok := metric.Plugin.(plugin.Exporter); ok {
-				interfaces += "exporter, "
-			}
-			if _, ok := metric.Plugin.(plugin.Collector); ok {
-				interfaces += "collector, "
-			}
-			if _, ok := metric.Plugin.(plugin.Runner); ok {
-				interfaces += "runner, "
-			}
-			if _, ok := metric.Plugin.(plugin.Watcher); ok {
-				interfaces += "watcher, "
-			}
-			if _, ok := metric.Plugin.(plugin.Configurator); ok {
-				interfaces += "configurator, "
-			}
-			interfaces = interfaces[:len(interfaces)-2]
-			log.Infof("using plugin '%s' providing following interfaces: %s", metric.Plugin.Name(), interfaces)
+			pagent = newPluginAgent(metric.Plugin, agent.CurrentOptions())
 		}
 		m.plugins[metric.Key] = pagent
 	}
 }
+
+// newPluginAgent creates plugin usage manager for the specified plugin
+func newPluginAgent(impl plugin.Accessor, options *agent.AgentOptions) (p *pluginAgent) {
+	p = &pluginAgent{
+		impl:         impl,
+		tasks:        make(performerHeap, 0),
+		maxCapacity:  getPluginCapacity(impl, options),
+		timeout:      getPluginTimeout(impl, options),
+		usedCapacity: 0,
+		index:        -1,
+		refcount:     0,
+		flights:      newFlightGroup(),
+	}
+
+	interfaces := ""
+	if _, ok := impl.(plugin.Exporter); ok {
+		interfaces += "exporter, "
+	}
+	if _, ok := impl.(plugin.Collector); ok {
+		interfaces += "collector, "
+	}
+	if _, ok := impl.(plugin.Runner); ok {
+		interfaces += "runner, "
+	}
+	if _, ok := impl.(plugin.Watcher); ok {
+		interfaces += "watcher, "
+	}
+	if _, ok := impl.(plugin.Configurator); ok {
+		interfaces += "configurator, "
+	}
+	interfaces = interfaces[:len(interfaces)-2]
+	log.Infof("using plugin '%s' providing following interfaces: %s", impl.Name(), interfaces)
+
+	return
+}
+
 func (m *Manager) Start() {
 	monitor.Register(monitor.Scheduler)
 	go m.run()
@@ -460,12 +634,13 @@ func (m *Manager) Stop() {
 }
 
 func (m *Manager) UpdateTasks(clientID uint64, writer plugin.ResultWriter, 
-	expressions []*glexpr.Expression, requests []*plugin.Request) {
+	expressions []*glexpr.Expression, requests []*plugin.Request, rejected chan<- struct{}) {
 
 	m.input <- &updateRequest{clientID: clientID,
 		sink:     writer,
 		requests: requests,
 		expressions: expressions,
+		rejected: rejected,
 	}
 }
 
@@ -492,7 +667,16 @@ func (m *Manager) PerformTask(key string, timeout time.Duration, clientID uint64
 
 	w := make(resultWriter, 1)
 
-	m.UpdateTasks(clientID, w, nil, []*plugin.Request{{Key: key, LastLogsize: &lastLogsize, Mtime: &mtime}})
+	// cancel the task if the result is not received in time
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.input <- &updateRequest{
+		clientID: clientID,
+		sink:     w,
+		requests: []*plugin.Request{{Key: key, LastLogsize: &lastLogsize, Mtime: &mtime}},
+		ctx:      ctx,
+	}
 
 	select {
 	case r := <-w:
@@ -516,8 +700,28 @@ func (m *Manager) FinishTask(task performer) {
 	m.input <- task
 }
 
+// Query returns status/debug query response, the query processing error is returned as response text
 func (m *Manager) Query(command string) (status string) {
-	request := &queryRequest{command: command, sink: make(chan string)}
+	var err error
+	if status, err = m.QueryStatus(command); err != nil {
+		return "cannot process request: " + err.Error()
+	}
+	return
+}
+
+// QueryStatus returns status/debug query response or query processing error
+func (m *Manager) QueryStatus(command string) (status string, err error) {
+	request := &queryRequest{command: command, sink: make(chan *queryResult)}
+	m.input <- request
+	result := <-request.sink
+	return result.text, result.err
+}
+
+// SchedulerStatus returns scheduler state for agent self-monitoring. The number of unsupported
+// items is returned for the specified active checks client or for all clients when requested by
+// passive checks.
+func (m *Manager) SchedulerStatus(clientID uint64) *agent.SchedulerStatus {
+	request := &statusRequest{clientID: clientID, sink: make(chan *agent.SchedulerStatus)}
 	m.input <- request
 	return <-request.sink
 }
@@ -538,6 +742,43 @@ func (m *Manager) configure(options *agent.AgentOptions) (err error) {
 	return
 }
 
+// UpdateOptions validates the new agent configuration and passes it to the manager to be applied
+// at runtime.
+func (m *Manager) UpdateOptions(options *agent.AgentOptions) (err error) {
+	if err = m.validatePlugins(options); err != nil {
+		return
+	}
+	var aliases *alias.Manager
+	if aliases, err = alias.NewManager(options); err != nil {
+		return
+	}
+	m.input <- &optionsUpdate{options: options, aliases: aliases}
+	return
+}
+
+// ValidateOptions checks that the configuration can be applied by UpdateOptions and
+// UpdateUserParameters, so the runtime configuration is not changed partially
+func (m *Manager) ValidateOptions(options *agent.AgentOptions) (err error) {
+	if err = m.validatePlugins(options); err != nil {
+		return
+	}
+	if _, err = alias.NewManager(options); err != nil {
+		return
+	}
+	if err = agent.ValidateUserParameters(options.UserParameter); err != nil {
+		return fmt.Errorf("cannot reload user parameters: %s", err)
+	}
+	return
+}
+
+// UpdateUserParameters reloads user parameters from the specified configuration. The current user
+// parameters are kept if the new configuration is not valid.
+func (m *Manager) UpdateUserParameters(options *agent.AgentOptions) (err error) {
+	request := &userParameterUpdate{options: options, sink: make(chan error)}
+	m.input <- request
+	return <-request.sink
+}
+
 func NewManager(options *agent.AgentOptions) (mannager *Manager, err error) {
 	var m Manager
 	m.init()
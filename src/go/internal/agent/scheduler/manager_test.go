@@ -21,9 +21,11 @@ package scheduler
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -660,6 +662,46 @@ func TestTaskCreate(t *testing.T) {
 	checkExporterTasks(t, manager, agent.MaxBuiltinClientID+1, items)
 }
 
+func TestTaskRejected(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	plugin.ClearRegistry()
+	var p mockExporterPlugin
+	plugin.RegisterMetrics(&p, "debug1", "debug1", "Debug.")
+
+	manager, _ := NewManager(&agent.Options)
+
+	var cache resultCacheMock
+	var lastLogsize uint64
+	var mtime int
+	rejected := make(chan struct{}, 1)
+	update := updateRequest{
+		clientID: agent.MaxBuiltinClientID + 1,
+		sink:     &cache,
+		requests: []*plugin.Request{
+			&plugin.Request{Itemid: 1, Key: "debug1", Delay: "10", LastLogsize: &lastLogsize, Mtime: &mtime},
+		},
+		rejected: rejected,
+	}
+	manager.processUpdateRequest(&update, time.Now())
+	select {
+	case <-rejected:
+		t.Errorf("Expected no rejected requests")
+	default:
+	}
+
+	update.requests = append(update.requests,
+		&plugin.Request{Itemid: 2, Key: "debug2", Delay: "10", LastLogsize: &lastLogsize, Mtime: &mtime})
+	manager.processUpdateRequest(&update, time.Now())
+	// the notification must not block when the previous one has not been received
+	manager.processUpdateRequest(&update, time.Now())
+	select {
+	case <-rejected:
+	default:
+		t.Errorf("Expected rejected request notification")
+	}
+}
+
 func TestTaskUpdate(t *testing.T) {
 	_ = log.Open(log.Console, log.Debug, "", 0)
 
@@ -1767,3 +1809,188 @@ func TestConfigurator(t *testing.T) {
 	manager.iterate(t, 5)
 	manager.checkPluginTimeline(t, plugins, calls, 5)
 }
+
+func TestUserParameterUpdate(t *testing.T) {
+	_ = log.Open(log.Console, log.Debug, "", 0)
+
+	plugin.ClearRegistry()
+	if err := agent.InitUserParameterPlugin([]string{"a,echo a"}, 0, ""); err != nil {
+		t.Fatalf("cannot initialize user parameters: %s", err)
+	}
+	var m Manager
+	m.init()
+	p := m.plugins["a"]
+
+	options := agent.AgentOptions{UserParameter: []string{"b,echo b", "c,echo c"}}
+	if err := m.processUserParameterUpdate(&userParameterUpdate{options: &options}); err != nil {
+		t.Fatalf("cannot update user parameters: %s", err)
+	}
+	if _, ok := m.plugins["a"]; ok {
+		t.Errorf("Expected metric a to be removed")
+	}
+	for _, key := range []string{"b", "c"} {
+		if m.plugins[key] != p {
+			t.Errorf("Expected metric %s to use the existing plugin agent", key)
+		}
+	}
+}
+
+func TestScheduleOffset(t *testing.T) {
+	if offset := scheduleOffset(1, 0); offset != 0 {
+		t.Errorf("Expected zero offset when jitter is disabled while got %s", offset)
+	}
+
+	offsets := make(map[time.Duration]bool)
+	for itemid := uint64(1); itemid <= 100; itemid++ {
+		offset := scheduleOffset(itemid, 10)
+		if offset < 0 || offset >= 10*time.Second || offset%time.Second != 0 {
+			t.Errorf("Invalid offset %s for itemid %d", offset, itemid)
+		}
+		if offset != scheduleOffset(itemid, 10) {
+			t.Errorf("Offset for itemid %d is not deterministic", itemid)
+		}
+		offsets[offset] = true
+	}
+	if len(offsets) < 2 {
+		t.Errorf("Expected items to be spread over different offsets")
+	}
+
+	if jitter := scheduleJitter("60", 10); jitter != 10 {
+		t.Errorf("Expected jitter 10 for simple interval while got %d", jitter)
+	}
+	for _, delay := range []string{"60;wd1-5h9", "60;30/1-5,09:00-18:00"} {
+		if jitter := scheduleJitter(delay, 10); jitter != 0 {
+			t.Errorf("Expected no jitter for custom interval %s while got %d", delay, jitter)
+		}
+	}
+}
+
+func TestSharedExport(t *testing.T) {
+	timeout := agent.Options.Timeout
+	agent.Options.Timeout = 1
+	defer func() { agent.Options.Timeout = timeout }()
+
+	group := newFlightGroup()
+	scheduled := time.Unix(60, priorityExporterTaskNs)
+
+	var calls int
+	var mutex sync.Mutex
+	start := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-start
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+		return "value", nil
+	}
+
+	// the export must not be cancelled together with the item which started it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := group.do(ctx, "key[a]", scheduled, time.Second, fn); err != context.Canceled {
+		t.Errorf("Expected cancelled wait while got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := group.do(context.Background(), "key[a]", scheduled, time.Second, fn)
+			if err != nil || value != "value" {
+				t.Errorf("Expected shared value while got %v (%v)", value, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	// export scheduled at the same time but performed later must reuse the result
+	if _, err := group.do(context.Background(), "key[a]", scheduled, time.Second, fn); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected single export while got %d", calls)
+	}
+
+	// next scheduled export must be performed again
+	if _, err := group.do(context.Background(), "key[a]", scheduled.Add(time.Minute), time.Second, fn); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected two exports while got %d", calls)
+	}
+
+	group.cleanup(time.Now())
+	if len(group.flights) != 1 {
+		t.Errorf("Expected finished export to be kept while got %d exports", len(group.flights))
+	}
+	group.cleanup(time.Now().Add(2 * time.Second))
+	if len(group.flights) != 0 {
+		t.Errorf("Expected finished exports to be removed while got %d exports", len(group.flights))
+	}
+
+	// cancelled shared export result must not be passed to other items
+	fn = func(ctx context.Context) (interface{}, error) {
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+		return nil, context.Canceled
+	}
+	if _, err := group.do(context.Background(), "key[a]", scheduled, time.Second, fn); err != context.Canceled {
+		t.Errorf("Expected cancelled export while got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("Expected cancelled export to be performed again while got %d exports", calls)
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	plugin.ClearRegistry()
+	var p1, p2 mockExporterPlugin
+	plugin.RegisterMetrics(&p1, "debug1", "debug1", "Debug.")
+	plugin.RegisterMetrics(&p2, "debug2", "debug2", "Debug.")
+
+	var options agent.AgentOptions
+	if err := conf.Unmarshal([]byte("Plugins.debug1.Timeout=30\nPlugins.debug2.Capacity=5"), &options); err != nil {
+		t.Fatalf("Cannot load options: %s", err)
+	}
+	if timeout := getPluginTimeout(&p1, &options); timeout != 30*time.Second {
+		t.Errorf("Expected plugin timeout %s while got %s", 30*time.Second, timeout)
+	}
+	if timeout := getPluginTimeout(&p2, &options); timeout != 0 {
+		t.Errorf("Expected no plugin timeout while got %s", timeout)
+	}
+}
+
+func TestSharedKeySchedule(t *testing.T) {
+	p := &pluginAgent{}
+	tasks := make([]*exporterTask, 2)
+	for i := range tasks {
+		tasks[i] = &exporterTask{
+			taskBase: taskBase{plugin: p, active: true, recurring: true, index: -1},
+			item:     clientItem{itemid: uint64(i + 1), delay: "60", key: "key[a]"},
+			shared:   true,
+		}
+	}
+
+	p.acquireSharedKey("key[a]")
+	if seed := tasks[0].scheduleSeed(); seed != tasks[0].item.itemid {
+		t.Errorf("Expected item seed for key requested by single client while got %d", seed)
+	}
+
+	p.acquireSharedKey("key[a]")
+	if tasks[0].scheduleSeed() != tasks[1].scheduleSeed() {
+		t.Errorf("Expected the same seed for key requested by several clients")
+	}
+
+	tasks[1].deactivate()
+	if seed := tasks[0].scheduleSeed(); seed != tasks[0].item.itemid {
+		t.Errorf("Expected item seed after other client stopped requesting key while got %d", seed)
+	}
+	tasks[0].deactivate()
+	if len(p.sharedKeys) != 0 {
+		t.Errorf("Expected no shared keys while got %v", p.sharedKeys)
+	}
+}
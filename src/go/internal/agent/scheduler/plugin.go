@@ -21,6 +21,7 @@ package scheduler
 
 import (
 	"container/heap"
+	"time"
 
 	"zabbix.com/pkg/plugin"
 )
@@ -33,12 +34,35 @@ type pluginAgent struct {
 	tasks performerHeap
 	// maximum plugin capacity
 	maxCapacity int
+	// plugin specific Timeout parameter, zero if not configured
+	timeout time.Duration
 	// used plugin capacity
 	usedCapacity int
 	// index in plugin queue
 	index int
 	// refcount us used to track plugin usage by clients
 	refcount int
+	// exports shared between items requesting the same key
+	flights *flightGroup
+	// number of exporter tasks sharing exports by item key
+	sharedKeys map[string]int
+}
+
+// acquireSharedKey registers exporter task sharing exports of the item key
+func (p *pluginAgent) acquireSharedKey(key string) {
+	if p.sharedKeys == nil {
+		p.sharedKeys = make(map[string]int)
+	}
+	p.sharedKeys[key]++
+}
+
+// releaseSharedKey unregisters exporter task sharing exports of the item key
+func (p *pluginAgent) releaseSharedKey(key string) {
+	if p.sharedKeys[key] <= 1 {
+		delete(p.sharedKeys, key)
+		return
+	}
+	p.sharedKeys[key]--
 }
 
 // peekTask() returns next task in the queue without removing it from queue or nil
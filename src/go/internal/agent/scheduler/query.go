@@ -20,11 +20,13 @@
 package scheduler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 
+	"zabbix.com/internal/agent"
 	"zabbix.com/pkg/plugin"
 )
 
@@ -33,11 +35,26 @@ type pluginMetrics struct {
 	metrics []*plugin.Metric
 }
 
-// getStatus() returns a list of plugins with their metrics and statuses in a plain text format.
-func (m *Manager) getStatus() (result string) {
-	var status strings.Builder
+// PluginStatus contains plugin status information in a machine readable format
+type PluginStatus struct {
+	Name         string         `json:"name"`
+	Active       bool           `json:"active"`
+	UsedCapacity int            `json:"used_capacity"`
+	MaxCapacity  int            `json:"max_capacity"`
+	Tasks        int            `json:"tasks"`
+	Metrics      []MetricStatus `json:"metrics"`
+}
+
+// MetricStatus contains metric key and its description
+type MetricStatus struct {
+	Key         string `json:"key"`
+	Description string `json:"description"`
+}
+
+// getPluginMetrics() returns a list of plugins with their metrics sorted by plugin name and metric key.
+func (m *Manager) getPluginMetrics() (infos []*pluginMetrics) {
 	agents := make(map[plugin.Accessor]*pluginMetrics)
-	infos := make([]*pluginMetrics, 0, len(m.plugins))
+	infos = make([]*pluginMetrics, 0, len(m.plugins))
 	for _, p := range m.plugins {
 		if _, ok := agents[p.impl]; !ok {
 			info := &pluginMetrics{ref: p, metrics: make([]*plugin.Metric, 0)}
@@ -46,7 +63,7 @@ func (m *Manager) getStatus() (result string) {
 		}
 	}
 
-	for _, metric := range plugin.Metrics {
+	for _, metric := range plugin.GetMetrics() {
 		if info, ok := agents[metric.Plugin]; ok {
 			info.metrics = append(info.metrics, metric)
 		}
@@ -54,11 +71,19 @@ func (m *Manager) getStatus() (result string) {
 	sort.Slice(infos, func(i, j int) bool {
 		return infos[i].ref.name() < infos[j].ref.name()
 	})
-
 	for _, info := range infos {
+		metrics := info.metrics
+		sort.Slice(metrics, func(l, r int) bool { return metrics[l].Key < metrics[r].Key })
+	}
+	return
+}
+
+// getStatus() returns a list of plugins with their metrics and statuses in a plain text format.
+func (m *Manager) getStatus() (result string) {
+	var status strings.Builder
+	for _, info := range m.getPluginMetrics() {
 		status.WriteString(fmt.Sprintf("[%s]\nactive: %t\ncapacity: %d/%d\ntasks: %d\n",
 			info.ref.name(), info.ref.active(), info.ref.usedCapacity, info.ref.maxCapacity, len(info.ref.tasks)))
-		sort.Slice(info.metrics, func(l, r int) bool { return info.metrics[l].Key < info.metrics[r].Key })
 		for _, metric := range info.metrics {
 			status.WriteString(metric.Key)
 			status.WriteString(": ")
@@ -70,12 +95,65 @@ func (m *Manager) getStatus() (result string) {
 	return status.String()
 }
 
-// processQuery handles internal queries like list of plugins with their metrics
-// (accessed from status page or remote command).
+// getStatusJSON() returns a list of plugins with their metrics and statuses in JSON format.
+func (m *Manager) getStatusJSON() (result string, err error) {
+	infos := m.getPluginMetrics()
+	plugins := make([]*PluginStatus, 0, len(infos))
+	for _, info := range infos {
+		status := &PluginStatus{
+			Name:         info.ref.name(),
+			Active:       info.ref.active(),
+			UsedCapacity: info.ref.usedCapacity,
+			MaxCapacity:  info.ref.maxCapacity,
+			Tasks:        len(info.ref.tasks),
+			Metrics:      make([]MetricStatus, 0, len(info.metrics)),
+		}
+		for _, metric := range info.metrics {
+			status.Metrics = append(status.Metrics, MetricStatus{Key: metric.Key, Description: metric.Description})
+		}
+		plugins = append(plugins, status)
+	}
+
+	var data []byte
+	if data, err = json.Marshal(plugins); err != nil {
+		return
+	}
+	return string(data), nil
+}
+
+// getSchedulerStatus returns scheduler state for agent self-monitoring.
+func (m *Manager) getSchedulerStatus(clientID uint64) (status *agent.SchedulerStatus) {
+	status = &agent.SchedulerStatus{Plugins: make(map[string]agent.PluginCapacity)}
+	for _, info := range m.getPluginMetrics() {
+		status.QueueLength += len(info.ref.tasks)
+		status.Plugins[info.ref.name()] = agent.PluginCapacity{
+			Used: info.ref.usedCapacity,
+			Max:  info.ref.maxCapacity,
+		}
+	}
+	for _, c := range m.clients {
+		if clientID > agent.MaxBuiltinClientID && c.id != clientID {
+			continue
+		}
+		for _, tacc := range c.exporters {
+			if tacc.task().unsupported {
+				status.UnsupportedItems++
+			}
+		}
+	}
+	return
+}
+
+// processQuery handles internal queries like list of plugins with their metrics or task
+// execution statistics (accessed from status page or remote command).
 func (m *Manager) processQuery(r *queryRequest) (text string, err error) {
 	switch r.command {
 	case "metrics":
 		return m.getStatus(), nil
+	case "metrics.json":
+		return m.getStatusJSON()
+	case "tasks":
+		return m.getTaskStats(), nil
 	default:
 		return "", errors.New("unknown request")
 	}
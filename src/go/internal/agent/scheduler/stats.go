@@ -0,0 +1,138 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"zabbix.com/internal/agent"
+)
+
+// taskExecution contains the result of the last task execution. It's set by the task
+// goroutine before finishing the task and processed by scheduler afterwards.
+type taskExecution struct {
+	duration time.Duration
+	err      error
+	// true if the export context deadline was exceeded, the task is also counted as timed out
+	// if its execution took longer than Timeout
+	timeout bool
+}
+
+// taskStats contains item execution statistics, accessed only by scheduler
+type taskStats struct {
+	executions   int
+	errors       int
+	timeouts     int
+	lastError    string
+	lastLatency  time.Duration
+	maxLatency   time.Duration
+	totalLatency time.Duration
+	updated      time.Time
+}
+
+// directTaskStats contains direct exporter task statistics aggregated by item key
+type directTaskStats struct {
+	taskStats
+	plugin string
+}
+
+func (s *taskStats) update(e *taskExecution, now time.Time) {
+	s.executions++
+	s.lastLatency = e.duration
+	s.totalLatency += e.duration
+	if e.duration > s.maxLatency {
+		s.maxLatency = e.duration
+	}
+	if e.timeout || e.duration > time.Duration(agent.CurrentOptions().Timeout)*time.Second {
+		s.timeouts++
+	}
+	if e.err != nil {
+		s.errors++
+		s.lastError = e.err.Error()
+	}
+	s.updated = now
+}
+
+func (s *taskStats) averageLatency() time.Duration {
+	if s.executions == 0 {
+		return 0
+	}
+	return s.totalLatency / time.Duration(s.executions)
+}
+
+// taskStatsInfo is used to list task statistics
+type taskStatsInfo struct {
+	clientID uint64
+	itemid   uint64
+	key      string
+	plugin   string
+	stats    *taskStats
+}
+
+// getTaskStats returns execution statistics of all tasks ordered by the total execution time.
+func (m *Manager) getTaskStats() (result string) {
+	infos := make([]*taskStatsInfo, 0)
+	for _, c := range m.clients {
+		for _, tacc := range c.exporters {
+			task := tacc.task()
+			infos = append(infos, &taskStatsInfo{
+				clientID: c.id,
+				itemid:   task.item.itemid,
+				key:      task.item.key,
+				plugin:   task.plugin.name(),
+				stats:    &task.stats,
+			})
+		}
+		for key, s := range c.directStats {
+			infos = append(infos, &taskStatsInfo{clientID: c.id, key: key, plugin: s.plugin, stats: &s.taskStats})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].stats.totalLatency != infos[j].stats.totalLatency {
+			return infos[i].stats.totalLatency > infos[j].stats.totalLatency
+		}
+		if infos[i].clientID != infos[j].clientID {
+			return infos[i].clientID < infos[j].clientID
+		}
+		return infos[i].key < infos[j].key
+	})
+
+	var buf strings.Builder
+	for _, info := range infos {
+		if info.itemid != 0 {
+			buf.WriteString(fmt.Sprintf("[%d] itemid:%d key:'%s' plugin:%s\n", info.clientID, info.itemid, info.key,
+				info.plugin))
+		} else {
+			buf.WriteString(fmt.Sprintf("[%d] key:'%s' plugin:%s\n", info.clientID, info.key, info.plugin))
+		}
+		s := info.stats
+		buf.WriteString(fmt.Sprintf("executions: %d, errors: %d, timeouts: %d\n", s.executions, s.errors,
+			s.timeouts))
+		buf.WriteString(fmt.Sprintf("latency: last %s, avg %s, max %s, total %s\n", s.lastLatency,
+			s.averageLatency(), s.maxLatency, s.totalLatency))
+		if s.lastError != "" {
+			buf.WriteString(fmt.Sprintf("last error: %s\n", s.lastError))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -20,9 +20,13 @@
 package scheduler
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"reflect"
+	"strings"
 	"time"
 
 	"zabbix.com/internal/agent"
@@ -42,6 +46,16 @@ const (
 	priorityStopperTaskNs
 )
 
+// export calls plugin Export method or ExportWithContext if plugin supports export cancellation.
+func export(ctx context.Context, impl plugin.Accessor, key string, params []string,
+	provider plugin.ContextProvider) (interface{}, error) {
+	if exporter, ok := impl.(plugin.ExporterWithContext); ok {
+		return exporter.ExportWithContext(ctx, key, params, provider)
+	}
+	exporter, _ := impl.(plugin.Exporter)
+	return exporter.Export(key, params, provider)
+}
+
 // exporterTaskAccessor is used by clients to track item exporter tasks .
 type exporterTaskAccessor interface {
 	task() *exporterTask
@@ -131,29 +145,52 @@ func (t *collectorTask) getWeight() int {
 // for active check items.
 type exporterTask struct {
 	taskBase
-	item    clientItem
-	failed  bool
-	updated time.Time
-	client  ClientAccessor
-	meta    plugin.Meta
-	output  plugin.ResultWriter
+	item   clientItem
+	failed bool
+	// true if the export result can be shared with items of other clients requesting the same key
+	shared bool
+	// the failed state of the last finished check, accessed only by scheduler
+	unsupported bool
+	execution   taskExecution
+	stats       taskStats
+	updated     time.Time
+	client      ClientAccessor
+	meta        plugin.Meta
+	output      plugin.ResultWriter
 }
 
 func (t *exporterTask) perform(s Scheduler) {
-	// pass item key as parameter so it can be safely updated while task is being processed in its goroutine
-	go func(itemkey string) {
+	// exports are limited by Timeout parameter, unless plugin has larger timeout configured
+	timeout := time.Duration(agent.CurrentOptions().Timeout) * time.Second
+	if t.plugin.timeout > timeout {
+		timeout = t.plugin.timeout
+	}
+
+	// pass item key, sharing parameters and timeout so they can be safely updated while task is being
+	// processed in its goroutine
+	go func(itemkey string, shared bool, scheduled time.Time, limit time.Duration) {
 		var result *plugin.Result
-		exporter, _ := t.plugin.impl.(plugin.Exporter)
 		now := time.Now()
 		var key string
 		var params []string
 		var err error
+		var timeout bool
 
 		if key, params, err = itemutil.ParseKey(itemkey); err == nil {
 			var ret interface{}
 			log.Debugf("executing exporter task for itemid:%d key '%s'", t.item.itemid, itemkey)
 
-			if ret, err = exporter.Export(key, params, t); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), limit)
+			if shared {
+				ret, err = t.plugin.flights.do(ctx, itemkey, scheduled, limit, func(ctx context.Context) (interface{}, error) {
+					return export(ctx, t.plugin.impl, key, params, &sharedContext{})
+				})
+			} else {
+				ret, err = export(ctx, t.plugin.impl, key, params, t)
+			}
+			timeout = ctx.Err() == context.DeadlineExceeded
+			cancel()
+			if err == nil {
 				log.Debugf("executed exporter task for itemid:%d key '%s'", t.item.itemid, itemkey)
 				if ret != nil {
 					rt := reflect.TypeOf(ret)
@@ -184,21 +221,61 @@ func (t *exporterTask) perform(s Scheduler) {
 		if result != nil && result.Error != nil {
 			log.Warningf(`check '%s' is not supported: %s`, itemkey, result.Error)
 			t.failed = true
+			t.execution = taskExecution{duration: time.Since(now), err: result.Error, timeout: timeout}
 		} else {
 			t.failed = false
+			t.execution = taskExecution{duration: time.Since(now), timeout: timeout}
 		}
 
 		s.FinishTask(t)
-	}(t.item.key)
+	}(t.item.key, t.shared, t.scheduled, timeout)
+}
+
+// scheduleOffset returns deterministic item schedule offset in range [0, jitter) seconds
+func scheduleOffset(seed uint64, jitter int) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], seed)
+	_, _ = h.Write(buf[:])
+	return time.Duration(h.Sum64()%uint64(jitter)) * time.Second
+}
+
+// scheduleJitter returns maximum schedule offset for item with the specified update interval. Only
+// simple intervals are shifted, custom intervals (flexible and scheduling) define the exact check
+// time, which must not be moved.
+func scheduleJitter(delay string, jitter int) int {
+	if strings.Contains(delay, ";") {
+		return 0
+	}
+	return jitter
+}
+
+// scheduleSeed returns seed used to calculate item schedule. Shared items requested by several
+// clients are scheduled by their key, so they are performed at the same time.
+func (t *exporterTask) scheduleSeed() uint64 {
+	if !t.shared || t.plugin.sharedKeys[t.item.key] < 2 {
+		return t.item.itemid
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(t.item.key))
+	return h.Sum64()
 }
 
 func (t *exporterTask) reschedule(now time.Time) (err error) {
+	seed := t.scheduleSeed()
+	// GetNextcheck already spreads items within the update interval by seed % delay, the offset
+	// only adds configurable shift on top of it. The nextcheck is calculated for shifted time and
+	// then shifted back by the same offset, so the item update interval stays exact.
+	offset := scheduleOffset(seed, scheduleJitter(t.item.delay, agent.CurrentOptions().ScheduleJitter))
 	var nextcheck time.Time
-	nextcheck, err = zbxlib.GetNextcheck(t.item.itemid, t.item.delay, now)
+	nextcheck, err = zbxlib.GetNextcheck(seed, t.item.delay, now.Add(-offset))
 	if err != nil {
 		return
 	}
-	t.scheduled = nextcheck.Add(priorityExporterTaskNs)
+	t.scheduled = nextcheck.Add(offset + priorityExporterTaskNs)
 	return
 }
 
@@ -206,6 +283,13 @@ func (t *exporterTask) task() (task *exporterTask) {
 	return t
 }
 
+func (t *exporterTask) deactivate() {
+	if t.active && t.shared {
+		t.plugin.releaseSharedKey(t.item.key)
+	}
+	t.taskBase.deactivate()
+}
+
 // plugin.ContextProvider interface
 
 func (t *exporterTask) ClientID() (clientid uint64) {
@@ -234,12 +318,15 @@ func (t *exporterTask) GlobalRegexp() plugin.RegexpMatcher {
 // HostInterfaceItem etc values.
 type directExporterTask struct {
 	taskBase
-	item   clientItem
-	done   bool
-	expire time.Time
-	client ClientAccessor
-	meta   plugin.Meta
-	output plugin.ResultWriter
+	item      clientItem
+	done      bool
+	expire    time.Time
+	client    ClientAccessor
+	meta      plugin.Meta
+	output    plugin.ResultWriter
+	execution taskExecution
+	// the context is cancelled when the task result is no longer expected
+	ctx context.Context
 }
 
 func (t *directExporterTask) isRecurring() bool {
@@ -249,13 +336,13 @@ func (t *directExporterTask) perform(s Scheduler) {
 	// pass item key as parameter so it can be safely updated while task is being processed in its goroutine
 	go func(itemkey string) {
 		var result *plugin.Result
-		exporter, _ := t.plugin.impl.(plugin.Exporter)
 		now := time.Now()
 		var key string
 		var params []string
 		var err error
+		var timeout bool
 
-		if now.After(t.expire) {
+		if now.After(t.expire) || t.ctx.Err() != nil {
 			err = errors.New("No data available.")
 			log.Debugf("direct exporter task expired for key '%s' error: '%s'", itemkey, err.Error())
 		} else {
@@ -263,7 +350,17 @@ func (t *directExporterTask) perform(s Scheduler) {
 				var ret interface{}
 				log.Debugf("executing direct exporter task for key '%s'", itemkey)
 
-				if ret, err = exporter.Export(key, params, t); err == nil {
+				ctx, cancel := context.WithDeadline(t.ctx, t.expire)
+				if shareExport(t.plugin.impl, key) {
+					ret, err = t.plugin.flights.do(ctx, itemkey, time.Time{}, time.Until(t.expire), func(ctx context.Context) (interface{}, error) {
+						return export(ctx, t.plugin.impl, key, params, &sharedContext{})
+					})
+				} else {
+					ret, err = export(ctx, t.plugin.impl, key, params, t)
+				}
+				timeout = ctx.Err() == context.DeadlineExceeded
+				cancel()
+				if err == nil {
 					log.Debugf("executed direct exporter task for key '%s'", itemkey)
 					if ret != nil {
 						rt := reflect.TypeOf(ret)
@@ -287,6 +384,7 @@ func (t *directExporterTask) perform(s Scheduler) {
 			t.output.Write(result)
 			t.done = true
 		}
+		t.execution = taskExecution{duration: time.Since(now), err: err, timeout: timeout}
 
 		s.FinishTask(t)
 	}(t.item.key)
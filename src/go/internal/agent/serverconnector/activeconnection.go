@@ -22,27 +22,187 @@ package serverconnector
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	"zabbix.com/internal/agent"
+	"zabbix.com/internal/agent/resultcache"
+	"zabbix.com/pkg/log"
 	"zabbix.com/pkg/tls"
 	"zabbix.com/pkg/zbxcomms"
 )
 
+// connection is used by connector to exchange data with server
+type connection interface {
+	resultcache.Uploader
+	// exchange sends request to server and returns its response
+	exchange(data []byte, timeout time.Duration) ([]byte, error)
+	// configure applies runtime configuration changes
+	configure(options *agent.AgentOptions, localAddr net.Addr) error
+	// setTLSConfig replaces TLS configuration after TLS files have been reloaded
+	setTLSConfig(tlsConfig *tls.Config)
+}
+
+// activeConnection exchanges data with server over TCP or TLS connection. The connection used for
+// data uploads is kept open between uploads and reopened when server has closed it. Other requests
+// always use their own connection, so they are not delayed by uploads.
 type activeConnection struct {
 	address   string
 	hostname  string
 	localAddr net.Addr
+	// TLS configuration for new connections
 	tlsConfig *tls.Config
+	// protects localAddr and tlsConfig, which can be changed by connector during runtime
+	mutex sync.Mutex
+	// the open upload connection to server, nil if not connected
+	conn *zbxcomms.Connection
+	// serializes uploads from result cache and protects the upload connection
+	connMutex sync.Mutex
+}
+
+func (c *activeConnection) setLocalAddr(localAddr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.localAddr = localAddr
+}
+
+func (c *activeConnection) configure(options *agent.AgentOptions, localAddr net.Addr) error {
+	c.setLocalAddr(localAddr)
+
+	// reconnect with the new configuration
+	c.connMutex.Lock()
+	c.disconnect()
+	c.connMutex.Unlock()
+	return nil
+}
+
+func (c *activeConnection) setTLSConfig(tlsConfig *tls.Config) {
+	c.mutex.Lock()
+	c.tlsConfig = tlsConfig
+	c.mutex.Unlock()
+
+	// the current upload is finished with the old configuration, the next one reconnects
+	c.connMutex.Lock()
+	c.disconnect()
+	c.connMutex.Unlock()
+}
+
+func (c *activeConnection) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// open opens new connection to server
+func (c *activeConnection) open(timeout time.Duration) (conn *zbxcomms.Connection, err error) {
+	c.mutex.Lock()
+	localAddr := c.localAddr
+	tlsConfig := c.tlsConfig
+	c.mutex.Unlock()
+
+	log.Tracef("connecting to [%s]", c.address)
+	if conn, err = zbxcomms.Open(c.address, &localAddr, timeout, zbxcomms.TimeoutModeFixed, tlsConfig); err != nil {
+		log.Tracef("cannot connect to [%s]: %s", c.address, err)
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return
+}
+
+// send sends request over the connection and returns server response
+func (c *activeConnection) send(conn *zbxcomms.Connection, data []byte, timeout time.Duration) (b []byte, err error) {
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+
+	log.Tracef("sending [%s] to [%s]", string(data), c.address)
+	if err = conn.Write(data); err != nil {
+		log.Tracef("cannot send to [%s]: %s", c.address, err)
+		return
+	}
+
+	if b, err = conn.Read(); err != nil {
+		log.Tracef("cannot receive data from [%s]: %s", c.address, err)
+		return
+	}
+	log.Tracef("received [%s] from [%s]", string(b), c.address)
+
+	if len(b) == 0 {
+		return nil, errors.New("connection closed")
+	}
+	return
+}
+
+func (c *activeConnection) exchange(data []byte, timeout time.Duration) (b []byte, err error) {
+	conn, err := c.open(timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	return c.send(conn, data, timeout)
+}
+
+// upload sends request over the upload connection, connecting to server if necessary
+func (c *activeConnection) upload(data []byte, timeout time.Duration) (b []byte, err error) {
+	if c.conn == nil {
+		if c.conn, err = c.open(timeout); err != nil {
+			return
+		}
+	}
+
+	if b, err = c.send(c.conn, data, timeout); err != nil {
+		c.disconnect()
+	}
+	return
 }
 
 func (c *activeConnection) Write(data []byte, timeout time.Duration) (err error) {
-	b, err := zbxcomms.Exchange(c.address, &c.localAddr, timeout, data, c.tlsConfig)
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	reused := c.conn != nil
+	b, err := c.upload(data, timeout)
+	if err != nil && reused {
+		// the idle connection might have been closed by server, for example servers closing
+		// connection after each request, in this case the request is sent again over a new
+		// connection. Timed out requests are not repeated as server might still be processing them.
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			log.Debugf("reconnecting to [%s]: %s", c.address, err)
+			b, err = c.upload(data, timeout)
+		}
+	}
 	if err != nil {
-		return err
+		return
 	}
 
+	if err = parseAgentDataResponse(b); err != nil {
+		if _, ok := err.(*responseError); !ok {
+			c.disconnect()
+		}
+	}
+	return
+}
+
+// responseError is returned when server has received the request, but answered with
+// unsuccessful response
+type responseError struct {
+	info string
+}
+
+func (e *responseError) Error() string {
+	if len(e.info) != 0 {
+		return e.info
+	}
+	return "unsuccessful response"
+}
+
+// parseAgentDataResponse checks the server response to agent data upload
+func parseAgentDataResponse(b []byte) (err error) {
 	var response agentDataResponse
 
 	err = json.Unmarshal(b, &response)
@@ -51,10 +211,7 @@ func (c *activeConnection) Write(data []byte, timeout time.Duration) (err error)
 	}
 
 	if response.Response != "success" {
-		if len(response.Info) != 0 {
-			return fmt.Errorf("%s", response.Info)
-		}
-		return errors.New("unsuccessful response")
+		return &responseError{info: response.Info}
 	}
 
 	return nil
@@ -0,0 +1,152 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package serverconnector
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/zbxcomms"
+)
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// serve accepts connections and answers requests with the specified response, closing connection
+// after the specified number of requests. Returns the number of accepted connections.
+func serve(l *zbxcomms.Listener, response string, requests int) *int32 {
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept(time.Second, zbxcomms.TimeoutModeFixed)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				for i := 0; i < requests; i++ {
+					if _, err := conn.Read(); err != nil {
+						return
+					}
+					if err := conn.Write([]byte(response)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return &accepted
+}
+
+func TestActiveConnection(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	var inputs = []struct {
+		response string
+		requests int
+		expected int32
+	}{
+		// server keeps connection open
+		{`{"response":"success"}`, 100, 1},
+		// server closes connection after each upload, upload is repeated over new connection
+		{`{"response":"success"}`, 1, 5},
+		// server closes connection after several uploads
+		{`{"response":"success"}`, 2, 3},
+		// unsuccessful response does not close connection
+		{`{"response":"failed"}`, 100, 1},
+	}
+
+	for i, p := range inputs {
+		address, err := freeAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := zbxcomms.Listen(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := serve(l, p.response, p.requests)
+
+		c := &activeConnection{address: address, localAddr: &net.TCPAddr{}}
+		for j := 0; j < 5; j++ {
+			err = c.Write([]byte(`{"request":"agent data"}`), time.Second)
+			if _, ok := err.(*responseError); err != nil && !ok {
+				t.Errorf("[%d] Unexpected write error: %s", i, err)
+			}
+		}
+		if n := atomic.LoadInt32(accepted); n != p.expected {
+			t.Errorf("[%d] Expected %d connections while got %d", i, p.expected, n)
+		}
+
+		// other requests use their own connection
+		if _, err = c.exchange([]byte(`{"request":"active checks"}`), time.Second); err != nil {
+			t.Errorf("[%d] Unexpected exchange error: %s", i, err)
+		}
+		if n := atomic.LoadInt32(accepted); n != p.expected+1 {
+			t.Errorf("[%d] Expected %d connections while got %d", i, p.expected+1, n)
+		}
+		if p.expected == 1 && c.conn == nil {
+			t.Errorf("[%d] Expected upload connection to stay open", i)
+		}
+		c.disconnect()
+		l.Close()
+	}
+}
+
+func TestActiveConnectionTLSReload(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	address, err := freeAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := zbxcomms.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := serve(l, `{"response":"success"}`, 100)
+
+	c := &activeConnection{address: address, localAddr: &net.TCPAddr{}}
+	defer c.disconnect()
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			// the open connection must be replaced by a new one using the reloaded configuration
+			c.setTLSConfig(nil)
+		}
+		if err = c.Write([]byte(`{"request":"agent data"}`), time.Second); err != nil {
+			t.Errorf("Unexpected write error: %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("Expected %d connections while got %d", 2, n)
+	}
+}
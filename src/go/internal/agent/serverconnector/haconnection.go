@@ -0,0 +1,142 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package serverconnector
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/tls"
+)
+
+// haConnection exchanges data with the active node of HA cluster specified by ServerActive entry
+// with nodes separated by semicolons. When the current node is unreachable or answers that it is
+// not active, the next node is tried. The connection sticks to the working node until it fails.
+type haConnection struct {
+	clientID uint64
+	address  string
+	hostname string
+	nodes    []connection
+	// the index of the current node
+	current int
+	mutex   sync.Mutex
+}
+
+func newHAConnection(clientID uint64, address string, hostname string, nodes []connection) *haConnection {
+	return &haConnection{
+		clientID: clientID,
+		address:  address,
+		hostname: hostname,
+		nodes:    nodes,
+	}
+}
+
+// isStandbyResponse checks if the response information reports that the node is not the active
+// node of HA cluster
+func isStandbyResponse(info string) bool {
+	info = strings.ToLower(info)
+	return strings.Contains(info, "standby") || strings.Contains(info, "not active")
+}
+
+// needFailover checks if the request must be repeated with the next node
+func needFailover(err error) bool {
+	if e, ok := err.(*responseError); ok {
+		return isStandbyResponse(e.info)
+	}
+	return true
+}
+
+// try performs the operation with the current node, failing over to the next nodes if necessary
+func (c *haConnection) try(op func(node connection) error) (err error) {
+	c.mutex.Lock()
+	start := c.current
+	c.mutex.Unlock()
+
+	for i := 0; i < len(c.nodes); i++ {
+		index := (start + i) % len(c.nodes)
+		node := c.nodes[index]
+		if err = op(node); err == nil || !needFailover(err) {
+			if index != start {
+				c.mutex.Lock()
+				c.current = index
+				c.mutex.Unlock()
+				log.Warningf("[%d] switched to node [%s] of [%s]", c.clientID, node.Addr(), c.address)
+			}
+			return
+		}
+		log.Debugf("[%d] cannot connect to node [%s] of [%s]: %s", c.clientID, node.Addr(), c.address, err)
+	}
+	return
+}
+
+func (c *haConnection) configure(options *agent.AgentOptions, localAddr net.Addr) (err error) {
+	for _, node := range c.nodes {
+		if nerr := node.configure(options, localAddr); nerr != nil && err == nil {
+			err = nerr
+		}
+	}
+	return
+}
+
+func (c *haConnection) setTLSConfig(tlsConfig *tls.Config) {
+	for _, node := range c.nodes {
+		node.setTLSConfig(tlsConfig)
+	}
+}
+
+func (c *haConnection) exchange(data []byte, timeout time.Duration) (b []byte, err error) {
+	err = c.try(func(node connection) (err error) {
+		if b, err = node.exchange(data, timeout); err != nil {
+			return
+		}
+		var response agentDataResponse
+		if json.Unmarshal(b, &response) == nil && response.Response != "success" &&
+			isStandbyResponse(response.Info) {
+			return &responseError{info: response.Info}
+		}
+		return
+	})
+	return
+}
+
+func (c *haConnection) Write(data []byte, timeout time.Duration) (err error) {
+	return c.try(func(node connection) error {
+		return node.Write(data, timeout)
+	})
+}
+
+func (c *haConnection) Addr() (s string) {
+	return c.address
+}
+
+func (c *haConnection) Hostname() (s string) {
+	return c.hostname
+}
+
+func (c *haConnection) CanRetry() (enabled bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[c.current].CanRetry()
+}
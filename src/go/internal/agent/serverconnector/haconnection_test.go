@@ -0,0 +1,127 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package serverconnector
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"zabbix.com/internal/agent"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/tls"
+)
+
+type mockNode struct {
+	address  string
+	response string
+	err      error
+	calls    int
+	// the last request data
+	request []byte
+}
+
+func (n *mockNode) configure(options *agent.AgentOptions, localAddr net.Addr) error {
+	return nil
+}
+
+func (n *mockNode) setTLSConfig(tlsConfig *tls.Config) {
+}
+
+func (n *mockNode) exchange(data []byte, timeout time.Duration) ([]byte, error) {
+	n.calls++
+	n.request = data
+	if n.err != nil {
+		return nil, n.err
+	}
+	return []byte(n.response), nil
+}
+
+func (n *mockNode) Write(data []byte, timeout time.Duration) error {
+	b, err := n.exchange(data, timeout)
+	if err != nil {
+		return err
+	}
+	return parseAgentDataResponse(b)
+}
+
+func (n *mockNode) Addr() string {
+	return n.address
+}
+
+func (n *mockNode) Hostname() string {
+	return ""
+}
+
+func (n *mockNode) CanRetry() bool {
+	return true
+}
+
+func TestHAConnection(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	success := `{"response":"success"}`
+	nodes := []*mockNode{
+		{address: "node1", err: errors.New("connection refused")},
+		{address: "node2", response: `{"response":"failed","info":"node is in standby mode"}`},
+		{address: "node3", response: success},
+	}
+	c := newHAConnection(1, "node1;node2;node3", "", []connection{nodes[0], nodes[1], nodes[2]})
+
+	if err := c.Write([]byte("{}"), time.Second); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if c.current != 2 {
+		t.Errorf("Expected to switch to node3 while current node is %d", c.current)
+	}
+
+	// the working node is used until it fails
+	nodes[0].err = nil
+	nodes[0].response = success
+	if _, err := c.exchange([]byte("{}"), time.Second); err != nil {
+		t.Fatalf("Unexpected exchange error: %s", err)
+	}
+	if nodes[0].calls != 1 || nodes[2].calls != 2 {
+		t.Errorf("Expected to stick to node3 while got node1 %d, node3 %d calls", nodes[0].calls, nodes[2].calls)
+	}
+
+	// unsuccessful response of active node is returned without failover
+	nodes[2].response = `{"response":"failed","info":"host is not monitored"}`
+	if err := c.Write([]byte("{}"), time.Second); err == nil || err.Error() != "host is not monitored" {
+		t.Errorf("Expected server error while got %v", err)
+	}
+	if nodes[0].calls != 1 {
+		t.Errorf("Unexpected failover on server error")
+	}
+
+	nodes[2].err = errors.New("connection refused")
+	if err := c.Write([]byte("{}"), time.Second); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if c.current != 0 {
+		t.Errorf("Expected to switch to node1 while current node is %d", c.current)
+	}
+
+	nodes[0].err = errors.New("connection refused")
+	if err := c.Write([]byte("{}"), time.Second); err == nil {
+		t.Errorf("Expected error when all nodes fail")
+	}
+}
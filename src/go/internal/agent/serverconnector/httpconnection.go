@@ -0,0 +1,198 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package serverconnector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"zabbix.com/internal/agent"
+	zbxtls "zabbix.com/pkg/tls"
+)
+
+// maximum size of server response
+const maxHTTPResponseSize = 128 * 1048576
+
+// httpConnection sends active check requests and agent data to the HTTP(S) endpoint specified
+// in ServerActive with http:// or https:// prefix. The requests are posted as JSON.
+type httpConnection struct {
+	address  string
+	hostname string
+	// protects connection configuration, which can be changed by connector during runtime
+	// configuration reload
+	mutex     sync.Mutex
+	localAddr net.Addr
+	header    http.Header
+	client    *http.Client
+}
+
+// isHTTPAddress returns true if the ServerActive entry is HTTP(S) endpoint
+func isHTTPAddress(address string) bool {
+	address = strings.ToLower(address)
+	return strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://")
+}
+
+// checkHTTPAddress validates HTTP(S) endpoint URL
+func checkHTTPAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if len(u.Hostname()) == 0 {
+		return errors.New("empty host name")
+	}
+	return nil
+}
+
+// parseHTTPHeaders parses headers specified in "Name: value" format
+func parseHTTPHeaders(options *agent.AgentOptions) (header http.Header, err error) {
+	header = make(http.Header)
+	for _, h := range options.HTTPHeader {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid HTTP header \"%s\"", h)
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if options.HTTPBearerToken != "" {
+		header.Set("Authorization", "Bearer "+options.HTTPBearerToken)
+	}
+	header.Set("Content-Type", "application/json")
+
+	return
+}
+
+func newHTTPConnection(address string, hostname string, localAddr net.Addr,
+	options *agent.AgentOptions) (c *httpConnection, err error) {
+	c = &httpConnection{address: address, hostname: hostname}
+	if err = c.configure(options, localAddr); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *httpConnection) configure(options *agent.AgentOptions, localAddr net.Addr) (err error) {
+	var header http.Header
+	if header, err = parseHTTPHeaders(options); err != nil {
+		return
+	}
+
+	var tlsConfig tls.Config
+	if options.HTTPCAFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(options.HTTPCAFile); err != nil {
+			return fmt.Errorf("cannot read HTTP CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("cannot parse HTTP CA file \"%s\"", options.HTTPCAFile)
+		}
+	}
+
+	dialer := &net.Dialer{LocalAddr: localAddr}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tlsConfig,
+		TLSHandshakeTimeout: time.Duration(options.Timeout) * time.Second,
+		IdleConnTimeout:     time.Duration(options.BufferSend+options.Timeout) * time.Second,
+	}
+
+	c.mutex.Lock()
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+	c.localAddr = localAddr
+	c.header = header
+	c.client = &http.Client{Transport: transport}
+	c.mutex.Unlock()
+
+	return
+}
+
+// setTLSConfig does nothing, HTTP connections do not use agent TLS configuration
+func (c *httpConnection) setTLSConfig(tlsConfig *zbxtls.Config) {
+}
+
+func (c *httpConnection) exchange(data []byte, timeout time.Duration) ([]byte, error) {
+	c.mutex.Lock()
+	client := c.client
+	header := c.header
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.address, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxHTTPResponseSize})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected HTTP response status \"%s\"", resp.Status)
+	}
+
+	return b, nil
+}
+
+func (c *httpConnection) Write(data []byte, timeout time.Duration) (err error) {
+	b, err := c.exchange(data, timeout)
+	if err != nil {
+		return err
+	}
+
+	return parseAgentDataResponse(b)
+}
+
+func (c *httpConnection) Addr() (s string) {
+	return c.address
+}
+
+func (c *httpConnection) Hostname() (s string) {
+	return c.hostname
+}
+
+func (c *httpConnection) CanRetry() (enabled bool) {
+	return true
+}
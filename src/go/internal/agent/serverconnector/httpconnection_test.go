@@ -0,0 +1,79 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package serverconnector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"zabbix.com/internal/agent"
+)
+
+func TestHTTPConnection(t *testing.T) {
+	var body string
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		header = r.Header
+		if body == `{"fail":true}` {
+			_, _ = w.Write([]byte(`{"response":"failed","info":"test failure"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"response":"success"}`))
+	}))
+	defer server.Close()
+
+	options := agent.AgentOptions{
+		Timeout:         3,
+		HTTPHeader:      []string{"X-Test: value"},
+		HTTPBearerToken: "secret",
+	}
+	c, err := newHTTPConnection(server.URL, "host", nil, &options)
+	if err != nil {
+		t.Fatalf("cannot create connection: %s", err)
+	}
+
+	if err = c.Write([]byte(`{"data":[]}`), time.Second); err != nil {
+		t.Errorf("unexpected upload error: %s", err)
+	}
+	if body != `{"data":[]}` {
+		t.Errorf("unexpected request body: %s", body)
+	}
+	if header.Get("X-Test") != "value" || header.Get("Authorization") != "Bearer secret" ||
+		header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected request headers: %v", header)
+	}
+
+	if err = c.Write([]byte(`{"fail":true}`), time.Second); err == nil || err.Error() != "test failure" {
+		t.Errorf("expected upload error \"test failure\" while got %v", err)
+	}
+	if !c.CanRetry() {
+		t.Errorf("expected failed uploads to be retried")
+	}
+
+	options.HTTPHeader = []string{"invalid"}
+	if _, err = newHTTPConnection(server.URL, "host", nil, &options); err == nil {
+		t.Errorf("expected error for invalid HTTP header")
+	}
+}
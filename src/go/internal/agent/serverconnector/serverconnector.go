@@ -20,11 +20,19 @@
 package serverconnector
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -37,7 +45,6 @@ import (
 	"zabbix.com/pkg/plugin"
 	"zabbix.com/pkg/tls"
 	"zabbix.com/pkg/version"
-	"zabbix.com/pkg/zbxcomms"
 )
 
 const hostMetadataLen = 255
@@ -51,10 +58,25 @@ type Connector struct {
 	hostname    string
 	localAddr   net.Addr
 	lastError   error
+	errMutex    sync.Mutex
 	resultCache resultcache.ResultCache
+	uploader    connection
 	taskManager scheduler.Scheduler
 	options     *agent.AgentOptions
 	tlsConfig   *tls.Config
+	// the last saved active check configuration
+	savedChecks []byte
+	// the revision and number of items of the current active check configuration
+	configRevision uint64
+	items          int
+	// notified by scheduler when some of the active checks could not be scheduled
+	rejected chan struct{}
+	// the last heartbeat error, protected by errMutex
+	heartbeatError error
+	// heartbeat messages are not sent to HTTP(S) endpoints
+	heartbeat bool
+	// closed when the connector goroutine has been stopped
+	done chan struct{}
 }
 
 type activeChecksRequest struct {
@@ -65,13 +87,44 @@ type activeChecksRequest struct {
 	HostInterface string `json:"interface,omitempty"`
 	ListenIP      string `json:"ip,omitempty"`
 	ListenPort    int    `json:"port,omitempty"`
+	// the revision of the current active check configuration, server does not send
+	// the configuration if it has not been changed
+	ConfigRevision uint64 `json:"config_revision,omitempty"`
 }
 
 type activeChecksResponse struct {
-	Response string            `json:"response"`
-	Info     string            `json:"info"`
-	Data     []*plugin.Request `json:"data"`
-	Expressions []*glexpr.Expression `json:"regexp"`
+	Response       string               `json:"response"`
+	Info           string               `json:"info"`
+	Data           []*plugin.Request    `json:"data"`
+	Expressions    []*glexpr.Expression `json:"regexp"`
+	ConfigRevision uint64               `json:"config_revision"`
+}
+
+type heartbeatRequest struct {
+	Request       string `json:"request"`
+	Host          string `json:"host"`
+	HeartbeatFreq int    `json:"heartbeat_freq"`
+}
+
+// RefreshResult contains result of the active check configuration update requested at runtime
+type RefreshResult struct {
+	Address  string
+	Hostname string
+	Items    int
+	Err      error
+}
+
+// refreshRequest is used to request immediate active check configuration update
+type refreshRequest struct {
+	sink chan *RefreshResult
+}
+
+// tlsReloadRequest is used to request TLS configuration update after TLS files have been changed
+type tlsReloadRequest struct {
+}
+
+// revisionResetRequest is used to request the full active check configuration with the next update
+type revisionResetRequest struct {
 }
 
 type agentDataResponse struct {
@@ -79,214 +132,458 @@ type agentDataResponse struct {
 	Info     string `json:"info"`
 }
 
-// ParseServerActive validates address list of zabbix Server or Proxy for ActiveCheck
-func ParseServerActive() ([]string, error) {
-	if 0 == len(strings.TrimSpace(agent.Options.ServerActive)) {
-		return []string{}, nil
-	}
-
+// parseServerActiveNode validates and normalizes single server address
+func parseServerActiveNode(address string) (string, error) {
 	var checkAddr string
-	addresses := strings.Split(agent.Options.ServerActive, ",")
 
-	for i := 0; i < len(addresses); i++ {
-		addresses[i] = strings.TrimSpace(addresses[i])
-		u := url.URL{Host: addresses[i]}
-		ip := net.ParseIP(addresses[i])
-		if nil == ip && 0 == len(strings.TrimSpace(u.Hostname())) {
-			return nil, fmt.Errorf("address \"%s\": empty value", addresses[i])
+	address = strings.TrimSpace(address)
+	if isHTTPAddress(address) {
+		if err := checkHTTPAddress(address); err != nil {
+			return "", fmt.Errorf("address \"%s\": %s", address, err)
 		}
+		return address, nil
+	}
 
-		if nil != ip {
-			checkAddr = net.JoinHostPort(addresses[i], "10051")
-		} else if 0 == len(u.Port()) {
-			checkAddr = net.JoinHostPort(u.Hostname(), "10051")
-		} else {
-			checkAddr = addresses[i]
+	u := url.URL{Host: address}
+	ip := net.ParseIP(address)
+	if nil == ip && 0 == len(strings.TrimSpace(u.Hostname())) {
+		return "", fmt.Errorf("address \"%s\": empty value", address)
+	}
+
+	if nil != ip {
+		checkAddr = net.JoinHostPort(address, "10051")
+	} else if 0 == len(u.Port()) {
+		checkAddr = net.JoinHostPort(u.Hostname(), "10051")
+	} else {
+		checkAddr = address
+	}
+
+	h, p, err := net.SplitHostPort(checkAddr)
+	if err != nil {
+		return "", fmt.Errorf("address \"%s\": %s", address, err)
+	}
+	return net.JoinHostPort(strings.TrimSpace(h), strings.TrimSpace(p)), nil
+}
+
+// parseServerActiveGroup validates and normalizes ServerActive entry, returning its HA nodes
+func parseServerActiveGroup(address string) (group []string, err error) {
+	group = strings.Split(address, ";")
+	for i := 0; i < len(group); i++ {
+		if group[i], err = parseServerActiveNode(group[i]); err != nil {
+			return nil, err
 		}
+	}
+	return
+}
 
-		if h, p, err := net.SplitHostPort(checkAddr); err != nil {
-			return nil, fmt.Errorf("address \"%s\": %s", addresses[i], err)
-		} else {
-			addresses[i] = net.JoinHostPort(strings.TrimSpace(h), strings.TrimSpace(p))
+// ParseServerActive validates address list of zabbix Server or Proxy for ActiveCheck. The nodes
+// of HA cluster are separated by semicolons and returned as single address.
+func ParseServerActive(options *agent.AgentOptions) ([]string, error) {
+	if 0 == len(strings.TrimSpace(options.ServerActive)) {
+		if len(options.ServerActiveTLS) != 0 {
+			return nil, errors.New("ServerActiveTLS parameters set without ServerActive")
 		}
+		return []string{}, nil
+	}
 
-		for j := 0; j < i; j++ {
-			if addresses[j] == addresses[i] {
-				return nil, fmt.Errorf("address \"%s\" specified more than once", addresses[i])
+	addresses := strings.Split(options.ServerActive, ",")
+	nodes := make(map[string]bool)
+
+	for i := 0; i < len(addresses); i++ {
+		group, err := parseServerActiveGroup(addresses[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range group {
+			if nodes[addr] {
+				return nil, fmt.Errorf("address \"%s\" specified more than once", addr)
 			}
+			nodes[addr] = true
 		}
+		addresses[i] = strings.Join(group, ";")
+	}
+
+	if err := validateServerActiveTLS(options, addresses); err != nil {
+		return nil, err
 	}
 
 	return addresses, nil
 }
 
-func (c *Connector) refreshActiveChecks() {
-	var err error
-
-	a := activeChecksRequest{
-		Request: "active checks",
-		Host:    c.hostname,
-		Version: version.Short(),
+// validateServerActiveTLS checks that each ServerActiveTLS entry refers to a different ServerActive
+// entry, specified in the same way with all its HA nodes
+func validateServerActiveTLS(options *agent.AgentOptions, addresses []string) error {
+	names := make([]string, 0, len(options.ServerActiveTLS))
+	for name := range options.ServerActiveTLS {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	log.Debugf("[%d] In refreshActiveChecks() from [%s]", c.clientID, c.address)
-	defer log.Debugf("[%d] End of refreshActiveChecks() from [%s]", c.clientID, c.address)
-
-	if a.HostInterface, err = processConfigItem(c.taskManager, time.Duration(c.options.Timeout)*time.Second, "HostInterface",
-		c.options.HostInterface, c.options.HostInterfaceItem, hostInterfaceLen, agent.LocalChecksClientID); err != nil {
-		log.Errf("cannot get host interface: %s", err)
-		return
+	entries := make(map[string]string)
+	for _, address := range addresses {
+		entries[address] = ""
 	}
 
-	if a.HostMetadata, err = processConfigItem(c.taskManager, time.Duration(c.options.Timeout)*time.Second, "HostMetadata",
-		c.options.HostMetadata, c.options.HostMetadataItem, hostMetadataLen, agent.LocalChecksClientID); err != nil {
-		log.Errf("cannot get host metadata: %s", err)
-		return
+	for _, name := range names {
+		group, err := parseServerActiveGroup(options.ServerActiveTLS[name].ServerActive)
+		if err != nil {
+			return fmt.Errorf("invalid ServerActiveTLS.%s.ServerActive parameter: %s", name, err)
+		}
+		address := strings.Join(group, ";")
+		other, ok := entries[address]
+		if !ok {
+			return fmt.Errorf("ServerActiveTLS.%s.ServerActive parameter \"%s\" does not match any ServerActive entry",
+				name, address)
+		}
+		if other != "" {
+			return fmt.Errorf("ServerActiveTLS.%s and ServerActiveTLS.%s are set for the same ServerActive entry \"%s\"",
+				other, name, address)
+		}
+		for _, node := range group {
+			if isHTTPAddress(node) {
+				return fmt.Errorf("ServerActiveTLS.%s cannot be set for HTTP address \"%s\"", name, node)
+			}
+		}
+		entries[address] = name
 	}
+	return nil
+}
 
-	if len(c.options.ListenIP) > 0 {
-		if i := strings.IndexByte(c.options.ListenIP, ','); i != -1 {
-			a.ListenIP = c.options.ListenIP[:i]
-		} else {
-			a.ListenIP = c.options.ListenIP
+// getTLSConfig returns TLS configuration for connections to the specified ServerActive entry, using
+// the entry's ServerActiveTLS parameters if configured and the global TLS parameters otherwise
+func getTLSConfig(options *agent.AgentOptions, address string) (cfg *tls.Config, err error) {
+	for name, tlsOptions := range options.ServerActiveTLS {
+		group, gerr := parseServerActiveGroup(tlsOptions.ServerActive)
+		if gerr != nil || strings.Join(group, ";") != address {
+			continue
+		}
+		if cfg, err = agent.GetServerActiveTLSConfig(&tlsOptions); err != nil {
+			return nil, fmt.Errorf("invalid ServerActiveTLS.%s parameters: %s", name, err)
 		}
+		return
 	}
+	return agent.GetTLSConfig(options)
+}
 
-	if c.options.ListenPort != defaultAgentPort {
-		a.ListenPort = c.options.ListenPort
+// RefreshTimeout returns the maximum time the active check configuration update from the specified
+// ServerActive entry can take. The host interface and metadata items are checked first and then
+// each HA node is contacted in turn, every step taking up to Timeout.
+func RefreshTimeout(options *agent.AgentOptions, address string) time.Duration {
+	steps := len(strings.Split(address, ";"))
+	if options.HostInterface == "" && options.HostInterfaceItem != "" {
+		steps++
 	}
+	if options.HostMetadata == "" && options.HostMetadataItem != "" {
+		steps++
+	}
+	return time.Duration(steps) * time.Second * time.Duration(options.Timeout)
+}
 
-	request, err := json.Marshal(&a)
-	if err != nil {
-		log.Errf("[%d] cannot create active checks request to [%s]: %s", c.clientID, c.address, err)
+// activeChecksPath returns the file name of the saved active check configuration of the
+// address/hostname combination
+func activeChecksPath(dir string, address string, hostname string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(address + "/" + hostname))
+	return filepath.Join(dir, fmt.Sprintf("%016x.json", h.Sum64()))
+}
+
+// writeFileSync writes data to the file and flushes it to disk, so the file is complete when it
+// replaces the previous one
+func writeFileSync(path string, data []byte) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
 		return
 	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
 
-	data, err := zbxcomms.Exchange(c.address, &c.localAddr, time.Second*time.Duration(c.options.Timeout), request, c.tlsConfig)
+// saveActiveChecks saves the received active check configuration, so it can be used after restart
+// until the configuration is received from server
+func (c *Connector) saveActiveChecks(data []byte) {
+	if c.options.ActiveChecksCacheDir == "" || bytes.Equal(data, c.savedChecks) {
+		return
+	}
 
-	if err != nil {
-		if c.lastError == nil || err.Error() != c.lastError.Error() {
-			log.Warningf("[%d] active check configuration update from [%s %s] started to fail (%s)", c.clientID,
-				c.address, c.hostname, err)
-			c.lastError = err
+	path := activeChecksPath(c.options.ActiveChecksCacheDir, c.address, c.hostname)
+	err := os.MkdirAll(c.options.ActiveChecksCacheDir, 0700)
+	if err == nil {
+		if err = writeFileSync(path+".tmp", data); err == nil {
+			err = os.Rename(path+".tmp", path)
 		}
+	}
+	if err != nil {
+		log.Warningf("[%d] cannot save list of active checks from [%s %s]: %s", c.clientID, c.address,
+			c.hostname, err)
 		return
 	}
+	c.savedChecks = data
+}
 
-	if c.lastError != nil {
-		log.Warningf("[%d] active check configuration update from [%s] is working again", c.clientID, c.address)
-		c.lastError = nil
+// removeActiveChecks removes the saved active check configuration
+func (c *Connector) removeActiveChecks(dir string) {
+	if dir == "" {
+		return
 	}
+	if err := os.Remove(activeChecksPath(dir, c.address, c.hostname)); err != nil && !os.IsNotExist(err) {
+		log.Warningf("[%d] cannot remove saved list of active checks from [%s %s]: %s", c.clientID, c.address,
+			c.hostname, err)
+	}
+}
 
-	var response activeChecksResponse
-
-	err = json.Unmarshal(data, &response)
-	if err != nil {
-		log.Errf("[%d] cannot parse list of active checks from [%s]: %s", c.clientID, c.address, err)
+// loadActiveChecks schedules the saved active checks until the active check configuration is
+// received from server
+func (c *Connector) loadActiveChecks() {
+	if c.options.ActiveChecksCacheDir == "" {
 		return
 	}
 
-	if response.Response != "success" {
-		if len(response.Info) != 0 {
-			log.Errf("[%d] no active checks on server [%s]: %s", c.clientID, c.address, response.Info)
-		} else {
-			log.Errf("[%d] no active checks on server [%s]", c.clientID, c.address)
+	data, err := ioutil.ReadFile(activeChecksPath(c.options.ActiveChecksCacheDir, c.address, c.hostname))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("[%d] cannot read saved list of active checks from [%s %s]: %s", c.clientID, c.address,
+				c.hostname, err)
 		}
-		c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), []*glexpr.Expression{}, []*plugin.Request{})
 		return
 	}
 
+	var response activeChecksResponse
+	if err = json.Unmarshal(data, &response); err != nil {
+		log.Warningf("[%d] cannot parse saved list of active checks from [%s %s]: %s", c.clientID, c.address,
+			c.hostname, err)
+		return
+	}
 	if response.Data == nil {
-		log.Errf("[%d] cannot parse list of active checks from [%s]: data array is missing", c.clientID,
-			c.address)
+		log.Warningf("[%d] cannot parse saved list of active checks from [%s %s]: data array is missing",
+			c.clientID, c.address, c.hostname)
+		return
+	}
+	if err = validateActiveChecks(&response); err != nil {
+		log.Warningf("[%d] cannot parse saved list of active checks from [%s %s]: %s", c.clientID, c.address,
+			c.hostname, err)
 		return
 	}
 
+	log.Infof("[%d] using saved list of %d active checks from [%s %s] until it is received from server",
+		c.clientID, len(response.Data), c.address, c.hostname)
+	c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), response.Expressions, response.Data,
+		nil)
+	c.savedChecks = data
+}
+
+// validateActiveChecks checks that all mandatory item and global regular expression fields are present
+// in the active check configuration
+func validateActiveChecks(response *activeChecksResponse) error {
 	for i := 0; i < len(response.Data); i++ {
 		if len(response.Data[i].Key) == 0 {
 			if response.Data[i].Itemid == 0 {
-				log.Errf("[%d] cannot parse list of active checks from [%s]: key is missing",
-					c.clientID, c.address)
-				return
+				return errors.New("key is missing")
 			}
-
-			log.Errf("[%d] cannot parse list of active checks from [%s]: key is missing for itemid '%d'",
-				c.clientID, c.address, response.Data[i].Itemid)
-			return
+			return fmt.Errorf("key is missing for itemid '%d'", response.Data[i].Itemid)
 		}
 
 		if response.Data[i].Itemid == 0 {
-			log.Errf("[%d] cannot parse list of active checks from [%s]: itemid is missing for key '%s'",
-				c.clientID, c.address, response.Data[i].Key)
-			return
+			return fmt.Errorf("itemid is missing for key '%s'", response.Data[i].Key)
 		}
 
 		if len(response.Data[i].Delay) == 0 {
-			log.Errf("[%d] cannot parse list of active checks from [%s]: delay is missing for itemid '%d'",
-				c.clientID, c.address, response.Data[i].Itemid)
-			return
+			return fmt.Errorf("delay is missing for itemid '%d'", response.Data[i].Itemid)
 		}
 
 		if response.Data[i].LastLogsize == nil {
-			log.Errf("[%d] cannot parse list of active checks from [%s]: lastlogsize is missing for itemid '%d'",
-				c.clientID, c.address, response.Data[i].Itemid)
-			return
+			return fmt.Errorf("lastlogsize is missing for itemid '%d'", response.Data[i].Itemid)
 		}
 
 		if response.Data[i].Mtime == nil {
-			log.Errf("[%d] cannot parse list of active checks from [%s]: mtime is missing for itemid '%d'",
-				c.clientID, c.address, response.Data[i].Itemid)
-			return
+			return fmt.Errorf("mtime is missing for itemid '%d'", response.Data[i].Itemid)
 		}
 	}
 
 	for i := 0; i < len(response.Expressions); i++ {
 		if len(response.Expressions[i].Name) == 0 {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: cannot retrieve value of tag "name"`,
-				c.clientID, c.address)
-			return
+			return errors.New(`cannot retrieve value of tag "name"`)
 		}
 
 		if len(response.Expressions[i].Body) == 0 {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: cannot retrieve value of tag "expression"`,
-				c.clientID, c.address)
-			return
+			return errors.New(`cannot retrieve value of tag "expression"`)
 		}
 
 		if response.Expressions[i].Type == nil {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: cannot retrieve value of tag "expression_type"`,
-				c.clientID, c.address)
-			return
+			return errors.New(`cannot retrieve value of tag "expression_type"`)
 		}
 
 		if response.Expressions[i].Delimiter == nil {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: cannot retrieve value of tag "exp_delimiter"`,
-				c.clientID, c.address)
-			return
+			return errors.New(`cannot retrieve value of tag "exp_delimiter"`)
 		}
 
 		if len(*response.Expressions[i].Delimiter) != 1 {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: invalid tag "exp_delimiter" value "%s"`,
-				c.clientID, c.address, *response.Expressions[i].Delimiter)
-			return
+			return fmt.Errorf(`invalid tag "exp_delimiter" value "%s"`, *response.Expressions[i].Delimiter)
 		}
 
 		if response.Expressions[i].Mode == nil {
-			log.Errf(`[%d] cannot parse list of active checks from [%s]: cannot retrieve value of tag "case_sensitive"`,
-				c.clientID, c.address)
-			return
+			return errors.New(`cannot retrieve value of tag "case_sensitive"`)
 		}
 	}
+	return nil
+}
 
-	c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), response.Expressions, response.Data)
+// activeChecksError logs and returns active check configuration update error
+func (c *Connector) activeChecksError(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	log.Errf("[%d] %s", c.clientID, err)
+	return err
+}
+
+// refreshActiveChecks requests active check configuration from server and updates scheduler tasks.
+// The number of received items is returned.
+func (c *Connector) refreshActiveChecks() (items int, err error) {
+	select {
+	case <-c.rejected:
+		// request the full configuration, so the rejected items are scheduled again
+		c.configRevision = 0
+	default:
+	}
+
+	a := activeChecksRequest{
+		Request:        "active checks",
+		Host:           c.hostname,
+		Version:        version.Short(),
+		ConfigRevision: c.configRevision,
+	}
+
+	log.Debugf("[%d] In refreshActiveChecks() from [%s]", c.clientID, c.address)
+	defer log.Debugf("[%d] End of refreshActiveChecks() from [%s]", c.clientID, c.address)
+
+	if a.HostInterface, err = processConfigItem(c.taskManager, time.Duration(c.options.Timeout)*time.Second, "HostInterface",
+		c.options.HostInterface, c.options.HostInterfaceItem, hostInterfaceLen, agent.LocalChecksClientID); err != nil {
+		return 0, c.activeChecksError("cannot get host interface: %s", err)
+	}
+
+	if a.HostMetadata, err = processConfigItem(c.taskManager, time.Duration(c.options.Timeout)*time.Second, "HostMetadata",
+		c.options.HostMetadata, c.options.HostMetadataItem, hostMetadataLen, agent.LocalChecksClientID); err != nil {
+		return 0, c.activeChecksError("cannot get host metadata: %s", err)
+	}
+
+	if len(c.options.ListenIP) > 0 {
+		if i := strings.IndexByte(c.options.ListenIP, ','); i != -1 {
+			a.ListenIP = c.options.ListenIP[:i]
+		} else {
+			a.ListenIP = c.options.ListenIP
+		}
+	}
+
+	if c.options.ListenPort != defaultAgentPort {
+		a.ListenPort = c.options.ListenPort
+	}
+
+	request, err := json.Marshal(&a)
+	if err != nil {
+		return 0, c.activeChecksError("cannot create active checks request to [%s]: %s", c.address, err)
+	}
+
+	data, err := c.uploader.exchange(request, time.Second*time.Duration(c.options.Timeout))
+
+	if err != nil {
+		if c.lastError == nil || err.Error() != c.lastError.Error() {
+			log.Warningf("[%d] active check configuration update from [%s %s] started to fail (%s)", c.clientID,
+				c.address, c.hostname, err)
+			c.setLastError(err)
+		}
+		return
+	}
+
+	if c.lastError != nil {
+		log.Warningf("[%d] active check configuration update from [%s] is working again", c.clientID, c.address)
+		c.setLastError(nil)
+	}
+
+	var response activeChecksResponse
+
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return 0, c.activeChecksError("cannot parse list of active checks from [%s]: %s", c.address, err)
+	}
+
+	if response.Response != "success" {
+		c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), []*glexpr.Expression{}, []*plugin.Request{}, nil)
+		c.removeActiveChecks(c.options.ActiveChecksCacheDir)
+		c.savedChecks = nil
+		c.configRevision = 0
+		c.items = 0
+		if len(response.Info) != 0 {
+			return 0, c.activeChecksError("no active checks on server [%s]: %s", c.address, response.Info)
+		}
+		return 0, c.activeChecksError("no active checks on server [%s]", c.address)
+	}
+
+	if response.Data == nil {
+		if c.configRevision != 0 && response.ConfigRevision == c.configRevision {
+			log.Debugf("[%d] active check configuration from [%s] is unchanged", c.clientID, c.address)
+			return c.items, nil
+		}
+		return 0, c.activeChecksError("cannot parse list of active checks from [%s]: data array is missing",
+			c.address)
+	}
+
+	if err = validateActiveChecks(&response); err != nil {
+		return 0, c.activeChecksError("cannot parse list of active checks from [%s]: %s", c.address, err)
+	}
+
+	c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), response.Expressions, response.Data,
+		c.rejected)
+	c.saveActiveChecks(data)
+	c.configRevision = response.ConfigRevision
+	c.items = len(response.Data)
+
+	return len(response.Data), nil
+}
+
+// sendHeartbeat sends heartbeat message to server, so it can detect agent that stopped sending data
+func (c *Connector) sendHeartbeat() {
+	request, err := json.Marshal(&heartbeatRequest{
+		Request:       "active check heartbeat",
+		Host:          c.hostname,
+		HeartbeatFreq: c.options.HeartbeatFrequency,
+	})
+	if err != nil {
+		log.Errf("[%d] cannot create heartbeat request to [%s]: %s", c.clientID, c.address, err)
+		return
+	}
+
+	// heartbeat is sent over its own connection, leaving the upload connection intact. It's sent from
+	// the connector goroutine, so unreachable server delays refresh and uploads by up to Timeout.
+	var b []byte
+	if b, err = c.uploader.exchange(request, time.Second*time.Duration(c.options.Timeout)); err == nil {
+		err = parseAgentDataResponse(b)
+	}
+	if err != nil {
+		if c.heartbeatError == nil || err.Error() != c.heartbeatError.Error() {
+			log.Warningf("[%d] sending heartbeat message to [%s %s] started to fail (%s)", c.clientID,
+				c.address, c.hostname, err)
+			c.setHeartbeatError(err)
+		}
+		return
+	}
+
+	if c.heartbeatError != nil {
+		log.Warningf("[%d] sending heartbeat message to [%s] is working again", c.clientID, c.address)
+		c.setHeartbeatError(nil)
+	}
 }
 
 func (c *Connector) run() {
 	var lastRefresh time.Time
 	var lastFlush time.Time
+	var lastHeartbeat time.Time
 
 	defer log.PanicHook()
 	log.Debugf("[%d] starting server connector for '%s'", c.clientID, c.address)
+	c.loadActiveChecks()
 
 	ticker := time.NewTicker(time.Second)
 run:
@@ -299,9 +596,14 @@ run:
 				lastFlush = now
 			}
 			if now.Sub(lastRefresh) > time.Second*time.Duration(c.options.RefreshActiveChecks) {
-				c.refreshActiveChecks()
+				_, _ = c.refreshActiveChecks()
 				lastRefresh = time.Now()
 			}
+			if c.heartbeat && c.options.HeartbeatFrequency != 0 &&
+				now.Sub(lastHeartbeat) >= time.Second*time.Duration(c.options.HeartbeatFrequency) {
+				c.sendHeartbeat()
+				lastHeartbeat = time.Now()
+			}
 		case u := <-c.input:
 			if u == nil {
 				break run
@@ -309,18 +611,59 @@ run:
 			switch v := u.(type) {
 			case *agent.AgentOptions:
 				c.updateOptions(v)
-				// TODO: when runtime configuration reload is implemented the result cache active
-				// connection properties must be updated too
+				if err := c.uploader.configure(v, c.localAddr); err != nil {
+					log.Warningf("[%d] cannot update connection configuration for [%s]: %s", c.clientID, c.address, err)
+				}
+				// ServerActiveTLS parameters can be changed at runtime
+				c.reloadTLSConfig()
+				c.resultCache.UpdateOptions(v)
+				// the changed configuration can affect which items are supported
+				c.configRevision = 0
+			case *refreshRequest:
+				r := &RefreshResult{Address: c.address, Hostname: c.hostname}
+				r.Items, r.Err = c.refreshActiveChecks()
+				lastRefresh = time.Now()
+				v.sink <- r
+			case *tlsReloadRequest:
+				c.reloadTLSConfig()
+			case *revisionResetRequest:
+				c.configRevision = 0
 			}
 		}
 	}
 	log.Debugf("[%d] server connector has been stopped", c.clientID)
+	close(c.done)
 	monitor.Unregister(monitor.Input)
 }
 
 func (c *Connector) updateOptions(options *agent.AgentOptions) {
 	c.options = options
-	c.localAddr = &net.TCPAddr{IP: net.ParseIP(agent.Options.SourceIP), Port: 0}
+	c.localAddr = &net.TCPAddr{IP: net.ParseIP(options.SourceIP), Port: 0}
+}
+
+// reloadTLSConfig rebuilds TLS configuration, reading the PSK file again. The new configuration
+// is used for the next connections to server.
+func (c *Connector) reloadTLSConfig() {
+	tlsConfig, err := getTLSConfig(c.options, c.address)
+	if err != nil {
+		log.Warningf("[%d] cannot reload TLS configuration for [%s]: %s", c.clientID, c.address, err)
+		return
+	}
+	c.tlsConfig = tlsConfig
+	c.uploader.setTLSConfig(tlsConfig)
+}
+
+// newConnection creates connection to the specified server address
+func (c *Connector) newConnection(address string) (connection, error) {
+	if isHTTPAddress(address) {
+		return newHTTPConnection(address, c.hostname, c.localAddr, c.options)
+	}
+	return &activeConnection{
+		address:   address,
+		hostname:  c.hostname,
+		localAddr: c.localAddr,
+		tlsConfig: c.tlsConfig,
+	}, nil
 }
 
 func New(taskManager scheduler.Scheduler, address string, hostname string, options *agent.AgentOptions) (connector *Connector, err error) {
@@ -330,25 +673,41 @@ func New(taskManager scheduler.Scheduler, address string, hostname string, optio
 		hostname:    hostname,
 		input:       make(chan interface{}, 10),
 		clientID:    agent.NewClientID(),
+		done:        make(chan struct{}),
+		rejected:    make(chan struct{}, 1),
+		heartbeat:   true,
 	}
 
 	c.updateOptions(options)
-	if c.tlsConfig, err = agent.GetTLSConfig(c.options); err != nil {
+	if c.tlsConfig, err = getTLSConfig(c.options, address); err != nil {
 		return
 	}
 
-	ac := &activeConnection{
-		address:   address,
-		hostname:  hostname,
-		localAddr: c.localAddr,
-		tlsConfig: c.tlsConfig,
+	if nodes := strings.Split(address, ";"); len(nodes) > 1 {
+		conns := make([]connection, len(nodes))
+		for i, node := range nodes {
+			if conns[i], err = c.newConnection(node); err != nil {
+				return
+			}
+			if isHTTPAddress(node) {
+				c.heartbeat = false
+			}
+		}
+		c.uploader = newHAConnection(c.clientID, address, hostname, conns)
+	} else {
+		if c.uploader, err = c.newConnection(address); err != nil {
+			return
+		}
+		c.heartbeat = !isHTTPAddress(address)
 	}
-	c.resultCache = resultcache.New(&agent.Options, c.clientID, ac)
 
 	return c, nil
 }
 
+// Start creates result cache and starts the connector. The result cache must be prepared for the
+// connector address/hostname combination before starting.
 func (c *Connector) Start() {
+	c.resultCache = resultcache.New(c.options, c.clientID, c.uploader)
 	c.resultCache.Start()
 	monitor.Register(monitor.Input)
 	go c.run()
@@ -362,8 +721,41 @@ func (c *Connector) StopCache() {
 	c.resultCache.Stop()
 }
 
-func (c *Connector) UpdateOptions() {
-	c.input <- &agent.Options
+// Remove stops the connector and its result cache at runtime, when the server or host name has
+// been removed from configuration. The client tasks are released after the connector goroutine
+// has been stopped, so they cannot be updated again, and the cached data flushed.
+func (c *Connector) Remove() {
+	c.StopConnector()
+	<-c.done
+	c.taskManager.UpdateTasks(c.clientID, c.resultCache.(plugin.ResultWriter), []*glexpr.Expression{},
+		[]*plugin.Request{}, nil)
+	c.removeActiveChecks(agent.CurrentOptions().ActiveChecksCacheDir)
+	c.resultCache.Upload(nil)
+	c.StopCache()
+}
+
+// RefreshActiveChecks requests immediate active check configuration update. The update result
+// is written to the returned channel.
+func (c *Connector) RefreshActiveChecks() <-chan *RefreshResult {
+	sink := make(chan *RefreshResult, 1)
+	c.input <- &refreshRequest{sink: sink}
+	return sink
+}
+
+func (c *Connector) UpdateOptions(options *agent.AgentOptions) {
+	c.input <- options
+}
+
+// ReloadTLS requests TLS configuration update after TLS files have been changed. The current
+// requests are finished with the old configuration.
+func (c *Connector) ReloadTLS() {
+	c.input <- &tlsReloadRequest{}
+}
+
+// ResetConfigRevision requests the full active check configuration with the next update, so
+// the items are scheduled again after user parameters have been reloaded
+func (c *Connector) ResetConfigRevision() {
+	c.input <- &revisionResetRequest{}
 }
 
 func processConfigItem(taskManager scheduler.Scheduler, timeout time.Duration, name, value, item string, length int, clientID uint64) (string, error) {
@@ -397,3 +789,43 @@ func processConfigItem(taskManager scheduler.Scheduler, timeout time.Duration, n
 func (c *Connector) ClientID() uint64 {
 	return c.clientID
 }
+
+// setLastError stores the last active check configuration update error. The error is modified only
+// by connector goroutine, but can be read by status listener.
+func (c *Connector) setLastError(err error) {
+	c.errMutex.Lock()
+	c.lastError = err
+	c.errMutex.Unlock()
+}
+
+// setHeartbeatError stores the last heartbeat error
+func (c *Connector) setHeartbeatError(err error) {
+	c.errMutex.Lock()
+	c.heartbeatError = err
+	c.errMutex.Unlock()
+}
+
+// LastError returns the last active check configuration update error or, if the last update
+// succeeded, the last heartbeat error. Nil is returned if both the last update and heartbeat
+// succeeded.
+func (c *Connector) LastError() (err error) {
+	c.errMutex.Lock()
+	if err = c.lastError; err == nil {
+		err = c.heartbeatError
+	}
+	c.errMutex.Unlock()
+	return
+}
+
+// CacheStats returns result cache statistics
+func (c *Connector) CacheStats() resultcache.Stats {
+	return c.resultCache.Stats()
+}
+
+func (c *Connector) Address() string {
+	return c.address
+}
+
+func (c *Connector) Hostname() string {
+	return c.hostname
+}
@@ -1,10 +1,20 @@
 package serverconnector
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
 
 	"zabbix.com/internal/agent"
+	"zabbix.com/internal/agent/resultcache"
+	"zabbix.com/internal/agent/scheduler"
+	"zabbix.com/pkg/glexpr"
+	"zabbix.com/pkg/log"
+	"zabbix.com/pkg/plugin"
 )
 
 type ParseServerActiveParams struct {
@@ -47,6 +57,16 @@ func TestParseServerActive(t *testing.T) {
 		{"[::1]:123,[::2]:123", false, []string{"[::1]:123", "[::2]:123"}},
 		{"[aaa]:123,[aab]:123", false, []string{"aaa:123", "aab:123"}},
 		{"abc,aaa", false, []string{"abc:10051", "aaa:10051"}},
+		{"https://gateway.example.com/zabbix", false, []string{"https://gateway.example.com/zabbix"}},
+		{"aaa, http://gateway:8080/data", false, []string{"aaa:10051", "http://gateway:8080/data"}},
+		{"http:///path", true, nil},
+		{"https://gateway, https://gateway", true, nil},
+		{"aaa;aab", false, []string{"aaa:10051;aab:10051"}},
+		{"aaa:10052 ; [::1]:123, aac", false, []string{"aaa:10052;[::1]:123", "aac:10051"}},
+		{"aaa;https://gateway/zabbix", false, []string{"aaa:10051;https://gateway/zabbix"}},
+		{"aaa;", true, nil},
+		{"aaa;aaa:10051", true, nil},
+		{"aaa;aab,aab", true, nil},
 	}
 
 	for i, p := range inputs {
@@ -54,7 +74,7 @@ func TestParseServerActive(t *testing.T) {
 		var err error
 
 		agent.Options.ServerActive = p.serverActive
-		if al, err = ParseServerActive(); nil != err && true != p.isError {
+		if al, err = ParseServerActive(&agent.Options); nil != err && true != p.isError {
 			t.Errorf("[%d] test with value \"%s\" failed: %s\n", i, p.serverActive, err.Error())
 			continue
 		}
@@ -70,3 +90,233 @@ func TestParseServerActive(t *testing.T) {
 		}
 	}
 }
+
+func TestParseServerActiveTLS(t *testing.T) {
+	var inputs = []struct {
+		serverActive string
+		tls          map[string]string
+		isError      bool
+	}{
+		{"aaa,aab", map[string]string{"a": "aab"}, false},
+		{"aaa,aab", map[string]string{"a": " aab:10051 "}, false},
+		{"aaa;aab,aac", map[string]string{"a": "aaa;aab", "b": "aac"}, false},
+		{"aaa,aab", map[string]string{"a": "aac"}, true},
+		{"aaa;aab,aac", map[string]string{"a": "aaa"}, true},
+		{"aaa;aab,aac", map[string]string{"a": "aab;aaa"}, true},
+		{"aaa,aab", map[string]string{"a": "aab", "b": "aab:10051"}, true},
+		{"aaa,aab", map[string]string{"a": ":80"}, true},
+		{"aaa,https://gateway/zabbix", map[string]string{"a": "https://gateway/zabbix"}, true},
+		{"", map[string]string{"a": "aaa"}, true},
+	}
+
+	for i, p := range inputs {
+		var options agent.AgentOptions
+		options.ServerActive = p.serverActive
+		options.ServerActiveTLS = make(map[string]agent.ServerActiveTLSOptions)
+		for name, address := range p.tls {
+			options.ServerActiveTLS[name] = agent.ServerActiveTLSOptions{ServerActive: address}
+		}
+
+		_, err := ParseServerActive(&options)
+		if err != nil && !p.isError {
+			t.Errorf("[%d] test with value \"%s\" failed: %s", i, p.serverActive, err)
+		}
+		if err == nil && p.isError {
+			t.Errorf("[%d] test with value \"%s\" did not fail", i, p.serverActive)
+		}
+	}
+}
+
+type mockScheduler struct {
+	scheduler.Scheduler
+	requests []*plugin.Request
+	updates  int
+}
+
+func (s *mockScheduler) UpdateTasks(clientID uint64, writer plugin.ResultWriter, expressions []*glexpr.Expression,
+	requests []*plugin.Request, rejected chan<- struct{}) {
+	s.requests = requests
+	s.updates++
+}
+
+type mockResultCache struct {
+	resultcache.ResultCache
+	plugin.ResultWriter
+}
+
+func TestActiveChecksSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "activechecks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newConnector := func() (*Connector, *mockScheduler) {
+		s := &mockScheduler{}
+		return &Connector{
+			clientID:    100,
+			address:     "127.0.0.1:10051",
+			hostname:    "test",
+			options:     &agent.AgentOptions{ActiveChecksCacheDir: dir},
+			taskManager: s,
+			resultCache: &mockResultCache{},
+		}, s
+	}
+
+	valid := []byte(`{"response":"success","data":[{"key":"agent.ping","itemid":1,"delay":"30s","lastlogsize":0,"mtime":0}],` +
+		`"regexp":[{"name":"re","expression":"a","expression_type":0,"exp_delimiter":",","case_sensitive":1}]}`)
+
+	c, _ := newConnector()
+	c.saveActiveChecks(valid)
+	path := activeChecksPath(dir, c.address, c.hostname)
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(data, valid) {
+		t.Fatalf("saved active checks do not match: %s (%v)", data, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not renamed")
+	}
+
+	c, s := newConnector()
+	c.loadActiveChecks()
+	if s.updates != 1 || len(s.requests) != 1 || s.requests[0].Key != "agent.ping" {
+		t.Errorf("saved active checks were not loaded: %d updates, %d requests", s.updates, len(s.requests))
+	}
+	if !bytes.Equal(c.savedChecks, valid) {
+		t.Errorf("loaded active checks were not remembered")
+	}
+
+	invalid := [][]byte{
+		[]byte(`{"response":"success"}`),
+		[]byte(`{"response":"success","data":[{"key":"agent.ping","itemid":1,"lastlogsize":0,"mtime":0}]}`),
+		[]byte(`{"response":"success","data":[{"key":"agent.ping","itemid":1,"delay":"30s","lastlogsize":0}]}`),
+		[]byte(`{"response":"success","data":[],"regexp":[{"name":"re","expression":"a","expression_type":0,` +
+			`"exp_delimiter":",,","case_sensitive":1}]}`),
+	}
+	for i, data := range invalid {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, s := newConnector()
+		c.loadActiveChecks()
+		if s.updates != 0 {
+			t.Errorf("[%d] invalid saved active checks were loaded", i)
+		}
+		if c.savedChecks != nil {
+			t.Errorf("[%d] invalid saved active checks were remembered", i)
+		}
+	}
+}
+
+func TestActiveChecksRevision(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	s := &mockScheduler{}
+	node := &mockNode{address: "127.0.0.1:10051"}
+	c := &Connector{
+		clientID:    100,
+		address:     node.address,
+		hostname:    "test",
+		options:     &agent.AgentOptions{Timeout: 3},
+		taskManager: s,
+		resultCache: &mockResultCache{},
+		uploader:    node,
+		rejected:    make(chan struct{}, 1),
+	}
+
+	full := `{"response":"success","config_revision":5,"data":[{"key":"agent.ping","itemid":1,"delay":"30s",` +
+		`"lastlogsize":0,"mtime":0}]}`
+	requestRevision := func() uint64 {
+		var r activeChecksRequest
+		if err := json.Unmarshal(node.request, &r); err != nil {
+			t.Fatalf("cannot parse active checks request: %s", err)
+		}
+		return r.ConfigRevision
+	}
+
+	node.response = full
+	if items, err := c.refreshActiveChecks(); err != nil || items != 1 {
+		t.Fatalf("full configuration was not applied: %d items (%v)", items, err)
+	}
+	if rev := requestRevision(); rev != 0 {
+		t.Errorf("expected no revision in the first request while got %d", rev)
+	}
+
+	node.response = `{"response":"success","config_revision":5}`
+	if items, err := c.refreshActiveChecks(); err != nil || items != 1 {
+		t.Errorf("unchanged configuration was not accepted: %d items (%v)", items, err)
+	}
+	if rev := requestRevision(); rev != 5 {
+		t.Errorf("expected revision 5 in the request while got %d", rev)
+	}
+	if s.updates != 1 {
+		t.Errorf("expected tasks not to be updated for unchanged configuration")
+	}
+
+	node.response = `{"response":"success","config_revision":6}`
+	if _, err := c.refreshActiveChecks(); err == nil {
+		t.Errorf("expected error for configuration without data and mismatching revision")
+	}
+	if s.updates != 1 {
+		t.Errorf("expected tasks not to be updated for configuration without data")
+	}
+
+	c.rejected <- struct{}{}
+	node.response = full
+	if _, err := c.refreshActiveChecks(); err != nil {
+		t.Errorf("full configuration was not applied: %s", err)
+	}
+	if rev := requestRevision(); rev != 0 {
+		t.Errorf("expected no revision in the request after items were rejected while got %d", rev)
+	}
+	if s.updates != 2 {
+		t.Errorf("expected tasks to be updated after items were rejected")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	node := &mockNode{address: "127.0.0.1:10051", err: errors.New("connection refused")}
+	c := &Connector{
+		clientID: 100,
+		address:  node.address,
+		hostname: "test",
+		options:  &agent.AgentOptions{Timeout: 3, HeartbeatFrequency: 60},
+		uploader: node,
+	}
+
+	c.sendHeartbeat()
+	if node.calls != 1 {
+		t.Fatalf("expected heartbeat message to be sent")
+	}
+	if err := c.LastError(); err == nil || err.Error() != "connection refused" {
+		t.Errorf("expected failed heartbeat in last error while got %v", err)
+	}
+
+	node.err = nil
+	node.response = `{"response":"success"}`
+	c.sendHeartbeat()
+	if err := c.LastError(); err != nil {
+		t.Errorf("expected no last error after successful heartbeat while got %s", err)
+	}
+
+	var inputs = []struct {
+		address   string
+		heartbeat bool
+	}{
+		{"127.0.0.1:10051", true},
+		{"127.0.0.1:10051;127.0.0.2:10051", true},
+		{"https://gateway.example.com/zabbix", false},
+		{"127.0.0.1:10051;https://gateway.example.com/zabbix", false},
+	}
+	for _, p := range inputs {
+		options := &agent.AgentOptions{Timeout: 3, HeartbeatFrequency: 60}
+		c, err := New(nil, p.address, "test", options)
+		if err != nil {
+			t.Fatalf("cannot create connector for [%s]: %s", p.address, err)
+		}
+		if c.heartbeat != p.heartbeat {
+			t.Errorf("expected heartbeat %t for [%s] while got %t", p.heartbeat, p.address, c.heartbeat)
+		}
+	}
+}
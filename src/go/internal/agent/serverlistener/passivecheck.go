@@ -20,6 +20,7 @@
 package serverlistener
 
 import (
+	"sync/atomic"
 	"time"
 
 	"zabbix.com/internal/agent"
@@ -29,6 +30,25 @@ import (
 
 const notsupported = "ZBX_NOTSUPPORTED"
 
+// passive check statistics, accessed atomically
+var passiveChecksTotal, passiveChecksFailed, rejectedConnections uint64
+
+// PassiveCheckStats contains passive check statistics of all listeners
+type PassiveCheckStats struct {
+	Checks              uint64
+	FailedChecks        uint64
+	RejectedConnections uint64
+}
+
+// Stats returns passive check statistics since agent start
+func Stats() PassiveCheckStats {
+	return PassiveCheckStats{
+		Checks:              atomic.LoadUint64(&passiveChecksTotal),
+		FailedChecks:        atomic.LoadUint64(&passiveChecksFailed),
+		RejectedConnections: atomic.LoadUint64(&rejectedConnections),
+	}
+}
+
 type passiveCheck struct {
 	conn      *passiveConnection
 	scheduler scheduler.Scheduler
@@ -47,7 +67,9 @@ func (pc *passiveCheck) handleCheck(data []byte) {
 	// direct passive check timeout is handled by the scheduler
 	s, err := pc.scheduler.PerformTask(string(data), timeoutForSinglePassiveChecks, agent.PassiveChecksClientID)
 
+	atomic.AddUint64(&passiveChecksTotal, 1)
 	if err != nil {
+		atomic.AddUint64(&passiveChecksFailed, 1)
 		log.Debugf("sending passive check response: %s: '%s' to '%s'", notsupported, err.Error(), pc.conn.Address())
 		_, err = pc.conn.Write(pc.formatError(err.Error()))
 	} else {
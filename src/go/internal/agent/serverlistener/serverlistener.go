@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"zabbix.com/internal/agent"
@@ -69,12 +70,13 @@ func (sl *ServerListener) run() {
 	log.Debugf("[%d] starting listener for '%s:%d'", sl.listenerID, sl.bindIP, sl.options.ListenPort)
 
 	for {
-		conn, err := sl.listener.Accept(time.Second*time.Duration(sl.options.Timeout),
+		conn, err := sl.listener.Accept(time.Second*time.Duration(agent.CurrentOptions().Timeout),
 			zbxcomms.TimeoutModeShift)
 
 		if err == nil {
 			if !sl.allowedPeers.CheckPeer(net.ParseIP(conn.RemoteIP())) {
 				conn.Close()
+				atomic.AddUint64(&rejectedConnections, 1)
 				log.Warningf("cannot accept incoming connection for peer: %s", conn.RemoteIP())
 			} else if err := sl.processConnection(conn); err != nil {
 				log.Warningf("cannot process incoming connection: %s", err.Error())
@@ -113,6 +115,20 @@ func (sl *ServerListener) Start() (err error) {
 	return
 }
 
+// ReloadTLS rebuilds TLS configuration after TLS files have been changed, reading the PSK file
+// again. The new configuration is used for the connections accepted afterwards.
+func (sl *ServerListener) ReloadTLS() (err error) {
+	var tlsConfig *tls.Config
+	if tlsConfig, err = agent.GetTLSConfig(sl.options); err != nil {
+		return
+	}
+	sl.tlsConfig = tlsConfig
+	if sl.listener != nil {
+		sl.listener.SetTLSConfig(tlsConfig)
+	}
+	return
+}
+
 func (sl *ServerListener) Stop() {
 	if sl.listener != nil {
 		sl.listener.Close()
@@ -0,0 +1,184 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package statuslistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"zabbix.com/internal/agent/resultcache"
+	"zabbix.com/internal/agent/scheduler"
+	"zabbix.com/internal/agent/serverconnector"
+	"zabbix.com/internal/agent/serverlistener"
+)
+
+const metricPrefix = "zabbix_agent2_"
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricWriter writes metrics in Prometheus text exposition format
+type metricWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricWriter) header(name, metricType, help string) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help,
+			metricPrefix, name, metricType)
+	}
+}
+
+// value writes metric value, labels are passed as name, value pairs
+func (mw *metricWriter) value(name string, value interface{}, labels ...string) {
+	if mw.err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(metricPrefix)
+	b.WriteString(name)
+	if len(labels) != 0 {
+		b.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(fmt.Sprintf(`%s="%s"`, labels[i], labelReplacer.Replace(labels[i+1])))
+		}
+		b.WriteString("}")
+	}
+	_, mw.err = fmt.Fprintf(mw.w, "%s %v\n", b.String(), value)
+}
+
+func writePluginMetrics(mw *metricWriter, taskManager scheduler.Scheduler) (err error) {
+	var plugins []scheduler.PluginStatus
+	response, err := taskManager.QueryStatus("metrics.json")
+	if err != nil {
+		return fmt.Errorf("cannot obtain plugin status: %s", err)
+	}
+	if err = json.Unmarshal([]byte(response), &plugins); err != nil {
+		return fmt.Errorf("cannot parse plugin status: %s", err)
+	}
+
+	mw.header("plugin_capacity_used", "gauge", "Number of tasks currently executed by plugin.")
+	for _, p := range plugins {
+		mw.value("plugin_capacity_used", p.UsedCapacity, "plugin", p.Name)
+	}
+	mw.header("plugin_capacity_max", "gauge", "Maximum number of tasks plugin can execute concurrently.")
+	for _, p := range plugins {
+		mw.value("plugin_capacity_max", p.MaxCapacity, "plugin", p.Name)
+	}
+	mw.header("plugin_tasks_queued", "gauge", "Number of tasks queued for plugin.")
+	for _, p := range plugins {
+		mw.value("plugin_tasks_queued", p.Tasks, "plugin", p.Name)
+	}
+	return mw.err
+}
+
+func writeConnectorMetrics(mw *metricWriter, connectors []*serverconnector.Connector) {
+	type connectorStats struct {
+		address  string
+		hostname string
+		cache    resultcache.Stats
+	}
+	stats := make([]connectorStats, len(connectors))
+	for i, c := range connectors {
+		stats[i] = connectorStats{address: c.Address(), hostname: c.Hostname(), cache: c.CacheStats()}
+	}
+
+	mw.header("result_cache_values", "gauge", "Number of values in result cache.")
+	for _, s := range stats {
+		mw.value("result_cache_values", s.cache.Values, "address", s.address, "hostname", s.hostname)
+	}
+	mw.header("result_cache_persistent_values", "gauge", "Number of persistent (log) values in result cache.")
+	for _, s := range stats {
+		mw.value("result_cache_persistent_values", s.cache.PersistentValues, "address", s.address,
+			"hostname", s.hostname)
+	}
+	mw.header("result_cache_capacity", "gauge", "Maximum number of values in memory result cache (BufferSize).")
+	for _, s := range stats {
+		if !s.cache.Persistent {
+			mw.value("result_cache_capacity", s.cache.Capacity, "address", s.address, "hostname", s.hostname)
+		}
+	}
+	mw.header("result_cache_upload_failures_total", "counter", "Number of failed history data uploads.")
+	for _, s := range stats {
+		mw.value("result_cache_upload_failures_total", s.cache.UploadFailures, "address", s.address,
+			"hostname", s.hostname)
+	}
+	mw.header("persistent_buffer_rows", "gauge", "Number of rows in persistent buffer tables.")
+	for _, s := range stats {
+		if s.cache.Persistent {
+			mw.value("persistent_buffer_rows", s.cache.Values-s.cache.PersistentValues, "address", s.address,
+				"hostname", s.hostname, "table", "data")
+			mw.value("persistent_buffer_rows", s.cache.PersistentValues, "address", s.address,
+				"hostname", s.hostname, "table", "log")
+		}
+	}
+	mw.header("persistent_buffer_size_bytes", "gauge", "Size of persistent buffer used by destination.")
+	for _, s := range stats {
+		if s.cache.Persistent {
+			mw.value("persistent_buffer_size_bytes", s.cache.DiskSize, "address", s.address, "hostname", s.hostname)
+		}
+	}
+}
+
+func writePassiveCheckMetrics(mw *metricWriter) {
+	stats := serverlistener.Stats()
+	mw.header("passive_checks_total", "counter", "Number of processed passive checks.")
+	mw.value("passive_checks_total", stats.Checks)
+	mw.header("passive_checks_failed_total", "counter", "Number of passive checks returned as not supported.")
+	mw.value("passive_checks_failed_total", stats.FailedChecks)
+	mw.header("passive_connections_rejected_total", "counter", "Number of rejected passive check connections.")
+	mw.value("passive_connections_rejected_total", stats.RejectedConnections)
+}
+
+func writeRuntimeMetrics(mw *metricWriter) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	mw.header("go_goroutines", "gauge", "Number of goroutines.")
+	mw.value("go_goroutines", runtime.NumGoroutine())
+	mw.header("go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.")
+	mw.value("go_memstats_heap_alloc_bytes", ms.HeapAlloc)
+	mw.header("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+	mw.value("go_memstats_heap_objects", ms.HeapObjects)
+	mw.header("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	mw.value("go_memstats_sys_bytes", ms.Sys)
+	mw.header("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	mw.value("go_gc_cycles_total", ms.NumGC)
+	mw.header("go_gc_pause_seconds_total", "counter", "Total GC pause duration in seconds.")
+	mw.value("go_gc_pause_seconds_total", float64(ms.PauseTotalNs)/1e9)
+}
+
+// writeMetrics writes agent self-monitoring metrics in Prometheus text exposition format
+func writeMetrics(w io.Writer, taskManager scheduler.Scheduler,
+	connectors func() []*serverconnector.Connector) (err error) {
+	mw := &metricWriter{w: w}
+	if err = writePluginMetrics(mw, taskManager); err != nil {
+		return
+	}
+	writeConnectorMetrics(mw, connectors())
+	writePassiveCheckMetrics(mw)
+	writeRuntimeMetrics(mw)
+	return mw.err
+}
@@ -20,7 +20,9 @@
 package statuslistener
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -28,6 +30,7 @@ import (
 
 	"zabbix.com/internal/agent"
 	"zabbix.com/internal/agent/scheduler"
+	"zabbix.com/internal/agent/serverconnector"
 	"zabbix.com/internal/monitor"
 	"zabbix.com/pkg/log"
 	"zabbix.com/pkg/version"
@@ -36,15 +39,69 @@ import (
 var srv http.Server
 
 func getConf(confFilePath string) (s string) {
+	options := agent.CurrentOptions()
 	s = fmt.Sprintf("Zabbix Agent 2 [%s]. (%s)\n"+
 		"using configuration file: %s\nServerActive: %s\nListenPort: %d\n\n",
-		agent.Options.Hostname, version.Long(),
-		confFilePath, agent.Options.ServerActive, agent.Options.ListenPort)
+		options.Hostname, version.Long(),
+		confFilePath, options.ServerActive, options.ListenPort)
 
 	return
 }
 
-func Start(taskManager scheduler.Scheduler, confFilePath string) (err error) {
+type agentStatus struct {
+	Hostname     string `json:"hostname"`
+	Version      string `json:"version"`
+	ConfigFile   string `json:"config_file"`
+	ServerActive string `json:"server_active"`
+	ListenPort   int    `json:"listen_port"`
+}
+
+type connectorStatus struct {
+	Address   string  `json:"address"`
+	Hostname  string  `json:"hostname"`
+	LastError *string `json:"last_error"`
+}
+
+type status struct {
+	Agent      agentStatus       `json:"agent"`
+	Plugins    json.RawMessage   `json:"plugins"`
+	Connectors []connectorStatus `json:"connectors"`
+}
+
+func getStatusJSON(taskManager scheduler.Scheduler, confFilePath string,
+	connectors func() []*serverconnector.Connector) (data []byte, err error) {
+	plugins, err := taskManager.QueryStatus("metrics.json")
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain plugin status: %s", err)
+	}
+
+	options := agent.CurrentOptions()
+	s := status{
+		Agent: agentStatus{
+			Hostname:     options.Hostname,
+			Version:      version.Long(),
+			ConfigFile:   confFilePath,
+			ServerActive: options.ServerActive,
+			ListenPort:   options.ListenPort,
+		},
+		Plugins:    json.RawMessage(plugins),
+		Connectors: make([]connectorStatus, 0),
+	}
+
+	for _, c := range connectors() {
+		cs := connectorStatus{Address: c.Address(), Hostname: c.Hostname()}
+		if err := c.LastError(); err != nil {
+			text := err.Error()
+			cs.LastError = &text
+		}
+		s.Connectors = append(s.Connectors, cs)
+	}
+
+	return json.Marshal(&s)
+}
+
+func Start(taskManager scheduler.Scheduler, confFilePath string,
+	connectors func() []*serverconnector.Connector) (err error) {
 	var l net.Listener
 
 	if l, err = net.Listen("tcp", fmt.Sprintf(":%d", agent.Options.StatusPort)); err != nil {
@@ -53,12 +110,46 @@ func Start(taskManager scheduler.Scheduler, confFilePath string) (err error) {
 
 	log.Debugf("starting status listener")
 
+	writeJSON := func(w http.ResponseWriter) {
+		data, err := getStatusJSON(taskManager, confFilePath, connectors)
+		if err != nil {
+			log.Errf("cannot create status response: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("received status request from %s", r.RemoteAddr)
+		if r.URL.Query().Get("format") == "json" {
+			writeJSON(w)
+			return
+		}
 		_, _ = w.Write([]byte(getConf(confFilePath)))
 		_, _ = w.Write([]byte(taskManager.Query("metrics")))
 	}))
+	mux.Handle("/status/tasks", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("received task statistics request from %s", r.RemoteAddr)
+		_, _ = w.Write([]byte(taskManager.Query("tasks")))
+	}))
+	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("received metrics request from %s", r.RemoteAddr)
+		var buf bytes.Buffer
+		if err := writeMetrics(&buf, taskManager, connectors); err != nil {
+			log.Errf("cannot create metrics response: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write(buf.Bytes())
+	}))
+	mux.Handle("/status.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("received JSON status request from %s", r.RemoteAddr)
+		writeJSON(w)
+	}))
 
 	srv = http.Server{Addr: fmt.Sprintf(":%d", agent.Options.StatusPort), Handler: mux}
 	go func() {
@@ -73,7 +164,7 @@ func Start(taskManager scheduler.Scheduler, confFilePath string) (err error) {
 
 func Stop() {
 	// shut down gracefully, but wait no longer than time defined in configuration parameter Timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(agent.Options.Timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(agent.CurrentOptions().Timeout))
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
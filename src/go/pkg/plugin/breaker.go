@@ -0,0 +1,144 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"zabbix.com/pkg/zbxerr"
+)
+
+// breakerState contains failure tracking state of a single endpoint
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// Breaker implements circuit breaker for plugins accessing remote backends. After the
+// configured number of consecutive connection failures the requests to the same endpoint
+// are rejected for back-off period, so unavailable backend does not exhaust plugin capacity.
+// When the back-off period expires a single request is allowed to try the endpoint again,
+// while the other requests are rejected for another back-off period unless the trying request
+// succeeds.
+type Breaker struct {
+	mutex     sync.Mutex
+	threshold int
+	backoff   time.Duration
+	endpoints map[string]*breakerState
+}
+
+// NewBreaker creates new circuit breaker. Zero threshold disables the breaker.
+func NewBreaker(threshold int, backoff time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		backoff:   backoff,
+		endpoints: make(map[string]*breakerState),
+	}
+}
+
+// Allow returns error if the endpoint is in back-off state.
+func (b *Breaker) Allow(endpoint string) error {
+	if b == nil || b.threshold == 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s, ok := b.endpoints[endpoint]; ok && s.failures >= b.threshold {
+		if left := time.Until(s.openUntil); left > 0 {
+			return zbxerr.ErrorBackendUnavailable.Wrap(fmt.Errorf(
+				"%d consecutive connection errors, next attempt in %d seconds",
+				s.failures, int((left+time.Second-1)/time.Second)))
+		}
+		// let this request probe the endpoint and reject the others until it succeeds
+		s.openUntil = time.Now().Add(b.backoff)
+	}
+
+	return nil
+}
+
+// Success resets endpoint failure counter.
+func (b *Breaker) Success(endpoint string) {
+	if b == nil || b.threshold == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	delete(b.endpoints, endpoint)
+	b.mutex.Unlock()
+}
+
+// Failure registers endpoint connection failure. The endpoint is put into back-off state
+// when the number of consecutive failures reaches the threshold.
+func (b *Breaker) Failure(endpoint string) {
+	if b == nil || b.threshold == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, ok := b.endpoints[endpoint]
+	if !ok {
+		s = &breakerState{}
+		b.endpoints[endpoint] = s
+	}
+
+	s.failures++
+	if s.failures >= b.threshold {
+		s.openUntil = time.Now().Add(b.backoff)
+	}
+}
+
+// Done registers the result of request allowed by Allow. Connection errors and timeouts are
+// registered as failures. Any other result means the endpoint is reachable, so the failure counter
+// is reset, which also finishes the probe after back-off period.
+func (b *Breaker) Done(endpoint string, err error) {
+	if err != nil && IsConnectionError(err) {
+		b.Failure(endpoint)
+	} else {
+		b.Success(endpoint)
+	}
+}
+
+// IsConnectionError returns true if the error is caused by failed connection, network error or
+// timeout. Both the wrapped errors and the causes of Zabbix errors are checked.
+func IsConnectionError(err error) bool {
+	for err != nil {
+		if errors.Is(err, zbxerr.ErrorConnectionFailed) || errors.Is(err, context.DeadlineExceeded) {
+			return true
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"zabbix.com/pkg/zbxerr"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		b.Failure("a")
+		if err := b.Allow("a"); err != nil {
+			t.Fatalf("expected endpoint to be available after %d failures, got error: %s", i+1, err)
+		}
+	}
+
+	b.Failure("a")
+	if err := b.Allow("a"); err == nil {
+		t.Fatalf("expected endpoint to be unavailable after 3 failures")
+	}
+	if err := b.Allow("b"); err != nil {
+		t.Fatalf("expected other endpoint to be available, got error: %s", err)
+	}
+
+	b.Success("a")
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after success, got error: %s", err)
+	}
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	b := NewBreaker(1, 10*time.Millisecond)
+
+	b.Failure("a")
+	if err := b.Allow("a"); err == nil {
+		t.Fatalf("expected endpoint to be unavailable")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after back-off, got error: %s", err)
+	}
+
+	// a single failure after back-off period must put endpoint back into back-off state
+	b.Failure("a")
+	if err := b.Allow("a"); err == nil {
+		t.Fatalf("expected endpoint to be unavailable")
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := NewBreaker(1, 10*time.Millisecond)
+
+	b.Failure("a")
+	time.Sleep(20 * time.Millisecond)
+
+	// only a single request must be allowed to probe the endpoint after back-off period
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after back-off, got error: %s", err)
+	}
+	if err := b.Allow("a"); err == nil {
+		t.Fatalf("expected endpoint to be unavailable while being probed")
+	}
+
+	b.Success("a")
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after successful probe, got error: %s", err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := NewBreaker(0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		b.Failure("a")
+	}
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected disabled breaker to allow requests, got error: %s", err)
+	}
+}
+
+func TestBreakerDone(t *testing.T) {
+	b := NewBreaker(1, 10*time.Millisecond)
+
+	b.Done("a", zbxerr.ErrorConnectionFailed.Wrap(errors.New("dial error")))
+	if err := b.Allow("a"); err == nil {
+		t.Fatalf("expected endpoint to be unavailable after connection error")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after back-off, got error: %s", err)
+	}
+
+	// a probe failing with query error means the endpoint is reachable again
+	b.Done("a", zbxerr.ErrorCannotFetchData.Wrap(errors.New("syntax error")))
+	if err := b.Allow("a"); err != nil {
+		t.Fatalf("expected endpoint to be available after probe query error, got error: %s", err)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection failed", zbxerr.ErrorConnectionFailed.Wrap(errors.New("refused")), true},
+		{"connection failed cause", zbxerr.ErrorCannotFetchData.Wrap(zbxerr.ErrorConnectionFailed), true},
+		{"timeout", fmt.Errorf("query: %w", context.DeadlineExceeded), true},
+		{"timeout cause", zbxerr.ErrorCannotFetchData.Wrap(context.DeadlineExceeded), true},
+		{"network error", zbxerr.ErrorCannotFetchData.Wrap(&net.OpError{Op: "read", Err: errors.New("reset")}), true},
+		{"query error", zbxerr.ErrorCannotFetchData.Wrap(errors.New("syntax error")), false},
+		{"plain error", errors.New("error"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConnectionError(tt.err); got != tt.want {
+				t.Errorf("IsConnectionError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sync"
 	"unicode"
 )
 
@@ -35,6 +36,9 @@ type Metric struct {
 var Metrics map[string]*Metric = make(map[string]*Metric)
 var Plugins map[string]Accessor = make(map[string]Accessor)
 
+// protects Metrics, which can be changed at runtime by user parameter reload
+var metricsMutex sync.RWMutex
+
 func registerMetric(plugin Accessor, name string, key string, description string) {
 	if ok, _ := regexp.MatchString(`^[A-Za-z0-9\._-]+$`, key); !ok {
 		panic(fmt.Sprintf(`cannot register metric "%s" having invalid format`, key))
@@ -107,19 +111,64 @@ func RegisterMetrics(impl Accessor, name string, params ...string) {
 	if len(params)&1 != 0 {
 		panic("expected even number of metric and description parameters")
 	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	for i := 0; i < len(params); i += 2 {
+		registerMetric(impl, name, params[i], params[i+1])
+	}
+}
+
+// ReplaceMetrics replaces all metrics provided by the plugin with the specified metrics. It's used
+// for metrics that can be reconfigured at runtime (user parameters). The metric set is swapped under
+// single registry lock, so the kept metrics stay available during replacement.
+func ReplaceMetrics(impl Accessor, name string, params ...string) {
+	if len(params)&1 != 0 {
+		panic("expected even number of metric and description parameters")
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	for key, metric := range Metrics {
+		if metric.Plugin == impl {
+			delete(Metrics, key)
+		}
+	}
 	for i := 0; i < len(params); i += 2 {
 		registerMetric(impl, name, params[i], params[i+1])
 	}
 }
 
 func Get(key string) (acc Accessor, err error) {
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
 	if m, ok := Metrics[key]; ok {
 		return m.Plugin, nil
 	}
 	return nil, UnsupportedMetricError
 }
 
+// GetPlugin returns the plugin registered with the specified name
+func GetPlugin(name string) (acc Accessor, ok bool) {
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
+	acc, ok = Plugins[name]
+	return
+}
+
+// GetMetrics returns a copy of the registered metrics, which is safe to use while the metrics are
+// being changed at runtime
+func GetMetrics() (metrics map[string]*Metric) {
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
+	metrics = make(map[string]*Metric, len(Metrics))
+	for key, metric := range Metrics {
+		metrics[key] = metric
+	}
+	return
+}
+
 func ClearRegistry() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
 	Metrics = make(map[string]*Metric)
 	Plugins = make(map[string]Accessor)
 }
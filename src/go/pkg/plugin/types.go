@@ -20,6 +20,7 @@
 package plugin
 
 import (
+	"context"
 	"errors"
 	"sync/atomic"
 	"time"
@@ -43,6 +44,24 @@ type Exporter interface {
 	Export(key string, params []string, context ContextProvider) (interface{}, error)
 }
 
+// ExporterWithContext - optional interface for exporters supporting export cancellation.
+// When implemented by Exporter plugin the scheduler calls ExportWithContext instead of Export.
+type ExporterWithContext interface {
+	// ExportWithContext method exports data based on the key 'key' and its parameters 'params'.
+	// The context 'ctx' carries item timeout deadline and is cancelled when the result is no longer
+	// expected, so plugins should use it to abort long running operations.
+	ExportWithContext(ctx context.Context, key string, params []string, provider ContextProvider) (interface{}, error)
+}
+
+// ExportSharing - optional interface for enabling sharing of export results between items.
+// If sharing is enabled for a key the scheduler performs export once when several clients request the same
+// key at the same time and passes the result to all of them. Shared exports are performed without item
+// context, so sharing must be enabled only for keys whose results do not depend on item or client.
+type ExportSharing interface {
+	// ShareExport method returns true if the result of key 'key' export can be shared between items.
+	ShareExport(key string) bool
+}
+
 // Runner - interface for managing background processes
 type Runner interface {
 	// Start method activates plugin.
@@ -1,3 +1,5 @@
+// +build !tlsgo
+
 /*
 ** Zabbix
 ** Copyright (C) 2001-2021 Zabbix SIA
@@ -926,6 +928,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -1143,7 +1146,6 @@ func NewClient(nc net.Conn, cfg *Config, timeout time.Duration, shiftDeadline bo
 	}
 
 	var cUser, cSecret *C.char
-	context := defaultContext
 	if cfg.Connect == ConnPSK {
 		cUser = C.CString(cfg.PSKIdentity)
 		cSecret = C.CString(cfg.PSKKey)
@@ -1152,15 +1154,26 @@ func NewClient(nc net.Conn, cfg *Config, timeout time.Duration, shiftDeadline bo
 			C.free(unsafe.Pointer(cUser))
 			C.free(unsafe.Pointer(cSecret))
 		}()
+	}
+
+	// the connection keeps reference to the context, so the context can be replaced afterwards
+	contextMutex.RLock()
+	context := defaultContext
+	if cfg.Connect == ConnPSK {
 		context = pskContext
+	} else if cfg.context != nil {
+		context = cfg.context.ctx
 	}
+	cTls := C.tls_new_client(C.SSL_CTX_LP(context), cUser, cSecret)
+	contextMutex.RUnlock()
+	runtime.KeepAlive(cfg.context)
 
 	// for TLS we overwrite the timeoutMode and force it to move on every read or write
 	c := &Client{
 		tlsConn: tlsConn{
 			conn:          nc,
 			buf:           make([]byte, 4096),
-			tls:           unsafe.Pointer(C.tls_new_client(C.SSL_CTX_LP(context), cUser, cSecret)),
+			tls:           unsafe.Pointer(cTls),
 			timeout:       timeout,
 			shiftDeadline: shiftDeadline,
 		},
@@ -1258,17 +1271,20 @@ func NewServer(nc net.Conn, cfg *Config, b []byte, timeout time.Duration, shiftD
 		}()
 	}
 
+	contextMutex.RLock()
 	context := pskContext
 	if cfg.Accept&ConnCert != 0 {
 		context = defaultContext
 	}
+	cTls := C.tls_new_server(C.SSL_CTX_LP(context), cUser, cSecret)
+	contextMutex.RUnlock()
 
 	// for TLS we overwrite the timeoutMode and force it to move on every read or write
 	s := &Server{
 		tlsConn: tlsConn{
 			conn:          nc,
 			buf:           make([]byte, 4096),
-			tls:           unsafe.Pointer(C.tls_new_server(C.SSL_CTX_LP(context), cUser, cSecret)),
+			tls:           unsafe.Pointer(cTls),
 			timeout:       timeout,
 			shiftDeadline: shiftDeadline,
 		},
@@ -1297,6 +1313,14 @@ func NewServer(nc net.Conn, cfg *Config, b []byte, timeout time.Duration, shiftD
 
 var pskContext, defaultContext unsafe.Pointer
 
+// certContext is certificate context created for the specific configuration by InitConfig
+type certContext struct {
+	ctx unsafe.Pointer
+}
+
+// protects contexts, which are replaced when TLS files are reloaded
+var contextMutex sync.RWMutex
+
 const (
 	ConnUnencrypted = 1 << iota
 	ConnPSK
@@ -1314,6 +1338,8 @@ type Config struct {
 	KeyFile           string
 	ServerCertIssuer  string
 	ServerCertSubject string
+	// the context used instead of the default one, see InitConfig
+	context *certContext
 }
 
 func CopyrightMessage() (message string) {
@@ -1327,18 +1353,9 @@ func CopyrightMessage() (message string) {
 		"Compiled with %s\nRunning with %s\n", C.GoString(C.tls_version_static()), C.GoString(version))
 }
 
-func Init(config *Config) (err error) {
-	if !supported {
-		return errors.New(SupportedErrMsg())
-	}
-	if pskContext != nil {
-		C.tls_free_context(C.SSL_CTX_LP(pskContext))
-	}
-	if defaultContext != nil {
-		C.tls_free_context(C.SSL_CTX_LP(defaultContext))
-	}
-
-	var cErr, cCaFile, cCrlFile, cCertFile, cKeyFile, cNULL *C.char
+// newContext creates context with certificate files of the configuration, if certificates are used
+func newContext(config *Config) (context unsafe.Pointer, err error) {
+	var cErr, cCaFile, cCrlFile, cCertFile, cKeyFile *C.char
 	if (config.Accept|config.Connect)&ConnCert != 0 {
 		cCaFile = C.CString(config.CAFile)
 		cCertFile = C.CString(config.CertFile)
@@ -1353,21 +1370,69 @@ func Init(config *Config) (err error) {
 		}
 	}
 
-	if defaultContext = unsafe.Pointer(C.tls_new_context(cCaFile, cCrlFile, cCertFile, cKeyFile, &cErr)); defaultContext == nil {
-		err = fmt.Errorf("cannot initialize default TLS context: %s", C.GoString(cErr))
+	if context = unsafe.Pointer(C.tls_new_context(cCaFile, cCrlFile, cCertFile, cKeyFile, &cErr)); context == nil {
+		err = errors.New(C.GoString(cErr))
 		C.free(unsafe.Pointer(cErr))
-		return
+	}
+	return
+}
+
+func Init(config *Config) (err error) {
+	if !supported {
+		return errors.New(SupportedErrMsg())
+	}
+	var cErr, cNULL *C.char
+
+	// create new contexts before releasing the current ones, so the current contexts are kept if
+	// TLS files being reloaded are invalid
+	var newDefaultContext, newPskContext unsafe.Pointer
+	if newDefaultContext, err = newContext(config); err != nil {
+		return fmt.Errorf("cannot initialize default TLS context: %s", err)
 	}
 
-	if pskContext = unsafe.Pointer(C.tls_new_context(cNULL, cNULL, cNULL, cNULL, &cErr)); pskContext == nil {
+	if newPskContext = unsafe.Pointer(C.tls_new_context(cNULL, cNULL, cNULL, cNULL, &cErr)); newPskContext == nil {
 		err = fmt.Errorf("cannot initialize PSK TLS context: %s", C.GoString(cErr))
 		C.free(unsafe.Pointer(cErr))
+		C.tls_free_context(C.SSL_CTX_LP(newDefaultContext))
 		return
 	}
 
+	contextMutex.Lock()
+	if pskContext != nil {
+		C.tls_free_context(C.SSL_CTX_LP(pskContext))
+	}
+	if defaultContext != nil {
+		C.tls_free_context(C.SSL_CTX_LP(defaultContext))
+	}
+	defaultContext, pskContext = newDefaultContext, newPskContext
+	contextMutex.Unlock()
+
 	log.Infof("OpenSSL library (%s) initialized", C.GoString(C.tls_version()))
 	log.Debugf("default context ciphersuites:%s", describeCiphersuites(defaultContext))
 	log.Debugf("psk context ciphersuites:%s", describeCiphersuites(pskContext))
 
 	return
 }
+
+// InitConfig creates certificate context used only by the client connections with the specified
+// configuration instead of the default context created by Init. It allows connecting to different
+// destinations with their own certificates. Configurations without certificates use the contexts
+// created by Init.
+func InitConfig(config *Config) (err error) {
+	if !supported {
+		return errors.New(SupportedErrMsg())
+	}
+	if config.Connect != ConnCert {
+		return
+	}
+
+	var context unsafe.Pointer
+	if context, err = newContext(config); err != nil {
+		return fmt.Errorf("cannot initialize TLS context: %s", err)
+	}
+	config.context = &certContext{ctx: context}
+	// connections keep reference to the context, so it can be freed together with configuration
+	runtime.SetFinalizer(config.context, func(c *certContext) { C.tls_free_context(C.SSL_CTX_LP(c.ctx)) })
+
+	return
+}
@@ -0,0 +1,647 @@
+// +build tlsgo
+
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+// Package tls implementation based on the Go crypto/tls package. It is selected with the tlsgo build tag
+// and allows building agent without OpenSSL. Only certificate based encryption is supported.
+package tls
+
+import (
+	"bytes"
+	gotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"zabbix.com/pkg/log"
+)
+
+const errPSKNotSupported = "PSK is not supported by Go TLS implementation"
+
+// TLS initialization
+var supported bool      // is TLS compiled in and successfully initialized
+var supportedMsg string // reason why TLS is not supported
+
+func Supported() bool {
+	return supported
+}
+
+func SupportedErrMsg() string {
+	return supportedMsg
+}
+
+func init() {
+	supported = true
+}
+
+// ciphersuites allowed for certificate based connections, matching OpenSSL "EECDH+aRSA+AES128:RSA+aRSA+AES128"
+// cipher list used by the OpenSSL implementation. TLS 1.3 ciphersuites are not configurable.
+var cipherSuites = []uint16{
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	gotls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	gotls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	gotls.TLS_RSA_WITH_AES_128_CBC_SHA,
+}
+
+// OpenSSL names of the ciphersuites, used in connection descriptions
+var cipherSuiteNames = map[uint16]string{
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: "ECDHE-RSA-AES128-GCM-SHA256",
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256: "ECDHE-RSA-AES128-SHA256",
+	gotls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:    "ECDHE-RSA-AES128-SHA",
+	gotls.TLS_RSA_WITH_AES_128_GCM_SHA256:       "AES128-GCM-SHA256",
+	gotls.TLS_RSA_WITH_AES_128_CBC_SHA256:       "AES128-SHA256",
+	gotls.TLS_RSA_WITH_AES_128_CBC_SHA:          "AES128-SHA",
+	gotls.TLS_AES_128_GCM_SHA256:                "TLS_AES_128_GCM_SHA256",
+	gotls.TLS_AES_256_GCM_SHA384:                "TLS_AES_256_GCM_SHA384",
+	gotls.TLS_CHACHA20_POLY1305_SHA256:          "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+var versionNames = map[uint16]string{
+	gotls.VersionTLS12: "TLSv1.2",
+	gotls.VersionTLS13: "TLSv1.3",
+}
+
+func describeCiphersuites(config *gotls.Config) (desc string) {
+	for _, id := range config.CipherSuites {
+		desc += " " + cipherSuiteNames[id]
+	}
+	return
+}
+
+// short names of distinguished name attributes as printed by OpenSSL
+var attributeNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.4":                    "SN",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "street",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.12":                   "title",
+	"2.5.4.17":                   "postalCode",
+	"2.5.4.42":                   "GN",
+	"2.5.4.43":                   "initials",
+	"2.5.4.46":                   "dnQualifier",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+}
+
+type attributeTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// the SET suffix makes encoding/asn1 parse the type as SET OF
+type relativeDistinguishedNameSET []attributeTypeAndValue
+
+type rdnSequence []relativeDistinguishedNameSET
+
+func attributeValue(v *asn1.RawValue) (value string, ok bool) {
+	if v.Class != asn1.ClassUniversal {
+		return
+	}
+	switch v.Tag {
+	case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, asn1.TagT61String, 26: // VisibleString
+		return string(v.Bytes), true
+	case asn1.TagBMPString:
+		if len(v.Bytes)%2 != 0 {
+			return
+		}
+		s := make([]uint16, len(v.Bytes)/2)
+		for i := range s {
+			s[i] = uint16(v.Bytes[i*2])<<8 | uint16(v.Bytes[i*2+1])
+		}
+		return string(utf16.Decode(s)), true
+	case 28: // UniversalString
+		if len(v.Bytes)%4 != 0 {
+			return
+		}
+		r := make([]rune, len(v.Bytes)/4)
+		for i := range r {
+			r[i] = rune(v.Bytes[i*4])<<24 | rune(v.Bytes[i*4+1])<<16 | rune(v.Bytes[i*4+2])<<8 | rune(v.Bytes[i*4+3])
+		}
+		return string(r), true
+	}
+	return
+}
+
+// escapeValue escapes attribute value according to RFC 2253, control characters are written as hex pairs
+func escapeValue(s string) string {
+	var buf strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;", r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(s)-1 && r == ' ':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&buf, "\\%02X", r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// formatName returns distinguished name in the same format as OpenSSL X509_NAME_print_ex() with
+// XN_FLAG_RFC2253 & ~ASN1_STRFLGS_ESC_MSB flags, which is used for TLSServerCertIssuer and
+// TLSServerCertSubject comparison.
+func formatName(raw []byte) (name string, err error) {
+	var rdns rdnSequence
+	var rest []byte
+	if rest, err = asn1.Unmarshal(raw, &rdns); err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		return "", errors.New("trailing data after distinguished name")
+	}
+
+	var buf strings.Builder
+	for i := len(rdns) - 1; i >= 0; i-- {
+		if i != len(rdns)-1 {
+			buf.WriteByte(',')
+		}
+		for j, atv := range rdns[i] {
+			if j != 0 {
+				buf.WriteByte('+')
+			}
+			oid := atv.Type.String()
+			value, ok := attributeValue(&atv.Value)
+			if short, known := attributeNames[oid]; known {
+				buf.WriteString(short)
+			} else {
+				buf.WriteString(oid)
+			}
+			buf.WriteByte('=')
+			if ok {
+				buf.WriteString(escapeValue(value))
+			} else {
+				buf.WriteString("#" + strings.ToUpper(hex.EncodeToString(atv.Value.FullBytes)))
+			}
+		}
+	}
+	return buf.String(), nil
+}
+
+type certificateListIssuer struct {
+	Version   int `asn1:"optional,default:0"`
+	Signature pkix.AlgorithmIdentifier
+	Issuer    asn1.RawValue
+}
+
+type revocationList struct {
+	crl    *pkix.CertificateList
+	issuer []byte
+}
+
+// certificate verification settings shared by all certificate based connections
+type verifier struct {
+	roots *x509.CertPool
+	crls  []*revocationList
+}
+
+func (v *verifier) checkRevocation(cert, issuer *x509.Certificate) (err error) {
+	var found bool
+	for _, rl := range v.crls {
+		if !bytes.Equal(rl.issuer, cert.RawIssuer) || issuer.CheckCRLSignature(rl.crl) != nil {
+			continue
+		}
+		found = true
+		if rl.crl.HasExpired(time.Now()) {
+			return errors.New("CRL has expired")
+		}
+		for _, revoked := range rl.crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errors.New("certificate revoked")
+			}
+		}
+	}
+	if !found {
+		return errors.New("unable to get certificate CRL")
+	}
+	return
+}
+
+func (v *verifier) verify(rawCerts [][]byte, usage x509.ExtKeyUsage) (err error) {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not return a certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		if certs[i], err = x509.ParseCertificate(raw); err != nil {
+			return fmt.Errorf("cannot parse peer certificate: %s", err)
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	var chains [][]*x509.Certificate
+	if chains, err = certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("certificate verify failed: %s", err)
+	}
+
+	if len(v.crls) == 0 {
+		return
+	}
+
+	// check all certificates in the chain except the trust anchor, like X509_V_FLAG_CRL_CHECK_ALL does
+	chain := chains[0]
+	for i := 0; i < len(chain)-1; i++ {
+		if err = v.checkRevocation(chain[i], chain[i+1]); err != nil {
+			return fmt.Errorf("certificate verify failed: %s", err)
+		}
+	}
+	return
+}
+
+func loadCertPool(filename string) (pool *x509.CertPool, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in file \"%s\"", filename)
+	}
+	return
+}
+
+func loadCRLs(filename string) (crls []*revocationList, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		var crl *pkix.CertificateList
+		if crl, err = x509.ParseDERCRL(block.Bytes); err != nil {
+			return nil, fmt.Errorf("cannot parse CRL in file \"%s\": %s", filename, err)
+		}
+		var tbs certificateListIssuer
+		if _, err = asn1.Unmarshal(crl.TBSCertList.Raw, &tbs); err != nil {
+			return nil, fmt.Errorf("cannot parse CRL issuer in file \"%s\": %s", filename, err)
+		}
+		crls = append(crls, &revocationList{crl: crl, issuer: tbs.Issuer.FullBytes})
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("no CRLs found in file \"%s\"", filename)
+	}
+	return
+}
+
+// deadlineConn moves connection deadline on every read or write if requested and returns the
+// already received data before reading from the connection.
+type deadlineConn struct {
+	net.Conn
+	buf           []byte
+	timeout       time.Duration
+	shiftDeadline bool
+}
+
+func (c *deadlineConn) Read(b []byte) (n int, err error) {
+	if len(c.buf) != 0 {
+		n = copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return
+	}
+	if c.shiftDeadline {
+		if err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (n int, err error) {
+	if c.shiftDeadline {
+		if err = c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+type tlsConn struct {
+	*gotls.Conn
+}
+
+func (c *tlsConn) verifyIssuerSubject(cfg *Config) (err error) {
+	if cfg.Connect == ConnCert && (cfg.ServerCertIssuer != "" || cfg.ServerCertSubject != "") {
+		certs := c.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("cannot obtain peer certificate")
+		}
+		var name string
+		if cfg.ServerCertIssuer != "" {
+			if name, err = formatName(certs[0].RawIssuer); err != nil {
+				return fmt.Errorf("cannot print distinguished name: %s", err)
+			}
+			if name != cfg.ServerCertIssuer {
+				return fmt.Errorf("invalid certificate issuer %s", name)
+			}
+		}
+		if cfg.ServerCertSubject != "" {
+			if name, err = formatName(certs[0].RawSubject); err != nil {
+				return fmt.Errorf("cannot print distinguished name: %s", err)
+			}
+			if name != cfg.ServerCertSubject {
+				return fmt.Errorf("invalid certificate subject %s", name)
+			}
+		}
+	}
+	return
+}
+
+func (c *tlsConn) String() (desc string) {
+	state := c.ConnectionState()
+	desc = fmt.Sprintf("%s %s", versionNames[state.Version], cipherSuiteNames[state.CipherSuite])
+	if len(state.PeerCertificates) != 0 {
+		issuer, errIssuer := formatName(state.PeerCertificates[0].RawIssuer)
+		subject, errSubject := formatName(state.PeerCertificates[0].RawSubject)
+		if errIssuer == nil && errSubject == nil {
+			desc += fmt.Sprintf(", peer certificate issuer:\"%s\" subject:\"%s\"", issuer, subject)
+		}
+	}
+	return
+}
+
+// TLS connection client
+type Client struct {
+	tlsConn
+}
+
+func NewClient(nc net.Conn, cfg *Config, timeout time.Duration, shiftDeadline bool) (conn net.Conn, err error) {
+	if !supported {
+		return nil, errors.New(SupportedErrMsg())
+	}
+
+	if cfg.Connect == ConnUnencrypted {
+		return nc, nil
+	}
+
+	if cfg.Connect == ConnPSK {
+		return nil, errors.New(errPSKNotSupported)
+	}
+
+	var config *gotls.Config
+	var v *verifier
+	if cfg.context != nil {
+		config, v = cfg.context.config.Clone(), cfg.context.verifier
+	} else {
+		config, v = defaultContext()
+	}
+	if config == nil {
+		return nil, errors.New("TLS context is not initialized")
+	}
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return v.verify(rawCerts, x509.ExtKeyUsageServerAuth)
+	}
+
+	// for TLS we overwrite the timeoutMode and force it to move on every read or write
+	c := &Client{
+		tlsConn: tlsConn{
+			Conn: gotls.Client(&deadlineConn{Conn: nc, timeout: timeout, shiftDeadline: shiftDeadline}, config),
+		},
+	}
+
+	if err = c.Handshake(); err != nil {
+		nc.Close()
+		return
+	}
+	if err = c.verifyIssuerSubject(cfg); err != nil {
+		c.Close()
+		return
+	}
+
+	log.Debugf("connection established using %s", c)
+
+	return c, nil
+}
+
+// TLS connection server
+type Server struct {
+	tlsConn
+}
+
+func NewServer(nc net.Conn, cfg *Config, b []byte, timeout time.Duration, shiftDeadline bool) (conn net.Conn, err error) {
+	if !supported {
+		return nil, errors.New(SupportedErrMsg())
+	}
+
+	if cfg.Accept&ConnCert == 0 {
+		return nil, errors.New(errPSKNotSupported)
+	}
+
+	config, v := defaultContext()
+	if config == nil {
+		return nil, errors.New("TLS context is not initialized")
+	}
+	config.ClientAuth = gotls.RequireAnyClientCert
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return v.verify(rawCerts, x509.ExtKeyUsageClientAuth)
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+
+	// for TLS we overwrite the timeoutMode and force it to move on every read or write
+	s := &Server{
+		tlsConn: tlsConn{
+			Conn: gotls.Server(&deadlineConn{Conn: nc, buf: buf, timeout: timeout, shiftDeadline: shiftDeadline},
+				config),
+		},
+	}
+
+	if err = s.Handshake(); err != nil {
+		nc.Close()
+		return
+	}
+	if err = s.verifyIssuerSubject(cfg); err != nil {
+		s.Close()
+		return
+	}
+
+	log.Debugf("connection established using %s", s)
+
+	return s, nil
+}
+
+var defaultConfig *gotls.Config
+var defaultVerifier *verifier
+
+// certContext is certificate context created for the specific configuration by InitConfig
+type certContext struct {
+	config   *gotls.Config
+	verifier *verifier
+}
+
+// protects default configuration, which is replaced when TLS files are reloaded
+var contextMutex sync.RWMutex
+
+// defaultContext returns copy of the default configuration and its verifier
+func defaultContext() (config *gotls.Config, v *verifier) {
+	contextMutex.RLock()
+	defer contextMutex.RUnlock()
+	if defaultConfig == nil {
+		return
+	}
+	return defaultConfig.Clone(), defaultVerifier
+}
+
+const (
+	ConnUnencrypted = 1 << iota
+	ConnPSK
+	ConnCert
+)
+
+type Config struct {
+	Accept            int
+	Connect           int
+	PSKIdentity       string
+	PSKKey            string
+	CAFile            string
+	CRLFile           string
+	CertFile          string
+	KeyFile           string
+	ServerCertIssuer  string
+	ServerCertSubject string
+	// the context used instead of the default one, see InitConfig
+	context *certContext
+}
+
+func CopyrightMessage() (message string) {
+	return ""
+}
+
+// newContext loads certificate files of the configuration
+func newContext(config *Config) (c *gotls.Config, v *verifier, err error) {
+	v = &verifier{}
+	if v.roots, err = loadCertPool(config.CAFile); err != nil {
+		return
+	}
+	if config.CRLFile != "" {
+		if v.crls, err = loadCRLs(config.CRLFile); err != nil {
+			return
+		}
+	}
+
+	var cert gotls.Certificate
+	if cert, err = gotls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+		return
+	}
+
+	// peer certificates are verified by the verifier, hostname verification is not performed
+	c = &gotls.Config{
+		Certificates:             []gotls.Certificate{cert},
+		InsecureSkipVerify:       true,
+		MinVersion:               gotls.VersionTLS12,
+		CipherSuites:             cipherSuites,
+		PreferServerCipherSuites: true,
+		SessionTicketsDisabled:   true,
+	}
+	return
+}
+
+func Init(config *Config) (err error) {
+	if !supported {
+		return errors.New(SupportedErrMsg())
+	}
+
+	if (config.Accept|config.Connect)&ConnPSK != 0 {
+		return fmt.Errorf("cannot initialize PSK TLS context: %s", errPSKNotSupported)
+	}
+
+	if (config.Accept|config.Connect)&ConnCert == 0 {
+		contextMutex.Lock()
+		defaultConfig, defaultVerifier = nil, nil
+		contextMutex.Unlock()
+		return
+	}
+
+	var c *gotls.Config
+	var v *verifier
+	if c, v, err = newContext(config); err != nil {
+		return fmt.Errorf("cannot initialize default TLS context: %s", err)
+	}
+
+	contextMutex.Lock()
+	defaultConfig, defaultVerifier = c, v
+	contextMutex.Unlock()
+
+	log.Infof("Go TLS library (%s) initialized", runtime.Version())
+	log.Debugf("default context ciphersuites:%s", describeCiphersuites(c))
+
+	return
+}
+
+// InitConfig creates certificate context used only by the client connections with the specified
+// configuration instead of the default context created by Init. It allows connecting to different
+// destinations with their own certificates.
+func InitConfig(config *Config) (err error) {
+	if !supported {
+		return errors.New(SupportedErrMsg())
+	}
+	if config.Connect == ConnPSK {
+		return fmt.Errorf("cannot initialize TLS context: %s", errPSKNotSupported)
+	}
+	if config.Connect != ConnCert {
+		return
+	}
+
+	var c *gotls.Config
+	var v *verifier
+	if c, v, err = newContext(config); err != nil {
+		return fmt.Errorf("cannot initialize TLS context: %s", err)
+	}
+	config.context = &certContext{config: c, verifier: v}
+
+	return
+}
@@ -0,0 +1,254 @@
+// +build tlsgo
+
+/*
+** Zabbix
+** Copyright (C) 2001-2021 Zabbix SIA
+**
+** This program is free software; you can redistribute it and/or modify
+** it under the terms of the GNU General Public License as published by
+** the Free Software Foundation; either version 2 of the License, or
+** (at your option) any later version.
+**
+** This program is distributed in the hope that it will be useful,
+** but WITHOUT ANY WARRANTY; without even the implied warranty of
+** MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+** GNU General Public License for more details.
+**
+** You should have received a copy of the GNU General Public License
+** along with this program; if not, write to the Free Software
+** Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+**/
+
+package tls
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zabbix.com/pkg/log"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, subject pkix.Name, issuer *testCert) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %s", err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func writePEM(t *testing.T, filename string, blockType string, der []byte) string {
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("cannot write file: %s", err)
+	}
+	return filename
+}
+
+// connect performs TLS handshake between client and server with the specified configurations
+// and returns client and server errors
+func connect(t *testing.T, clientCfg *Config, serverCfg *Config) (clientErr error, serverErr error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer l.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer nc.Close()
+		b := make([]byte, 1)
+		if _, err = nc.Read(b); err != nil {
+			errs <- err
+			return
+		}
+		var conn net.Conn
+		if conn, err = NewServer(nc, serverCfg, b, time.Second*5, true); err == nil {
+			conn.Close()
+		}
+		errs <- err
+	}()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	var conn net.Conn
+	if conn, clientErr = NewClient(nc, clientCfg, time.Second*5, true); clientErr == nil {
+		conn.Close()
+	}
+	serverErr = <-errs
+	return
+}
+
+func TestCertificates(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	dir, err := ioutil.TempDir("", "tlsgo")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, pkix.Name{CommonName: "Root CA", Organization: []string{"Zabbix SIA"}}, nil)
+	agent := newTestCert(t, 2, pkix.Name{CommonName: "Zabbix agent"}, ca)
+
+	cfg := Config{
+		Accept:            ConnCert,
+		Connect:           ConnCert,
+		CAFile:            writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.cert.Raw),
+		CertFile:          writePEM(t, filepath.Join(dir, "agent.crt"), "CERTIFICATE", agent.cert.Raw),
+		KeyFile:           writePEM(t, filepath.Join(dir, "agent.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(agent.key)),
+		ServerCertIssuer:  "CN=Root CA,O=Zabbix SIA",
+		ServerCertSubject: "CN=Zabbix server",
+	}
+	serverCfg := cfg
+	serverCfg.Connect = ConnUnencrypted
+
+	// both sides share the same TLS context, so the test server also uses the agent certificate
+	if err = Init(&cfg); err != nil {
+		t.Fatalf("cannot initialize TLS: %s", err)
+	}
+	if clientErr, serverErr := connect(t, &cfg, &serverCfg); clientErr == nil {
+		t.Errorf("expected subject mismatch error")
+	} else if !strings.Contains(clientErr.Error(), "invalid certificate subject CN=Zabbix agent") {
+		t.Errorf("unexpected client error: %s (server error: %v)", clientErr, serverErr)
+	}
+
+	cfg.ServerCertSubject = "CN=Zabbix agent"
+	if clientErr, serverErr := connect(t, &cfg, &serverCfg); clientErr != nil || serverErr != nil {
+		t.Errorf("unexpected errors: client: %v, server: %v", clientErr, serverErr)
+	}
+
+	now := time.Now()
+	crl, err := ca.cert.CreateCRL(rand.Reader, ca.key,
+		[]pkix.RevokedCertificate{{SerialNumber: agent.cert.SerialNumber, RevocationTime: now}}, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("cannot create CRL: %s", err)
+	}
+	cfg.CRLFile = writePEM(t, filepath.Join(dir, "ca.crl"), "X509 CRL", crl)
+	if err = Init(&cfg); err != nil {
+		t.Fatalf("cannot initialize TLS: %s", err)
+	}
+	if clientErr, _ := connect(t, &cfg, &serverCfg); clientErr == nil {
+		t.Errorf("expected revoked certificate error")
+	} else if !strings.Contains(clientErr.Error(), "certificate revoked") {
+		t.Errorf("unexpected client error: %s", clientErr)
+	}
+
+	psk := Config{Connect: ConnPSK, PSKIdentity: "id", PSKKey: "0123456789abcdef"}
+	if err = Init(&psk); err == nil {
+		t.Errorf("expected PSK initialization error")
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	name := pkix.Name{
+		Country:            []string{"LV"},
+		Organization:       []string{"Zabbix SIA"},
+		OrganizationalUnit: []string{" Development+QA "},
+		CommonName:         "#agent;1",
+	}
+	raw, err := asn1.Marshal(name.ToRDNSequence())
+	if err != nil {
+		t.Fatalf("cannot marshal name: %s", err)
+	}
+	expected := `CN=\#agent\;1,OU=\ Development\+QA\ ,O=Zabbix SIA,C=LV`
+	if s, err := formatName(raw); err != nil {
+		t.Errorf("cannot format name: %s", err)
+	} else if s != expected {
+		t.Errorf("expected %s while got %s", expected, s)
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	_ = log.Open(log.Console, log.None, "", 0)
+
+	dir, err := ioutil.TempDir("", "tlsgo")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caA := newTestCert(t, 1, pkix.Name{CommonName: "CA A"}, nil)
+	agentA := newTestCert(t, 2, pkix.Name{CommonName: "Agent A"}, caA)
+	caB := newTestCert(t, 1, pkix.Name{CommonName: "CA B"}, nil)
+	agentB := newTestCert(t, 2, pkix.Name{CommonName: "Agent B"}, caB)
+
+	cfgA := Config{
+		Accept:   ConnCert,
+		Connect:  ConnCert,
+		CAFile:   writePEM(t, filepath.Join(dir, "a.crt"), "CERTIFICATE", caA.cert.Raw),
+		CertFile: writePEM(t, filepath.Join(dir, "agent_a.crt"), "CERTIFICATE", agentA.cert.Raw),
+		KeyFile:  writePEM(t, filepath.Join(dir, "agent_a.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(agentA.key)),
+	}
+	cfgB := Config{
+		Connect:  ConnCert,
+		CAFile:   writePEM(t, filepath.Join(dir, "b.crt"), "CERTIFICATE", caB.cert.Raw),
+		CertFile: writePEM(t, filepath.Join(dir, "agent_b.crt"), "CERTIFICATE", agentB.cert.Raw),
+		KeyFile:  writePEM(t, filepath.Join(dir, "agent_b.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(agentB.key)),
+	}
+
+	if err = Init(&cfgA); err != nil {
+		t.Fatalf("cannot initialize TLS: %s", err)
+	}
+	if err = InitConfig(&cfgB); err != nil {
+		t.Fatalf("cannot initialize TLS configuration: %s", err)
+	}
+
+	if clientErr, serverErr := connect(t, &cfgA, &cfgA); clientErr != nil || serverErr != nil {
+		t.Errorf("unexpected errors: client: %v, server: %v", clientErr, serverErr)
+	}
+
+	// the test server uses default context with certificate signed by CA A, which is not trusted by
+	// the client using CA B
+	if clientErr, _ := connect(t, &cfgB, &cfgA); clientErr == nil {
+		t.Errorf("expected certificate verification error")
+	} else if !strings.Contains(clientErr.Error(), "certificate verify failed") {
+		t.Errorf("unexpected client error: %s", clientErr)
+	}
+}
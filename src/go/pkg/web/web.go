@@ -50,7 +50,7 @@ func Get(url string, timeout time.Duration, dump bool) (string, error) {
 			Proxy:             http.ProxyFromEnvironment,
 			DisableKeepAlives: true,
 			DialContext: (&net.Dialer{
-				LocalAddr: &net.TCPAddr{IP: net.ParseIP(agent.Options.SourceIP), Port: 0},
+				LocalAddr: &net.TCPAddr{IP: net.ParseIP(agent.CurrentOptions().SourceIP), Port: 0},
 			}).DialContext,
 		},
 		Timeout:       timeout,
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"zabbix.com/pkg/log"
@@ -39,8 +40,15 @@ const (
 )
 
 const headerSize = 4 + 1 + 4 + 4
+const largeHeaderSize = 4 + 1 + 8 + 8
 const tcpProtocol = byte(0x01)
 const zlibCompress = byte(0x02)
+const largePacket = byte(0x04)
+
+const (
+	maxRecvDataSize      = 128 * 1048576
+	maxRecvLargeDataSize = 1024 * 1048576
+)
 
 const (
 	connStateAccept = iota + 1
@@ -60,6 +68,8 @@ type Connection struct {
 type Listener struct {
 	listener  net.Listener
 	tlsconfig *tls.Config
+	// protects tlsconfig, which can be replaced when TLS files are reloaded
+	mutex sync.Mutex
 }
 
 func Open(address string, localAddr *net.Addr, timeout time.Duration, timeoutMode int, args ...interface{}) (c *Connection, err error) {
@@ -100,16 +110,35 @@ func (c *Connection) write(w io.Writer, data []byte) (err error) {
 		buf.Write(data)
 	}
 
+	// messages exceeding the standard size limit are accepted only with large packet header
+	large := uint64(buf.Len()) > maxRecvDataSize || uint64(len(data)) > maxRecvDataSize
+	return writePacket(w, flags, buf.Bytes(), len(data), large)
+}
+
+// writePacket writes message header followed by the payload, dataLen is the uncompressed data length
+func writePacket(w io.Writer, flags byte, payload []byte, dataLen int, large bool) (err error) {
 	var b bytes.Buffer
-	b.Grow(buf.Len() + headerSize)
-	b.Write([]byte{'Z', 'B', 'X', 'D', flags})
-	if err = binary.Write(&b, binary.LittleEndian, uint32(buf.Len())); nil != err {
-		return err
-	}
-	if err = binary.Write(&b, binary.LittleEndian, uint32(len(data))); nil != err {
-		return err
+	if large {
+		flags |= largePacket
+		b.Grow(len(payload) + largeHeaderSize)
+		b.Write([]byte{'Z', 'B', 'X', 'D', flags})
+		if err = binary.Write(&b, binary.LittleEndian, uint64(len(payload))); nil != err {
+			return err
+		}
+		if err = binary.Write(&b, binary.LittleEndian, uint64(dataLen)); nil != err {
+			return err
+		}
+	} else {
+		b.Grow(len(payload) + headerSize)
+		b.Write([]byte{'Z', 'B', 'X', 'D', flags})
+		if err = binary.Write(&b, binary.LittleEndian, uint32(len(payload))); nil != err {
+			return err
+		}
+		if err = binary.Write(&b, binary.LittleEndian, uint32(dataLen)); nil != err {
+			return err
+		}
 	}
-	b.Write(buf.Bytes())
+	b.Write(payload)
 	_, err = w.Write(b.Bytes())
 
 	return err
@@ -130,10 +159,9 @@ func (c *Connection) WriteString(s string) error {
 }
 
 func (c *Connection) read(r io.Reader, pending []byte) ([]byte, error) {
-	const maxRecvDataSize = 128 * 1048576
 	var total int
 	var b [2048]byte
-	var reservedSize uint32
+	var expectedSize, reservedSize uint64
 
 	s := b[:]
 	if pending != nil {
@@ -173,33 +201,62 @@ func (c *Connection) read(r io.Reader, pending []byte) ([]byte, error) {
 		return nil, fmt.Errorf("Message is using unsupported protocol version.")
 	}
 
-	expectedSize := binary.LittleEndian.Uint32(s[5:9])
+	hdrSize := headerSize
+	maxSize := uint64(maxRecvDataSize)
+	if 0 != (flags & largePacket) {
+		hdrSize = largeHeaderSize
+		maxSize = maxRecvLargeDataSize
 
-	if expectedSize > maxRecvDataSize {
-		return nil, fmt.Errorf("Message size %d exceeds the maximum size %d bytes.", expectedSize, maxRecvDataSize)
+		for total < hdrSize {
+			n, err := r.Read(s[total:])
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("Cannot read message: '%s'", err)
+			}
+
+			if n == 0 {
+				return nil, fmt.Errorf("Message is missing header.")
+			}
+
+			total += n
+		}
+
+		expectedSize = binary.LittleEndian.Uint64(s[5:13])
+		reservedSize = binary.LittleEndian.Uint64(s[13:21])
+	} else {
+		expectedSize = uint64(binary.LittleEndian.Uint32(s[5:9]))
+		reservedSize = uint64(binary.LittleEndian.Uint32(s[9:13]))
 	}
 
-	if int(expectedSize) < total-headerSize {
+	if expectedSize > maxSize {
+		return nil, fmt.Errorf("Message size %d exceeds the maximum size %d bytes.", expectedSize, maxSize)
+	}
+
+	if int(expectedSize) < total-hdrSize {
 		return nil, fmt.Errorf("Message is longer than expected.")
 	}
 
 	if 0 != (flags & zlibCompress) {
-		reservedSize = binary.LittleEndian.Uint32(s[9:13])
+		if 0 != (flags&largePacket) && reservedSize > maxSize {
+			return nil, fmt.Errorf("Uncompressed message size %d exceeds the maximum size %d bytes.",
+				reservedSize, maxSize)
+		}
+	} else {
+		reservedSize = 0
 	}
 
-	if int(expectedSize) == total-headerSize {
+	if int(expectedSize) == total-hdrSize {
 		if 0 != (flags & zlibCompress) {
-			return c.uncompress(s[headerSize:total], reservedSize)
+			return c.uncompress(s[hdrSize:total], reservedSize)
 		}
-		return s[headerSize:total], nil
+		return s[hdrSize:total], nil
 	}
 
 	sTmp := make([]byte, expectedSize+1)
-	if total > headerSize {
-		copy(sTmp, s[headerSize:total])
+	if total > hdrSize {
+		copy(sTmp, s[hdrSize:total])
 	}
 	s = sTmp
-	total = total - headerSize
+	total = total - hdrSize
 
 	for total < int(expectedSize) {
 		n, err := r.Read(s[total:])
@@ -224,7 +281,7 @@ func (c *Connection) read(r io.Reader, pending []byte) ([]byte, error) {
 	return s[:total], nil
 }
 
-func (c *Connection) uncompress(data []byte, expLen uint32) ([]byte, error) {
+func (c *Connection) uncompress(data []byte, expLen uint64) ([]byte, error) {
 	var b bytes.Buffer
 
 	b.Grow(int(expLen))
@@ -237,7 +294,7 @@ func (c *Connection) uncompress(data []byte, expLen uint32) ([]byte, error) {
 	if nil != err {
 		return nil, fmt.Errorf("Unable to uncompress message: '%s'", err)
 	}
-	if len != int64(expLen) {
+	if uint64(len) != expLen {
 		return nil, fmt.Errorf("Uncompressed message size %d instead of expected %d.", len, expLen)
 	}
 	return b.Bytes(), nil
@@ -307,12 +364,22 @@ func (l *Listener) Accept(timeout time.Duration, timeoutMode int) (c *Connection
 	if conn, err = l.listener.Accept(); err != nil {
 		return
 	} else {
-		c = &Connection{conn: conn, tlsConfig: l.tlsconfig, state: connStateAccept, timeout: timeout,
+		l.mutex.Lock()
+		tlsconfig := l.tlsconfig
+		l.mutex.Unlock()
+		c = &Connection{conn: conn, tlsConfig: tlsconfig, state: connStateAccept, timeout: timeout,
 			timeoutMode: timeoutMode}
 	}
 	return
 }
 
+// SetTLSConfig replaces TLS configuration used for the connections accepted afterwards
+func (l *Listener) SetTLSConfig(tlsconfig *tls.Config) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tlsconfig = tlsconfig
+}
+
 func (c *Connection) Close() (err error) {
 	if c.conn != nil {
 		err = c.conn.Close()
@@ -320,6 +387,12 @@ func (c *Connection) Close() (err error) {
 	return
 }
 
+// SetDeadline sets absolute read and write deadline, used with fixed timeout mode to apply
+// different timeouts to requests sent over the same connection
+func (c *Connection) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
 func (c *Connection) SetCompress(compress bool) {
 	c.compress = compress
 }
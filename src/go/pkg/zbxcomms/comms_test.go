@@ -21,6 +21,7 @@ package zbxcomms
 
 import (
 	"bytes"
+	"compress/zlib"
 	"io"
 	"testing"
 )
@@ -131,3 +132,59 @@ func TestReceive(t *testing.T) {
 		})
 	}
 }
+
+func TestLargePacket(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789ABCDEF"), 1024)
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		c := Connection{compress: compress}
+		if err := c.write(&buf, data); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+		if buf.Bytes()[4]&largePacket != 0 {
+			t.Errorf("Expected large packet flag not to be set for message within standard size limit")
+		}
+
+		payload := data
+		flags := tcpProtocol
+		if compress {
+			var z bytes.Buffer
+			w := zlib.NewWriter(&z)
+			_, _ = w.Write(data)
+			w.Close()
+			payload = z.Bytes()
+			flags |= zlibCompress
+		}
+		buf.Reset()
+		if err := writePacket(&buf, flags, payload, len(data), true); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+		if buf.Bytes()[4]&largePacket == 0 {
+			t.Errorf("Expected large packet flag to be set")
+		}
+		if buf.Len() != len(payload)+largeHeaderSize {
+			t.Errorf("Expected %d bytes while got %d", len(payload)+largeHeaderSize, buf.Len())
+		}
+
+		received, err := c.read(&buf, nil)
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("Received data does not match sent data")
+		}
+	}
+
+	packet := []byte("ZBXD\x05\x0A\x00\x00\x00\x00\x00\x00\x00\x0A\x00\x00\x00\x00\x00\x00\x00agent.ping")
+	var c Connection
+	if data, err := c.read(bytes.NewReader(packet), nil); err != nil || string(data) != "agent.ping" {
+		t.Errorf("Expected 'agent.ping' while got '%s' (%v)", data, err)
+	}
+	if _, err := c.read(bytes.NewReader(packet[:17]), nil); err == nil {
+		t.Errorf("Expected error for incomplete large packet header")
+	}
+	packet = []byte("ZBXD\x05\x0A\x00\x00\x00\x01\x00\x00\x00\x0A\x00\x00\x00\x00\x00\x00\x00agent.ping")
+	if _, err := c.read(bytes.NewReader(packet), nil); err == nil {
+		t.Errorf("Expected error for message exceeding maximum size")
+	}
+}
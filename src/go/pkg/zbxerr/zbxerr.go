@@ -97,4 +97,5 @@ var (
 	ErrorUnsupportedMetric   = New("unsupported metric")
 	ErrorEmptyResult         = New("empty result")
 	ErrorUnknownSession      = New("unknown session")
+	ErrorBackendUnavailable  = New("backend unavailable")
 )
@@ -89,6 +89,49 @@ type Session interface {
 	Ping() error
 }
 
+// contextSession limits session operation time by the context deadline. The mgo driver does not
+// support contexts, so the remaining time is passed to server as maxTimeMS to abort queries.
+type contextSession struct {
+	Session
+	ctx context.Context
+}
+
+// newContextSession returns session wrapper limiting operations by the context deadline.
+func newContextSession(ctx context.Context, s Session) Session {
+	if _, ok := ctx.Deadline(); !ok {
+		return s
+	}
+
+	return &contextSession{Session: s, ctx: ctx}
+}
+
+// GetMaxTimeMS returns the session timeout or the time left until context deadline, whichever is smaller.
+func (s *contextSession) GetMaxTimeMS() int64 {
+	maxTime := s.Session.GetMaxTimeMS()
+
+	if deadline, ok := s.ctx.Deadline(); ok {
+		left := time.Until(deadline).Milliseconds()
+		if left < 1 {
+			left = 1
+		}
+
+		if left < maxTime {
+			maxTime = left
+		}
+	}
+
+	return maxTime
+}
+
+// Ping checks if the context is not cancelled before sending ping command.
+func (s *contextSession) Ping() error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Session.Ping()
+}
+
 // Database is an interface to access to the database struct.
 type Database interface {
 	C(name string) Collection
@@ -20,6 +20,7 @@
 package mongodb
 
 import (
+	"context"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -39,13 +40,20 @@ type Plugin struct {
 	plugin.Base
 	connMgr *ConnManager
 	options PluginOptions
+	breaker *plugin.Breaker
 }
 
 // impl is the pointer to the plugin implementation.
 var impl Plugin
 
 // Export implements the Exporter interface.
-func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider) (result interface{}, err error) {
+func (p *Plugin) Export(key string, rawParams []string, pctx plugin.ContextProvider) (result interface{}, err error) {
+	return p.ExportWithContext(context.Background(), key, rawParams, pctx)
+}
+
+// ExportWithContext implements the ExporterWithContext interface.
+func (p *Plugin) ExportWithContext(ctx context.Context, key string, rawParams []string,
+	_ plugin.ContextProvider) (result interface{}, err error) {
 	params, err := metrics[key].EvalParams(rawParams, p.options.Sessions)
 	if err != nil {
 		return nil, err
@@ -61,8 +69,18 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 		return nil, zbxerr.ErrorUnsupportedMetric
 	}
 
+	if err = p.breaker.Allow(uri.Addr()); err != nil {
+		if key == keyPing {
+			return pingFailed, nil
+		}
+
+		return nil, err
+	}
+
 	conn, err := p.connMgr.GetConnection(*uri)
 	if err != nil {
+		p.breaker.Failure(uri.Addr())
+
 		// Special logic of processing connection errors should be used if mongodb.ping is requested
 		// because it must return pingFailed if any error occurred.
 		if key == keyPing {
@@ -74,7 +92,15 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 		return nil, err
 	}
 
-	result, err = handleMetric(conn, params)
+	result, err = handleMetric(newContextSession(ctx, conn), params)
+
+	// failed ping means unavailable backend, although it's not returned as error
+	if key == keyPing && result == pingFailed {
+		p.breaker.Failure(uri.Addr())
+	} else {
+		p.breaker.Done(uri.Addr(), err)
+	}
+
 	if err != nil {
 		p.Errf(err.Error())
 	}
@@ -82,8 +108,16 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 	return result, err
 }
 
+// ShareExport implements the ExportSharing interface. The query results do not depend on item,
+// so the same query requested by several clients at the same time is performed once.
+func (p *Plugin) ShareExport(key string) bool {
+	return true
+}
+
 // Start implements the Runner interface and performs initialization when plugin is activated.
 func (p *Plugin) Start() {
+	p.breaker = plugin.NewBreaker(p.options.BreakerThreshold, time.Duration(p.options.BreakerTimeout)*time.Second)
+
 	p.connMgr = NewConnManager(
 		time.Duration(p.options.KeepAlive)*time.Second,
 		time.Duration(p.options.Timeout)*time.Second,
@@ -95,6 +129,7 @@ func (p *Plugin) Start() {
 func (p *Plugin) Stop() {
 	p.connMgr.Destroy()
 	p.connMgr = nil
+	p.breaker = nil
 }
 
 type MongoLogger struct {
@@ -37,6 +37,13 @@ type PluginOptions struct {
 	// KeepAlive is a time to wait before unused connections will be closed.
 	KeepAlive int `conf:"optional,range=60:900,default=300"`
 
+	// BreakerThreshold is the number of consecutive connection errors after which requests to the same
+	// server are rejected for BreakerTimeout seconds. Zero disables the circuit breaker.
+	BreakerThreshold int `conf:"optional,range=0:100,default=0"`
+
+	// BreakerTimeout is a time in seconds to reject requests to the unavailable server.
+	BreakerTimeout int `conf:"optional,range=1:3600,default=60"`
+
 	// Sessions stores pre-defined named sets of connections settings.
 	Sessions map[string]conf.Session `conf:"optional"`
 }
@@ -99,6 +99,12 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 	return result, err
 }
 
+// ShareExport implements the ExportSharing interface. The query results do not depend on item,
+// so the same query requested by several clients at the same time is performed once.
+func (p *Plugin) ShareExport(key string) bool {
+	return true
+}
+
 // Start implements the Runner interface and performs initialization when plugin is activated.
 func (p *Plugin) Start() {
 	queryStorage, err := yarn.New(http.Dir(p.options.CustomQueriesPath), "*"+sqlExt)
@@ -44,13 +44,20 @@ type Plugin struct {
 	plugin.Base
 	connMgr *ConnManager
 	options PluginOptions
+	breaker *plugin.Breaker
 }
 
 // impl is the pointer to the plugin implementation.
 var impl Plugin
 
 // Export implements the Exporter interface.
-func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider) (result interface{}, err error) {
+func (p *Plugin) Export(key string, rawParams []string, pctx plugin.ContextProvider) (result interface{}, err error) {
+	return p.ExportWithContext(context.Background(), key, rawParams, pctx)
+}
+
+// ExportWithContext implements the ExporterWithContext interface.
+func (p *Plugin) ExportWithContext(ctx context.Context, key string, rawParams []string,
+	_ plugin.ContextProvider) (result interface{}, err error) {
 	var extraParams []string
 
 	params, err := metrics[key].EvalParams(rawParams, p.options.Sessions)
@@ -74,8 +81,18 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 		return nil, zbxerr.ErrorUnsupportedMetric
 	}
 
+	if err = p.breaker.Allow(uri.Addr()); err != nil {
+		if key == keyPing {
+			return pingFailed, nil
+		}
+
+		return nil, err
+	}
+
 	conn, err := p.connMgr.GetConnection(*uri)
 	if err != nil {
+		p.breaker.Failure(uri.Addr())
+
 		// Special logic of processing connection errors should be used if pgsql.ping is requested
 		// because it must return pingFailed if any error occurred.
 		if key == keyPing {
@@ -87,10 +104,29 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(conn.ctx, conn.callTimeout)
+	// the query is cancelled when the connection is closed or the export is cancelled
+	queryCtx, cancel := context.WithTimeout(conn.ctx, conn.callTimeout)
 	defer cancel()
 
-	result, err = handleMetric(ctx, conn, key, params, extraParams...)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	result, err = handleMetric(queryCtx, conn, key, params, extraParams...)
+
+	// failed ping means unavailable backend, although it's not returned as error
+	if key == keyPing && result == pingFailed {
+		p.breaker.Failure(uri.Addr())
+	} else {
+		p.breaker.Done(uri.Addr(), err)
+	}
 
 	if err != nil {
 		p.Errf(err.Error())
@@ -99,8 +135,16 @@ func (p *Plugin) Export(key string, rawParams []string, _ plugin.ContextProvider
 	return result, err
 }
 
+// ShareExport implements the ExportSharing interface. The query results do not depend on item,
+// so the same query requested by several clients at the same time is performed once.
+func (p *Plugin) ShareExport(key string) bool {
+	return true
+}
+
 // Start implements the Runner interface and performs initialization when plugin is activated.
 func (p *Plugin) Start() {
+	p.breaker = plugin.NewBreaker(p.options.BreakerThreshold, time.Duration(p.options.BreakerTimeout)*time.Second)
+
 	queryStorage, err := yarn.New(http.Dir(p.options.CustomQueriesPath), "*"+sqlExt)
 	if err != nil {
 		p.Errf(err.Error())
@@ -121,4 +165,5 @@ func (p *Plugin) Start() {
 func (p *Plugin) Stop() {
 	p.connMgr.Destroy()
 	p.connMgr = nil
+	p.breaker = nil
 }
@@ -34,6 +34,7 @@ type Plugin struct {
 	plugin.Base
 	connMgr *ConnManager
 	options PluginOptions
+	breaker *plugin.Breaker
 }
 
 // impl is the pointer to the plugin implementation.
@@ -56,8 +57,18 @@ func (p *Plugin) Export(key string, rawParams []string, ctx plugin.ContextProvid
 		return nil, zbxerr.ErrorUnsupportedMetric
 	}
 
+	if err = p.breaker.Allow(uri.Addr()); err != nil {
+		if key == keyPing {
+			return pingFailed, nil
+		}
+
+		return nil, err
+	}
+
 	conn, err := p.connMgr.GetConnection(*uri)
 	if err != nil {
+		p.breaker.Failure(uri.Addr())
+
 		// Special logic of processing connection errors is used if redis.ping is requested
 		// because it must return pingFailed if any error occurred.
 		if key == keyPing {
@@ -70,6 +81,14 @@ func (p *Plugin) Export(key string, rawParams []string, ctx plugin.ContextProvid
 	}
 
 	result, err = handleMetric(conn, params)
+
+	// failed ping means unavailable backend, although it's not returned as error
+	if key == keyPing && result == pingFailed {
+		p.breaker.Failure(uri.Addr())
+	} else {
+		p.breaker.Done(uri.Addr(), err)
+	}
+
 	if err != nil {
 		p.Errf(err.Error())
 	}
@@ -77,8 +96,16 @@ func (p *Plugin) Export(key string, rawParams []string, ctx plugin.ContextProvid
 	return result, err
 }
 
+// ShareExport implements the ExportSharing interface. The query results do not depend on item,
+// so the same query requested by several clients at the same time is performed once.
+func (p *Plugin) ShareExport(key string) bool {
+	return true
+}
+
 // Start implements the Runner interface and performs initialization when plugin is activated.
 func (p *Plugin) Start() {
+	p.breaker = plugin.NewBreaker(p.options.BreakerThreshold, time.Duration(p.options.BreakerTimeout)*time.Second)
+
 	p.connMgr = NewConnManager(
 		time.Duration(p.options.KeepAlive)*time.Second,
 		time.Duration(p.options.Timeout)*time.Second,
@@ -90,4 +117,5 @@ func (p *Plugin) Start() {
 func (p *Plugin) Stop() {
 	p.connMgr.Destroy()
 	p.connMgr = nil
+	p.breaker = nil
 }